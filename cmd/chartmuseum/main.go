@@ -18,10 +18,10 @@ package main
 
 import (
 	"fmt"
+	"github.com/Waterdrips/chartmuseum/pkg/chartmuseum"
+	"github.com/Waterdrips/chartmuseum/pkg/config"
 	"github.com/chartmuseum/storage"
 	"helm.sh/chartmuseum/pkg/cache"
-	"helm.sh/chartmuseum/pkg/chartmuseum"
-	"helm.sh/chartmuseum/pkg/config"
 	"log"
 	"os"
 	"strings"
@@ -102,6 +102,27 @@ func cliHandler(c *cli.Context) {
 		EnforceSemver2:         conf.GetBool("enforce-semver2"),
 		CacheInterval:          conf.GetDuration("cacheinterval"),
 		Host:                   conf.GetString("listen.host"),
+		RetentionConfig:        conf.GetString("retention.config"),
+		RetentionInterval:      conf.GetDuration("retention.interval"),
+		ChartFilesCacheSize:    conf.GetString("chartfilescachesize"),
+		VerifyKeyring:          conf.GetString("verifykeyring"),
+		RequireSignedCharts:    conf.GetBool("requiresignedcharts"),
+		SignedOnlyRepos:        conf.GetString("signedonlyrepos"),
+		StagingTimeout:         conf.GetDuration("stagingtimeout"),
+		WebhooksConfig:         conf.GetString("webhooks.config"),
+		AuditStore:             conf.GetString("audit.store"),
+		AuditFile:              conf.GetString("audit.file"),
+		StorageQuota:           conf.GetString("quota.default"),
+		StorageQuotaConfig:     conf.GetString("quota.config"),
+		TenantsConfig:          conf.GetString("tenants.config"),
+		EnableTenantYAML:       conf.GetBool("tenants.enableyaml"),
+		LintPolicy:             conf.GetString("lint.policy"),
+		UploadPolicyConfig:     conf.GetString("uploadpolicy.config"),
+		ProtectReleases:        conf.GetBool("protectreleases"),
+		ProtectedVersions:      conf.GetString("protectedversions"),
+		EnableOCI:              conf.GetBool("enableoci"),
+		ProxyConfig:            conf.GetString("proxy.config"),
+		ProxyInterval:          conf.GetDuration("proxy.interval"),
 	}
 
 	server, err := newServer(options)
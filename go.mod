@@ -13,6 +13,8 @@ replace (
 require (
 	github.com/Masterminds/semver/v3 v3.1.1
 	github.com/alicebob/miniredis v2.5.0+incompatible
+	github.com/andybalholm/brotli v1.0.2
+	github.com/aws/aws-sdk-go v1.37.28
 	github.com/chartmuseum/auth v0.4.5
 	github.com/chartmuseum/storage v0.10.5
 	github.com/ghodss/yaml v1.0.0
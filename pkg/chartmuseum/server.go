@@ -17,14 +17,17 @@ limitations under the License.
 package chartmuseum
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 	"time"
 
+	mt "github.com/Waterdrips/chartmuseum/pkg/chartmuseum/server/multitenant"
 	"github.com/chartmuseum/storage"
 	"helm.sh/chartmuseum/pkg/cache"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
-	mt "helm.sh/chartmuseum/pkg/chartmuseum/server/multitenant"
+	"helm.sh/helm/v3/pkg/provenance"
 )
 
 type (
@@ -72,6 +75,46 @@ type (
 		CacheInterval  time.Duration
 		Host           string
 		Version        string
+		// RetentionConfig is the path of a YAML file with the retention rules used to prune chart versions
+		RetentionConfig   string
+		RetentionInterval time.Duration
+		// ChartFilesCacheSize is the maximum size of the files extracted from chart packages kept in memory, such as "100Mi"
+		ChartFilesCacheSize string
+		// VerifyKeyring is the path of a keyring used to verify uploaded provenance files
+		VerifyKeyring string
+		// RequireSignedCharts makes every repo only accept and serve chart versions with a verified provenance file
+		RequireSignedCharts bool
+		// SignedOnlyRepos is a comma-separated list of repos (or glob patterns) which only accept and serve signed chart versions
+		SignedOnlyRepos string
+		// StagingTimeout is the age after which files staged by interrupted uploads are deleted
+		StagingTimeout time.Duration
+		// WebhooksConfig is the path of a YAML file with the webhooks notified of chart events
+		WebhooksConfig string
+		// AuditStore is where the audit log of write operations is kept, "storage" or "local" (disabled if empty)
+		AuditStore string
+		// AuditFile is the path of the file the audit log is appended to, with the "local" audit store
+		AuditFile string
+		// StorageQuota is the default storage quota of each repo, such as "10Gi" (no quota if empty)
+		StorageQuota string
+		// StorageQuotaConfig is the path of a YAML file with storage quotas overriding the default one
+		StorageQuotaConfig string
+		// TenantsConfig is the path of a YAML file with settings overriding the server ones for some repos
+		TenantsConfig string
+		// EnableTenantYAML allows each repo to override the server settings with a tenant.yaml stored in it
+		EnableTenantYAML bool
+		// LintPolicy is off, warn or reject, what is done with the lint findings of uploaded chart packages
+		LintPolicy string
+		// UploadPolicyConfig is the path of a YAML file with policies uploaded chart packages must follow
+		UploadPolicyConfig string
+		// ProtectReleases makes release (non-prerelease) versions immutable once published
+		ProtectReleases bool
+		// ProtectedVersions is a comma-separated list of regular expressions matching chart versions which are immutable once published
+		ProtectedVersions string
+		// EnableOCI serves the OCI distribution API below /v2/, to push and pull charts as OCI artifacts
+		EnableOCI bool
+		// ProxyConfig is the path of a YAML file with the upstream chart repositories proxied by some repos
+		ProxyConfig   string
+		ProxyInterval time.Duration
 	}
 
 	// Server is a generic interface for web servers
@@ -120,6 +163,124 @@ func NewServer(options ServerOptions) (Server, error) {
 		Host:              options.Host,
 	})
 
+	var retentionRules []*mt.RetentionRule
+	if options.RetentionConfig != "" {
+		retentionRules, err = mt.LoadRetentionRules(options.RetentionConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var webhooks []*mt.Webhook
+	if options.WebhooksConfig != "" {
+		webhooks, err = mt.LoadWebhooks(options.WebhooksConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var chartFilesCacheSize int64
+	if options.ChartFilesCacheSize != "" {
+		chartFilesCacheSize, err = mt.ParseByteSize(options.ChartFilesCacheSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var storageQuota int64
+	if options.StorageQuota != "" {
+		storageQuota, err = mt.ParseByteSize(options.StorageQuota)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var storageQuotas []*mt.StorageQuota
+	if options.StorageQuotaConfig != "" {
+		storageQuotas, err = mt.LoadStorageQuotas(options.StorageQuotaConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lintPolicy := options.LintPolicy
+	if lintPolicy == "" {
+		lintPolicy = mt.LintPolicyOff
+	}
+	if err := mt.ValidateLintPolicy(lintPolicy); err != nil {
+		return nil, err
+	}
+
+	var uploadPolicies []*mt.UploadPolicy
+	if options.UploadPolicyConfig != "" {
+		uploadPolicies, err = mt.LoadUploadPolicies(options.UploadPolicyConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var protectedVersionPatterns []string
+	for _, pattern := range strings.Split(options.ProtectedVersions, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			protectedVersionPatterns = append(protectedVersionPatterns, pattern)
+		}
+	}
+	protectedVersions, err := mt.CompileProtectedVersions(protectedVersionPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenantOverrides []*mt.TenantOverrides
+	if options.TenantsConfig != "" {
+		tenantOverrides, err = mt.LoadTenantOverrides(options.TenantsConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var upstreamProxies []*mt.UpstreamProxy
+	if options.ProxyConfig != "" {
+		upstreamProxies, err = mt.LoadUpstreamProxies(options.ProxyConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var auditStore mt.AuditStore
+	switch options.AuditStore {
+	case "":
+	case "storage":
+		auditStore = mt.NewStorageAuditStore(options.StorageBackend)
+	case "local":
+		if options.AuditFile == "" {
+			return nil, errors.New("a file to append the audit log to is required for the local audit store")
+		}
+		auditStore, err = mt.NewLocalFileAuditStore(options.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported audit store %q", options.AuditStore)
+	}
+
+	var signedOnlyRepos []string
+	for _, repo := range strings.Split(options.SignedOnlyRepos, ",") {
+		if repo = strings.Trim(strings.TrimSpace(repo), "/"); repo != "" {
+			signedOnlyRepos = append(signedOnlyRepos, repo)
+		}
+	}
+	if (options.RequireSignedCharts || len(signedOnlyRepos) > 0) && options.VerifyKeyring == "" {
+		return nil, errors.New("a keyring to verify provenance files is required for signed-only repos")
+	}
+
+	var provenanceVerifier *provenance.Signatory
+	if options.VerifyKeyring != "" {
+		provenanceVerifier, err = provenance.NewFromKeyring(options.VerifyKeyring, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	server, err := mt.NewMultiTenantServer(mt.MultiTenantServerOptions{
 		Logger:                 logger,
 		Router:                 router,
@@ -140,6 +301,26 @@ func NewServer(options ServerOptions) (Server, error) {
 		EnforceSemver2:         options.EnforceSemver2,
 		Version:                options.Version,
 		CacheInterval:          options.CacheInterval,
+		RetentionRules:         retentionRules,
+		RetentionInterval:      options.RetentionInterval,
+		ChartFilesCacheSize:    chartFilesCacheSize,
+		ProvenanceVerifier:     provenanceVerifier,
+		RequireSignedCharts:    options.RequireSignedCharts,
+		SignedOnlyRepos:        signedOnlyRepos,
+		StagingTimeout:         options.StagingTimeout,
+		Webhooks:               webhooks,
+		AuditStore:             auditStore,
+		StorageQuota:           storageQuota,
+		StorageQuotas:          storageQuotas,
+		TenantOverrides:        tenantOverrides,
+		EnableTenantYAML:       options.EnableTenantYAML,
+		LintPolicy:             lintPolicy,
+		UploadPolicies:         uploadPolicies,
+		ProtectReleases:        options.ProtectReleases,
+		ProtectedVersions:      protectedVersions,
+		EnableOCI:              options.EnableOCI,
+		UpstreamProxies:        upstreamProxies,
+		ProxyInterval:          options.ProxyInterval,
 	})
 
 	return server, err
@@ -17,13 +17,15 @@ limitations under the License.
 package multitenant
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
 	pathutil "path/filepath"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
-	"github.com/chartmuseum/storage"
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
@@ -54,6 +56,42 @@ func (server *MultiTenantServer) getAllCharts(log cm_logger.LoggingFn, repo stri
 	return result, nil
 }
 
+func (server *MultiTenantServer) searchCharts(log cm_logger.LoggingFn, repo string, query string, offset int, limit int) ([]*SearchResult, *HTTPError) {
+	terms, parseErr := parseSearchQuery(query)
+	if parseErr != nil {
+		return nil, &HTTPError{http.StatusBadRequest, parseErr.Error()}
+	}
+	indexFile, err := server.getIndexFile(log, repo)
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Message}
+	}
+	results := []*SearchResult{}
+	for name, chartVersions := range indexFile.Entries {
+		if len(chartVersions) == 0 {
+			continue
+		}
+		// entries are sorted by Regenerate, newest version first
+		latest := chartVersions[0]
+		if score := scoreChartVersion(latest, terms); score > 0 {
+			results = append(results, &SearchResult{Name: name, Score: score, Chart: latest})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	if offset >= len(results) {
+		return []*SearchResult{}, nil
+	}
+	end := len(results)
+	if limit != -1 && offset+limit < end {
+		end = offset + limit
+	}
+	return results[offset:end], nil
+}
+
 func (server *MultiTenantServer) getChart(log cm_logger.LoggingFn, repo string, name string) (helm_repo.ChartVersions, *HTTPError) {
 	allCharts, err := server.getAllCharts(log, repo, 0, -1)
 	if err != nil {
@@ -66,22 +104,89 @@ func (server *MultiTenantServer) getChart(log cm_logger.LoggingFn, repo string,
 	return chart, nil
 }
 
-func (server *MultiTenantServer) getChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) (*helm_repo.ChartVersion, *HTTPError) {
-	indexFile, err := server.getIndexFile(log, repo)
+func (server *MultiTenantServer) getChartVersions(log cm_logger.LoggingFn, repo string, name string, constraint string, includePrereleases bool) (helm_repo.ChartVersions, *HTTPError) {
+	chart, err := server.getChart(log, repo, name)
 	if err != nil {
-		return nil, &HTTPError{http.StatusInternalServerError, err.Message}
+		return nil, err
+	}
+	matches, matchErr := chartVersionsMatchingConstraint(chart, constraint, includePrereleases)
+	if matchErr != nil {
+		return nil, &HTTPError{http.StatusBadRequest, matchErr.Error()}
+	}
+	return matches, nil
+}
+
+func (server *MultiTenantServer) getChartVersion(log cm_logger.LoggingFn, repo string, name string, version string, includePrereleases bool) (*helm_repo.ChartVersion, *HTTPError) {
+	chart, err := server.getChart(log, repo, name)
+	if err != nil {
+		return nil, err
 	}
 	if version == "latest" {
-		version = ""
+		version = "*"
+	} else {
+		// an exact match always wins, even for versions which are not valid semver
+		for _, chartVersion := range chart {
+			if chartVersion.Version == version {
+				return chartVersion, nil
+			}
+		}
 	}
-	chartVersion, getErr := indexFile.Get(name, version)
-	if getErr != nil {
-		return nil, &HTTPError{http.StatusNotFound, getErr.Error()}
+	matches, matchErr := chartVersionsMatchingConstraint(chart, version, includePrereleases)
+	if matchErr != nil || len(matches) == 0 {
+		return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("no chart version found for %s-%s", name, version)}
 	}
-	return chartVersion, nil
+	return matches[0], nil
+}
+
+// chartVersionsMatchingConstraint returns the chart versions satisfying a semver constraint, newest first.
+// Prereleases are only included if requested, in which case they are checked against the constraint
+// using their release version (e.g. 1.5.0-beta.1 satisfies ^1.4).
+func chartVersionsMatchingConstraint(chartVersions helm_repo.ChartVersions, constraint string, includePrereleases bool) (helm_repo.ChartVersions, error) {
+	if constraint == "" {
+		constraint = "*"
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+	}
+
+	type versionPair struct {
+		version      *semver.Version
+		chartVersion *helm_repo.ChartVersion
+	}
+	var pairs []versionPair
+	for _, chartVersion := range chartVersions {
+		v, err := semver.NewVersion(chartVersion.Version)
+		if err != nil {
+			continue
+		}
+		isMatch := c.Check(v)
+		if !isMatch && includePrereleases && v.Prerelease() != "" {
+			release, _ := v.SetPrerelease("")
+			isMatch = c.Check(&release)
+		}
+		if isMatch {
+			pairs = append(pairs, versionPair{v, chartVersion})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].version.GreaterThan(pairs[j].version)
+	})
+
+	matches := helm_repo.ChartVersions{}
+	for _, pair := range pairs {
+		matches = append(matches, pair.chartVersion)
+	}
+	return matches, nil
 }
 
 func (server *MultiTenantServer) deleteChartVersion(log cm_logger.LoggingFn, repo string, name string, version string) *HTTPError {
+	if httpErr := server.checkNotUpstreamProxy(repo); httpErr != nil {
+		return httpErr
+	}
+	if httpErr := checkDelete(server.getTenantSettings(log, repo), version); httpErr != nil {
+		return httpErr
+	}
 	filename := pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(name, version))
 	log(cm_logger.DebugLevel, "Deleting package from storage",
 		"package", filename,
@@ -90,113 +195,207 @@ func (server *MultiTenantServer) deleteChartVersion(log cm_logger.LoggingFn, rep
 	if deleteObjErr != nil {
 		return &HTTPError{http.StatusNotFound, deleteObjErr.Error()}
 	}
+	server.forgetStorageObject(repo, pathutil.Base(filename))
 	provFilename := pathutil.Join(repo, cm_repo.ProvenanceFilenameFromNameVersion(name, version))
-	server.StorageBackend.DeleteObject(provFilename) // ignore error here, may be no prov file
+	if server.StorageBackend.DeleteObject(provFilename) == nil { // ignore error here, may be no prov file
+		server.forgetStorageObject(repo, pathutil.Base(provFilename))
+	}
+	server.removeChartVersionOverlay(log, repo, name, version)
+	server.removeOCIManifest(repo, name, version)
 	return nil
 }
 
-func (server *MultiTenantServer) uploadChartPackage(log cm_logger.LoggingFn, repo string, content []byte, force bool) (string, *HTTPError ){
-	filename, err := cm_repo.ChartPackageFilenameFromContent(content)
+func (server *MultiTenantServer) promoteChartVersion(log cm_logger.LoggingFn, repo string, name string, version string, targetRepo string, force bool) (*helm_repo.ChartVersion, *uploadReport, *HTTPError) {
+	if err := server.validateRepo(targetRepo); err != nil {
+		return nil, nil, &HTTPError{http.StatusBadRequest, err.Error()}
+	}
+	if targetRepo == repo {
+		return nil, nil, &HTTPError{http.StatusBadRequest, "cannot promote a chart version to the same repo"}
+	}
+	if httpErr := server.checkNotUpstreamProxy(targetRepo); httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	object, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename))
+	if err != nil {
+		return nil, nil, &HTTPError{http.StatusNotFound, "chart version not found"}
+	}
+	chartPackage, err := spoolChartPackage(bytes.NewReader(object.Content), time.Now())
 	if err != nil {
-		return filename,&HTTPError{http.StatusInternalServerError, err.Error()}
+		return nil, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
 	}
+	defer chartPackage.remove()
+	files := []*chartOrProvenanceFile{{filename: filename, field: defaultFormField, chart: chartPackage}}
 
-	if pathutil.Base(filename) != filename {
-		// Name wants to break out of current directory
-		return filename,&HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
+	var provContent []byte
+	provFilename := cm_repo.ProvenanceFilenameFromNameVersion(name, version)
+	provObject, err := server.StorageBackend.GetObject(pathutil.Join(repo, provFilename))
+	if err == nil {
+		provContent = provObject.Content
+		files = append(files, &chartOrProvenanceFile{filename: provFilename, content: provContent, field: defaultProvField})
 	}
 
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err = server.StorageBackend.GetObject(pathutil.Join(repo, filename))
-		if err == nil {
-			return filename, &HTTPError{http.StatusConflict, "file already exists"}
+	// the target repo rules apply, as if the files were uploaded there
+	for _, file := range files {
+		if status, err := server.validateChartOrProv(log, targetRepo, file, force); err != nil {
+			return nil, nil, &HTTPError{status, err.Error()}
 		}
 	}
+	report := &uploadReport{}
+	if httpErr := server.checkUploadedChartPackage(log, targetRepo, chartPackage, report); httpErr != nil {
+		return nil, report, httpErr
+	}
+	if httpErr := server.checkStorageLimit(log, targetRepo, files, force); httpErr != nil {
+		return nil, nil, httpErr
+	}
+	provenance, httpErr := server.verifyProvenance(log, targetRepo, filename, chartPackage, provContent)
+	if httpErr == nil {
+		httpErr = server.checkChartPackageSigned(targetRepo, filename, provenance)
+	}
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
 
-	if server.EnforceSemver2 {
-		version, err := cm_repo.ChartVersionFromStorageObject(storage.Object{
-			Content: content,
-			// Since we only need content to check for the chart version
-			// left the others fields to be default
-		})
-		if err != nil {
-			return filename, &HTTPError{http.StatusBadRequest, err.Error()}
+	upload := server.newStagedUpload(targetRepo)
+	for _, file := range files {
+		log(cm_logger.DebugLevel, "Promoting file to repo",
+			"filename", file.filename,
+			"repo", repo,
+			"target_repo", targetRepo,
+		)
+		if err := upload.stage(file); err != nil {
+			return nil, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
 		}
-		if _, err := semver.StrictNewVersion(version.Metadata.Version); err != nil {
-			return filename, &HTTPError{http.StatusBadRequest, fmt.Errorf("semver2 validation: %w", err).Error()}
+	}
+	if err := upload.publish(); err != nil {
+		return nil, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	if provenance != nil {
+		server.recordProvenance(log, targetRepo, provenance)
+	}
+	for _, lint := range report.lint {
+		server.recordLintReport(log, targetRepo, lint)
+	}
+	return chartPackage.chartVersion, report, nil
+}
+
+// validateRepo checks that a repo name given as a parameter (rather than in the route) is a valid tenant
+func (server *MultiTenantServer) validateRepo(repo string) error {
+	if repo == "" {
+		if server.Router.Depth == 0 || server.Router.DepthDynamic {
+			return nil
 		}
+		return fmt.Errorf("repo is required")
+	}
+	if pathutil.Clean(repo) != repo || strings.HasPrefix(repo, "/") || strings.HasPrefix(repo, "..") {
+		return fmt.Errorf("%s is improperly formatted", repo)
+	}
+	if parts := strings.Split(repo, "/"); !server.Router.DepthDynamic && len(parts) != server.Router.Depth {
+		return fmt.Errorf("%s does not match repo depth %d", repo, server.Router.Depth)
 	}
+	return nil
+}
 
-	limitReached, err := server.checkStorageLimit(repo, filename, force)
-	if err != nil {
-		return filename, &HTTPError{http.StatusInternalServerError, err.Error()}
+/*
+uploadChartPackage stores a spooled chart package, returning the chart version parsed when it was received,
+and the report of the upload with its policy violations and lint findings, whether the upload succeeded or not.
+*/
+func (server *MultiTenantServer) uploadChartPackage(log cm_logger.LoggingFn, repo string, chartPackage *spooledChartPackage, force bool) (*helm_repo.ChartVersion, *uploadReport, *HTTPError) {
+	if httpErr := server.checkNotUpstreamProxy(repo); httpErr != nil {
+		return nil, nil, httpErr
+	}
+	filename := chartPackage.filename
+	if pathutil.Base(filename) != filename {
+		// Name wants to break out of current directory
+		return nil, nil, &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
 	}
-	if limitReached {
-		return filename, &HTTPError{http.StatusInsufficientStorage, "repo has reached storage limit"}
+
+	settings := server.getTenantSettings(log, repo)
+	if httpErr := server.checkOverwrite(settings, pathutil.Join(repo, filename), chartPackage.chartVersion.Version, force, "file already exists"); httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	report := &uploadReport{}
+	if httpErr := server.checkUploadedChartPackage(log, repo, chartPackage, report); httpErr != nil {
+		return nil, report, httpErr
+	}
+
+	// a provenance file uploaded earlier must match the new package
+	provenance, httpErr := server.verifyProvenance(log, repo, filename, chartPackage, nil)
+	if httpErr == nil {
+		httpErr = server.checkChartPackageSigned(repo, filename, provenance)
+	}
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	file := &chartOrProvenanceFile{filename: filename, field: defaultFormField, chart: chartPackage}
+	if httpErr := server.checkStorageLimit(log, repo, []*chartOrProvenanceFile{file}, force); httpErr != nil {
+		return nil, nil, httpErr
 	}
 	log(cm_logger.DebugLevel, "Adding package to storage",
 		"package", filename,
+		"size", chartPackage.size,
 	)
-	err = server.StorageBackend.PutObject(pathutil.Join(repo, filename), content)
+	upload := server.newStagedUpload(repo)
+	err := upload.stage(file)
+	if err == nil {
+		err = upload.publish()
+	}
 	if err != nil {
-		return filename, &HTTPError{http.StatusInternalServerError, err.Error()}	}
-	return filename, nil
+		return nil, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	if provenance != nil {
+		server.recordProvenance(log, repo, provenance)
+	}
+	for _, lint := range report.lint {
+		server.recordLintReport(log, repo, lint)
+	}
+	return chartPackage.chartVersion, report, nil
 }
 
-func (server *MultiTenantServer) uploadProvenanceFile(log cm_logger.LoggingFn, repo string, content []byte, force bool) *HTTPError {
+// uploadProvenanceFile stores a provenance file, returning the chart version it was verified against, if any
+func (server *MultiTenantServer) uploadProvenanceFile(log cm_logger.LoggingFn, repo string, content []byte, force bool) (*helm_repo.ChartVersion, *HTTPError) {
+	if httpErr := server.checkNotUpstreamProxy(repo); httpErr != nil {
+		return nil, httpErr
+	}
 	filename, err := cm_repo.ProvenanceFilenameFromContent(content)
 	if err != nil {
-		return &HTTPError{http.StatusInternalServerError, err.Error()}
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
 	}
 
 	if pathutil.Base(filename) != filename {
 		// Name wants to break out of current directory
-		return &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
+		return nil, &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s is improperly formatted", filename)}
 	}
 
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err = server.StorageBackend.GetObject(pathutil.Join(repo, filename))
-		if err == nil {
-			return &HTTPError{http.StatusConflict, "file already exists"}
-		}
+	settings := server.getTenantSettings(log, repo)
+	if httpErr := server.checkOverwrite(settings, pathutil.Join(repo, filename), provenanceVersion(content), force, "file already exists"); httpErr != nil {
+		return nil, httpErr
 	}
-	limitReached, err := server.checkStorageLimit(repo, filename, force)
-	if err != nil {
-		return &HTTPError{http.StatusInternalServerError, err.Error()}
+	provenance, httpErr := server.verifyProvenance(log, repo, strings.TrimSuffix(filename, provenanceFileSuffix), nil, content)
+	if httpErr != nil {
+		return nil, httpErr
 	}
-	if limitReached {
-		return &HTTPError{http.StatusInsufficientStorage, "repo has reached storage limit"}
+	file := &chartOrProvenanceFile{filename: filename, content: content, field: defaultProvField}
+	if httpErr := server.checkStorageLimit(log, repo, []*chartOrProvenanceFile{file}, force); httpErr != nil {
+		return nil, httpErr
 	}
 	log(cm_logger.DebugLevel, "Adding provenance file to storage",
 		"provenance_file", filename,
 	)
-	err = server.StorageBackend.PutObject(pathutil.Join(repo, filename), content)
+	upload := server.newStagedUpload(repo)
+	err = upload.stage(file)
+	if err == nil {
+		err = upload.publish()
+	}
 	if err != nil {
-		return &HTTPError{http.StatusInternalServerError, err.Error()}
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
 	}
-	return nil
-}
-
-func (server *MultiTenantServer) checkStorageLimit(repo string, filename string, force bool) (bool, error) {
-	if server.MaxStorageObjects > 0 {
-		allObjects, err := server.StorageBackend.ListObjects(repo)
-		if err != nil {
-			return false, err
-		}
-		if len(allObjects) >= server.MaxStorageObjects {
-			limitReached := true
-			if server.AllowOverwrite || (server.AllowForceOverwrite && force) {
-				// if the max has been reached, we should still allow
-				// user to overwrite an existing file
-				for _, object := range allObjects {
-					if object.Path == filename {
-						limitReached = false
-						break
-					}
-				}
-			}
-			return limitReached, nil
-		}
+	if provenance == nil {
+		return nil, nil
 	}
-	return false, nil
+	server.recordProvenance(log, repo, provenance)
+	return provenance.chartVersion, nil
 }
@@ -0,0 +1,376 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	pathutil "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/chartmuseum/storage"
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// AuditActionPush is recorded for a chart package uploaded for a new chart version
+	AuditActionPush = "push"
+	// AuditActionOverwrite is recorded for a chart package replacing an existing one, with --allow-overwrite
+	AuditActionOverwrite = "overwrite"
+	// AuditActionForceOverwrite is recorded for a chart package replacing an existing one, with ?force
+	AuditActionForceOverwrite = "force-overwrite"
+	// AuditActionProvenance is recorded for an uploaded provenance file
+	AuditActionProvenance = "provenance"
+	// AuditActionDelete is recorded for a deleted chart version, either through the API or by retention rules
+	AuditActionDelete = "delete"
+
+	// auditPrefix is the prefix, below each tenant, where the storage audit store writes its records.
+	// As a nested prefix it is left out when listing the objects of the tenant.
+	auditPrefix = ".audit"
+)
+
+type (
+	// AuditRecord is an entry of the audit log, recording a write operation on a chart version
+	AuditRecord struct {
+		ID        string    `json:"id"`
+		Timestamp time.Time `json:"timestamp"`
+		Action    string    `json:"action"`
+		Repo      string    `json:"repo"`
+		Name      string    `json:"name"`
+		Version   string    `json:"version"`
+		Digest    string    `json:"digest,omitempty"`
+		ClientIP  string    `json:"clientIP,omitempty"`
+		RequestID string    `json:"requestID,omitempty"`
+		Principal string    `json:"principal,omitempty"`
+		Source    string    `json:"source,omitempty"`
+		Reason    string    `json:"reason,omitempty"`
+	}
+
+	// AuditStore is an append-only store of audit records
+	AuditStore interface {
+		Append(record *AuditRecord) error
+		// List returns the records of a tenant accepted by match (every record if nil), newest first.
+		// The first offset records are skipped, and at most limit records are returned if limit is positive.
+		List(repo string, match func(record *AuditRecord) bool, offset int, limit int) ([]*AuditRecord, error)
+	}
+
+	// auditQuery filters the records returned by GET /api/:repo/audit, empty fields matching every record
+	auditQuery struct {
+		name    string
+		version string
+		action  string
+	}
+
+	// storageAuditStore writes each record to its own object under the audit prefix of its tenant
+	storageAuditStore struct {
+		backend storage.Backend
+	}
+
+	// localFileAuditStore appends the records of every tenant to a local file, as JSON lines
+	localFileAuditStore struct {
+		lock     sync.Mutex
+		filename string
+	}
+)
+
+// NewStorageAuditStore creates an audit store keeping its records in a storage backend, next to the charts of each tenant
+func NewStorageAuditStore(backend storage.Backend) AuditStore {
+	return &storageAuditStore{backend: backend}
+}
+
+func (store *storageAuditStore) Append(record *AuditRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	// the zero-padded timestamp sorts the objects in the order the records were written
+	filename := fmt.Sprintf("%020d-%s.json", record.Timestamp.UnixNano(), record.ID)
+	return store.backend.PutObject(pathutil.Join(record.Repo, auditPrefix, filename), content)
+}
+
+// List pages through the listed objects, newest first, and only fetches the records it needs:
+// without match, the skipped records are not fetched at all.
+func (store *storageAuditStore) List(repo string, match func(record *AuditRecord) bool, offset int, limit int) ([]*AuditRecord, error) {
+	prefix := pathutil.Join(repo, auditPrefix)
+	objects, err := store.backend.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Path > objects[j].Path
+	})
+	if match == nil {
+		if offset >= len(objects) {
+			return []*AuditRecord{}, nil
+		}
+		objects, offset = objects[offset:], 0
+	}
+	records := []*AuditRecord{}
+	for _, object := range objects {
+		if limit > 0 && len(records) == limit {
+			break
+		}
+		object, err = store.backend.GetObject(pathutil.Join(prefix, object.Path))
+		if err != nil {
+			return nil, err
+		}
+		record := &AuditRecord{}
+		if err = json.Unmarshal(object.Content, record); err != nil {
+			return nil, fmt.Errorf("audit record %s: %s", object.Path, err)
+		}
+		if match != nil && !match(record) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// NewLocalFileAuditStore creates an audit store appending its records to a local file, created if it does not exist
+func NewLocalFileAuditStore(filename string) (AuditStore, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &localFileAuditStore{filename: filename}, nil
+}
+
+func (store *localFileAuditStore) Append(record *AuditRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	f, err := os.OpenFile(store.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(content, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (store *localFileAuditStore) List(repo string, match func(record *AuditRecord) bool, offset int, limit int) ([]*AuditRecord, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	f, err := os.Open(store.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := []*AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &AuditRecord{}
+		if err = json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", store.filename, line, err)
+		}
+		if record.Repo == repo && (match == nil || match(record)) {
+			records = append(records, record)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	// the file is read oldest first
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	if offset >= len(records) {
+		return []*AuditRecord{}, nil
+	}
+	records = records[offset:]
+	if limit > 0 && limit < len(records) {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// auditUploadAction returns the action recorded for a chart package about to be uploaded, depending on whether it exists
+func (server *MultiTenantServer) auditUploadAction(log cm_logger.LoggingFn, repo string, filename string, force bool) string {
+	if server.AuditStore == nil {
+		return ""
+	}
+	content, _, err := openStorageObject(server.StorageBackend, pathutil.Join(repo, filename))
+	if err != nil {
+		return AuditActionPush
+	}
+	content.Close()
+	if server.getTenantSettings(log, repo).allowOverwrite {
+		return AuditActionOverwrite
+	}
+	return AuditActionForceOverwrite
+}
+
+// auditChartVersion returns the record of an operation on a chart version
+func auditChartVersion(repo string, action string, chartVersion *helm_repo.ChartVersion) *AuditRecord {
+	return &AuditRecord{
+		Action:  action,
+		Repo:    repo,
+		Name:    chartVersion.Name,
+		Version: chartVersion.Version,
+		Digest:  chartVersion.Digest,
+	}
+}
+
+// auditProvenanceFile returns the record of an uploaded provenance file, its digest being the one of the file itself
+func auditProvenanceFile(repo string, filename string, content []byte) *AuditRecord {
+	record := &AuditRecord{Action: AuditActionProvenance, Repo: repo}
+	packageFilename := strings.TrimSuffix(filename, provenanceFileSuffix)
+	chartVersion, err := cm_repo.ChartVersionFromStorageObject(storage.Object{Path: packageFilename})
+	if err == nil {
+		record.Name = chartVersion.Name
+		record.Version = chartVersion.Version
+	}
+	digest := sha256.Sum256(content)
+	record.Digest = hex.EncodeToString(digest[:])
+	return record
+}
+
+// getIndexedDigest returns the digest of a chart version in the cached index, empty if it is not indexed
+func (server *MultiTenantServer) getIndexedDigest(log cm_logger.LoggingFn, repo string, name string, version string) string {
+	entry, err := server.initCacheEntry(log, repo)
+	if err != nil {
+		return ""
+	}
+	for _, chartVersion := range entry.RepoIndex.Entries[name] {
+		if chartVersion.Version == version {
+			return chartVersion.Digest
+		}
+	}
+	return ""
+}
+
+// auditRequest records a write operation made by a request, with the client, request ID and principal
+func (server *MultiTenantServer) auditRequest(c *gin.Context, record *AuditRecord) {
+	if server.AuditStore == nil {
+		return
+	}
+	record.ClientIP = c.ClientIP()
+	record.RequestID = c.GetString("requestid")
+	record.Principal = server.auditPrincipal(c)
+	server.appendAuditRecord(server.Logger.ContextLoggingFn(c), record)
+}
+
+// appendAuditRecord writes a record to the audit store. The operation already happened, so an error is only logged.
+func (server *MultiTenantServer) appendAuditRecord(log cm_logger.LoggingFn, record *AuditRecord) {
+	if server.AuditStore == nil {
+		return
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	record.ID = hex.EncodeToString(id)
+	record.Timestamp = time.Now().UTC()
+	if err := server.AuditStore.Append(record); err != nil {
+		log(cm_logger.ErrorLevel, "Error writing audit record",
+			"repo", record.Repo,
+			"action", record.Action,
+			"name", record.Name,
+			"version", record.Version,
+			"error", err.Error(),
+		)
+	}
+}
+
+/*
+auditPrincipal returns the user authenticated by the router: the username of basic auth, or the subject of
+the bearer token. The token was already verified by the router, so its claims are only decoded here.
+Without authentication, requests have no principal.
+*/
+func (server *MultiTenantServer) auditPrincipal(c *gin.Context) string {
+	if server.Router == nil || server.Router.Authorizer == nil {
+		return ""
+	}
+	if username, _, ok := c.Request.BasicAuth(); ok {
+		return username
+	}
+	const bearerPrefix = "Bearer "
+	header := c.GetHeader("Authorization")
+	if len(header) <= len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return ""
+	}
+	parts := strings.Split(header[len(bearerPrefix):], ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Subject string `json:"sub"`
+	}{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// getAuditRecords returns the records of a tenant matching a query, newest first
+func (server *MultiTenantServer) getAuditRecords(repo string, query auditQuery, offset int, limit int) ([]*AuditRecord, *HTTPError) {
+	if server.AuditStore == nil {
+		return nil, &HTTPError{http.StatusNotFound, "audit log is not enabled"}
+	}
+	var match func(record *AuditRecord) bool
+	if query != (auditQuery{}) {
+		match = query.matches
+	}
+	records, err := server.AuditStore.List(repo, match, offset, limit)
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	return records, nil
+}
+
+// matches returns whether a record has the name, version and action of the query
+func (query auditQuery) matches(record *AuditRecord) bool {
+	return (query.name == "" || record.Name == query.name) &&
+		(query.version == "" || record.Version == query.version) &&
+		(query.action == "" || record.Action == query.action)
+}
@@ -35,7 +35,9 @@ _.-'  \        ( \___
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	pathutil "path"
+	"strings"
 	"sync"
 	"time"
 
@@ -55,6 +57,8 @@ type (
 		// cryptic JSON field names to minimize size saved in cache
 		RepoName  string         `json:"a"`
 		RepoIndex *cm_repo.Index `json:"b"`
+		// the ETag of the index, computed once per regeneration rather than on every request
+		RepoIndexETag string `json:"c,omitempty"`
 	}
 
 	event struct {
@@ -73,11 +77,32 @@ const (
 	deleteChart operationType = 2
 )
 
+var (
+	// chartEvents name the operations in webhooks and in the event feed
+	chartEvents = map[operationType]string{
+		addChart:    "chart.added",
+		updateChart: "chart.updated",
+		deleteChart: "chart.deleted",
+	}
+)
+
 var (
 	EntrySavedMessage             = "Entry saved in cache store"
 	CouldNotSaveEntryErrorMessage = "Could not save entry in cache store"
 )
 
+func newCacheEntry(repo string, index *cm_repo.Index) *cacheEntry {
+	entry := &cacheEntry{RepoName: repo}
+	entry.setRepoIndex(index)
+	return entry
+}
+
+// setRepoIndex sets the index of a cache entry once regenerated, along with its ETag
+func (entry *cacheEntry) setRepoIndex(index *cm_repo.Index) {
+	entry.RepoIndex = index
+	entry.RepoIndexETag = indexETag(index.Raw)
+}
+
 func (server *MultiTenantServer) primeCache() error {
 	// only prime the cache if this is a single tenant setup
 	if server.Router.Depth == 0 {
@@ -174,6 +199,11 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 		return nil, err
 	}
 
+	server.applyMetadataOverlay(log, repo, index)
+	err = server.hideUnsignedChartVersions(log, repo, index)
+	if err != nil {
+		return nil, err
+	}
 	err = index.Regenerate()
 	if err != nil {
 		return nil, err
@@ -183,7 +213,7 @@ func (server *MultiTenantServer) regenerateRepositoryIndexWorker(log cm_logger.L
 		"repo", repo,
 	)
 
-	entry.RepoIndex = index
+	entry.setRepoIndex(index)
 	err = server.saveCacheEntry(log, entry)
 	return index, err
 }
@@ -198,22 +228,22 @@ func (server *MultiTenantServer) fetchChartsInStorage(log cm_logger.LoggingFn, r
 	}
 
 	// filter out storage objects that dont have extension used for chart packages (.tgz)
-	//filteredObjects := []cm_storage.Object{}
-	//for _, object := range allObjects {
-	//	if object.HasExtension(cm_repo.ChartPackageFileExtension) {
-	//		log(cm_logger.DebugLevel, "GetObject From Storage Backend", "repo", repo, "path", object.Path)
-	//		Since ListObject cannot fetch the content from file list
-			//objectDetail, err := server.StorageBackend.GetObject(pathutil.Join(repo, object.Path))
-			//if err != nil {
-			//	return nil, fmt.Errorf("backend storage: chart not found: %q", err)
-			//}
-			//do not change other object field except content
-			//object.Content = objectDetail.Content
-			//filteredObjects = append(filteredObjects, object)
-		//}
-	//}
-
-	return allObjects, nil
+	filteredObjects := []cm_storage.Object{}
+	for _, object := range allObjects {
+		if object.HasExtension(cm_repo.ChartPackageFileExtension) {
+			log(cm_logger.DebugLevel, "GetObject From Storage Backend", "repo", repo, "path", object.Path)
+			// Since ListObject cannot fetch the content from file list
+			objectDetail, err := server.StorageBackend.GetObject(pathutil.Join(repo, object.Path))
+			if err != nil {
+				return nil, fmt.Errorf("backend storage: chart not found: %q", err)
+			}
+			// do not change other object field except content
+			object.Content = objectDetail.Content
+			filteredObjects = append(filteredObjects, object)
+		}
+	}
+
+	return filteredObjects, nil
 }
 
 func (server *MultiTenantServer) removeIndexObject(log cm_logger.LoggingFn, repo string, index *cm_repo.Index, object cm_storage.Object) error {
@@ -241,6 +271,7 @@ func (server *MultiTenantServer) updateIndexObject(log cm_logger.LoggingFn, repo
 		"version", chartVersion.Version,
 	)
 	index.UpdateEntry(chartVersion)
+	server.storeOCIManifestOfChartVersion(log, repo, chartVersion)
 	return nil
 }
 
@@ -258,15 +289,58 @@ func (server *MultiTenantServer) addIndexObjectsAsync(log cm_logger.LoggingFn, r
 	for _, object := range objects {
 		o, err := cm_repo.ChartVersionFromStorageObject(object)
 		if err != nil {
-			return err
+			err = server.checkInvalidChartPackageError(log, repo, object, err, "added")
+			if err != nil {
+				return err
+			}
+			continue
 		}
 
 		index.AddEntry(o)
+		server.storeOCIManifestOfChartVersion(log, repo, o)
 	}
 
 	return nil
 }
 
+// storeOCIManifestOfChartVersion stores the OCI manifest of a chart version added to the index, so that pulls only read it
+func (server *MultiTenantServer) storeOCIManifestOfChartVersion(log cm_logger.LoggingFn, repo string, chartVersion *helm_repo.ChartVersion) {
+	if !server.EnableOCI {
+		return
+	}
+	if err := server.storeOCIManifest(log, repo, chartVersion); err != nil {
+		log(cm_logger.WarnLevel, "Error storing OCI manifest",
+			"repo", repo,
+			"name", chartVersion.Name,
+			"version", chartVersion.Version,
+			"error", err.Error(),
+		)
+	}
+}
+
+/*
+storeOCIManifestOfProvenanceFile stores the OCI manifest of a chart version again once its provenance file is uploaded
+on its own, adding a layer. Unless it is verified, such a provenance file leaves the index as is, without an event.
+*/
+func (server *MultiTenantServer) storeOCIManifestOfProvenanceFile(log cm_logger.LoggingFn, repo string, provFilename string) {
+	if !server.EnableOCI {
+		return
+	}
+	entry, err := server.initCacheEntry(log, repo)
+	if err != nil {
+		return
+	}
+	packageFilename := strings.TrimSuffix(provFilename, provenanceFileSuffix)
+	for _, chartVersions := range entry.RepoIndex.Entries {
+		for _, chartVersion := range chartVersions {
+			if cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version) == packageFilename {
+				server.storeOCIManifestOfChartVersion(log, repo, chartVersion)
+				return
+			}
+		}
+	}
+}
+
 func (server *MultiTenantServer) getObjectChartVersion(repo string, object cm_storage.Object, load bool) (*helm_repo.ChartVersion, error) {
 	op := object.Path
 	if load {
@@ -305,8 +379,9 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 
 	if _, ok := server.Tenants[repo]; !ok {
 		server.Tenants[repo] = &tenantInternals{
-			FetchedObjectsLock: &sync.Mutex{},
-			RegenerationLock:   &sync.Mutex{},
+			FetchedObjectsLock:  &sync.Mutex{},
+			RegenerationLock:    &sync.Mutex{},
+			MetadataOverlayLock: &sync.Mutex{},
 		}
 	}
 
@@ -314,11 +389,7 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 		var ok bool
 		entry, ok = server.InternalCacheStore[repo]
 		if !ok {
-			repoIndex := server.newRepositoryIndex(log, repo)
-			entry = &cacheEntry{
-				RepoName:  repo,
-				RepoIndex: repoIndex,
-			}
+			entry = newCacheEntry(repo, server.newRepositoryIndex(log, repo))
 			server.InternalCacheStore[repo] = entry
 		} else {
 			log(cm_logger.DebugLevel, "Entry found in cache store",
@@ -328,11 +399,7 @@ func (server *MultiTenantServer) initCacheEntry(log cm_logger.LoggingFn, repo st
 	} else {
 		content, err = server.ExternalCacheStore.Get(repo)
 		if err != nil {
-			repoIndex := server.newRepositoryIndex(log, repo)
-			entry = &cacheEntry{
-				RepoName:  repo,
-				RepoIndex: repoIndex,
-			}
+			entry = newCacheEntry(repo, server.newRepositoryIndex(log, repo))
 			content, err = json.Marshal(entry)
 			if err != nil {
 				return nil, err
@@ -388,13 +455,7 @@ func (server *MultiTenantServer) saveCacheEntry(log cm_logger.LoggingFn, entry *
 }
 
 func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, repo string) *cm_repo.Index {
-	var chartURL string
-	if server.ChartURL != "" {
-		chartURL = server.ChartURL
-		if repo != "" {
-			chartURL = chartURL + "/" + repo
-		}
-	}
+	chartURL := server.getTenantSettings(log, repo).chartURL
 
 	serverInfo := &cm_repo.ServerInfo{
 		ContextPath: server.Router.ContextPath,
@@ -424,12 +485,28 @@ func (server *MultiTenantServer) newRepositoryIndex(log cm_logger.LoggingFn, rep
 		"repo", repo,
 	)
 
-	return &cm_repo.Index{
+	index := &cm_repo.Index{
 		IndexFile: indexFile,
 		RepoName:  repo,
 		Raw:       object.Content,
 		ChartURL:  chartURL,
 	}
+
+	// the overlay may have changed since index-cache.yaml was saved
+	if server.applyMetadataOverlay(log, repo, index) || server.requireSignedCharts(repo) {
+		err = server.hideUnsignedChartVersions(log, repo, index)
+		if err == nil {
+			err = index.Regenerate()
+		}
+		if err != nil {
+			log(cm_logger.WarnLevel, "index-cache.yaml could not be regenerated with metadata-overlay.yaml",
+				"repo", repo,
+				"error", err.Error(),
+			)
+			return cm_repo.NewIndex(chartURL, repo, serverInfo)
+		}
+	}
+	return index
 }
 
 func (server *MultiTenantServer) initCacheTimer() {
@@ -485,9 +562,20 @@ func (server *MultiTenantServer) startEventListener() {
 			continue
 		}
 
+		// the package of the chart version may have been replaced or removed
+		server.chartFiles.remove(chartFilesCacheKey(repo, e.ChartVersion.Name, e.ChartVersion.Version))
+		if e.OpType != deleteChart {
+			server.storeOCIManifestOfChartVersion(log, repo, e.ChartVersion)
+		}
+
 		switch e.OpType {
 		case updateChart:
-			index.UpdateEntry(e.ChartVersion)
+			if index.HasEntry(e.ChartVersion) {
+				index.UpdateEntry(e.ChartVersion)
+			} else {
+				// e.g. a chart version of a signed-only tenant, hidden until its provenance file was uploaded
+				index.AddEntry(e.ChartVersion)
+			}
 		case addChart:
 			index.AddEntry(e.ChartVersion)
 		case deleteChart:
@@ -499,13 +587,17 @@ func (server *MultiTenantServer) startEventListener() {
 			continue
 		}
 
-		err = index.Regenerate()
+		server.applyMetadataOverlay(log, repo, index)
+		err = server.hideUnsignedChartVersions(log, repo, index)
+		if err == nil {
+			err = index.Regenerate()
+		}
 		if err != nil {
 			log(cm_logger.ErrorLevel, "Error regenerating index", zap.Error(err), zap.String("repo", repo))
 			tenant.RegenerationLock.Unlock()
 			continue
 		}
-		entry.RepoIndex = index
+		entry.setRepoIndex(index)
 
 		err = server.saveCacheEntry(log, entry)
 		if err != nil {
@@ -521,6 +613,8 @@ func (server *MultiTenantServer) startEventListener() {
 		}
 
 		tenant.RegenerationLock.Unlock()
+		server.eventFeed.publish(repo, e.OpType, e.ChartVersion)
+		server.notifyWebhooks(log, repo, e.OpType, e.ChartVersion)
 		log(cm_logger.DebugLevel, "Event handled successfully", zap.Any("event", e))
 	}
 }
@@ -583,7 +677,7 @@ func (server *MultiTenantServer) refreshCacheEntry(log cm_logger.LoggingFn, repo
 		)
 		return
 	}
-	entry.RepoIndex = ir.index
+	entry.setRepoIndex(ir.index)
 
 	if server.UseStatefiles {
 		// Dont wait, save index-cache.yaml to storage in the background.
@@ -0,0 +1,83 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// the timestamp of index.yaml, excluded from its ETag
+	indexGeneratedPrefix = []byte("\ngenerated: ")
+)
+
+/*
+indexETag returns a weak ETag hashing the content of an index.yaml. The generated timestamp is left out,
+as it changes every time the index is regenerated (and differs between replicas) even if no chart changed,
+so the ETag is weak: index.yaml files differing by their timestamp only are equivalent, not identical.
+*/
+func indexETag(raw []byte) string {
+	hash := sha256.New()
+	start := bytes.Index(raw, indexGeneratedPrefix)
+	if start == -1 {
+		hash.Write(raw)
+	} else {
+		hash.Write(raw[:start])
+		rest := raw[start+len(indexGeneratedPrefix):]
+		if end := bytes.IndexByte(rest, '\n'); end != -1 {
+			hash.Write(rest[end:])
+		}
+	}
+	return fmt.Sprintf("W/\"%x\"", hash.Sum(nil))
+}
+
+/*
+notModified sets the ETag and Last-Modified headers of a response, and answers with a 304 if the copy
+of the client is still fresh according to the If-None-Match (with a weak comparison) or (if absent)
+If-Modified-Since headers.
+*/
+func notModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	c.Header("ETag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	fresh := false
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == strings.TrimPrefix(etag, "W/") || tag == "*" {
+				fresh = true
+				break
+			}
+		}
+	} else if ifModifiedSince := c.GetHeader("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ifModifiedSince)
+		fresh = err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	if fresh {
+		c.Status(http.StatusNotModified)
+	}
+	return fresh
+}
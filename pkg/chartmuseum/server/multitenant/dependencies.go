@@ -0,0 +1,270 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	dependencyResolved   = "resolved"
+	dependencyUnresolved = "unresolved"
+	dependencyAmbiguous  = "ambiguous"
+	dependencyBundled    = "bundled"
+
+	// maxDependencyDepth limits how deep the dependency tree of a chart version is resolved
+	maxDependencyDepth = 10
+)
+
+type (
+	// DependencyTree is the resolved dependency tree of a chart version
+	DependencyTree struct {
+		Repo         string            `json:"repo"`
+		Name         string            `json:"name"`
+		Version      string            `json:"version"`
+		Dependencies []*DependencyNode `json:"dependencies"`
+	}
+
+	// DependencyNode is a dependency of a chart version, resolved against the index of one or more tenants.
+	// A dependency is ambiguous when matching versions are found in more than one tenant, in which case it
+	// resolves to the first of the candidates (the tenant of the chart first, then in the order requested).
+	DependencyNode struct {
+		Name         string                `json:"name"`
+		Version      string                `json:"version"`
+		Repository   string                `json:"repository,omitempty"`
+		Alias        string                `json:"alias,omitempty"`
+		Status       string                `json:"status"`
+		Error        string                `json:"error,omitempty"`
+		Resolved     *ResolvedDependency   `json:"resolved,omitempty"`
+		Candidates   []*ResolvedDependency `json:"candidates,omitempty"`
+		Dependencies []*DependencyNode     `json:"dependencies,omitempty"`
+	}
+
+	// ResolvedDependency is a chart version matching the version constraint of a dependency
+	ResolvedDependency struct {
+		Repo    string `json:"repo"`
+		Version string `json:"version"`
+	}
+
+	// Dependent is a chart version which depends on another chart
+	Dependent struct {
+		Repo       string `json:"repo"`
+		Name       string `json:"name"`
+		Version    string `json:"version"`
+		Constraint string `json:"constraint"`
+	}
+
+	// dependencyResolver resolves dependencies against the index entries of a list of tenants, in order of preference
+	dependencyResolver struct {
+		repos   []string
+		entries map[string]map[string]helm_repo.ChartVersions
+	}
+)
+
+// resolve builds the dependency tree of a chart version
+func (resolver *dependencyResolver) resolve(repo string, chartVersion *helm_repo.ChartVersion) *DependencyTree {
+	visited := map[string]bool{dependencyKey(repo, chartVersion.Name, chartVersion.Version): true}
+	return &DependencyTree{
+		Repo:         repo,
+		Name:         chartVersion.Name,
+		Version:      chartVersion.Version,
+		Dependencies: resolver.resolveDependencies(chartVersion.Dependencies, visited, 1),
+	}
+}
+
+func (resolver *dependencyResolver) resolveDependencies(dependencies []*chart.Dependency, visited map[string]bool, depth int) []*DependencyNode {
+	nodes := []*DependencyNode{}
+	for _, dependency := range dependencies {
+		if dependency == nil {
+			continue
+		}
+		node := &DependencyNode{
+			Name:       dependency.Name,
+			Version:    dependency.Version,
+			Repository: dependency.Repository,
+			Alias:      dependency.Alias,
+		}
+		nodes = append(nodes, node)
+
+		// dependencies from a file:// repository are packaged inside the chart
+		if strings.HasPrefix(dependency.Repository, "file://") {
+			node.Status = dependencyBundled
+			continue
+		}
+
+		var match *helm_repo.ChartVersion
+		for _, repo := range resolver.repos {
+			matches, err := chartVersionsMatchingConstraint(resolver.entries[repo][dependency.Name], dependency.Version, false)
+			if err != nil {
+				node.Error = err.Error()
+				break
+			}
+			if len(matches) == 0 {
+				continue
+			}
+			if match == nil {
+				match = matches[0]
+			}
+			node.Candidates = append(node.Candidates, &ResolvedDependency{Repo: repo, Version: matches[0].Version})
+		}
+
+		switch {
+		case match == nil:
+			node.Status = dependencyUnresolved
+			node.Candidates = nil
+			continue
+		case len(node.Candidates) > 1:
+			node.Status = dependencyAmbiguous
+		default:
+			node.Status = dependencyResolved
+		}
+		node.Resolved = node.Candidates[0]
+		if node.Status == dependencyResolved {
+			node.Candidates = nil
+		}
+
+		key := dependencyKey(node.Resolved.Repo, match.Name, match.Version)
+		if depth < maxDependencyDepth && !visited[key] {
+			visited[key] = true
+			node.Dependencies = resolver.resolveDependencies(match.Dependencies, visited, depth+1)
+			delete(visited, key)
+		}
+	}
+	return nodes
+}
+
+// dependents lists the chart versions depending on a chart, optionally only those whose constraint allows a version of it
+func (resolver *dependencyResolver) dependents(name string, version string) ([]*Dependent, error) {
+	var v *semver.Version
+	if version != "" {
+		var err error
+		v, err = semver.NewVersion(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %w", version, err)
+		}
+	}
+
+	dependents := []*Dependent{}
+	for _, repo := range resolver.repos {
+		for _, chartVersions := range resolver.entries[repo] {
+			for _, chartVersion := range chartVersions {
+				if chartVersion.Metadata == nil {
+					continue
+				}
+				for _, dependency := range chartVersion.Dependencies {
+					if dependency == nil || dependency.Name != name {
+						continue
+					}
+					if v != nil && !dependencyConstraintAllows(dependency.Version, v) {
+						continue
+					}
+					dependents = append(dependents, &Dependent{
+						Repo:       repo,
+						Name:       chartVersion.Name,
+						Version:    chartVersion.Version,
+						Constraint: dependency.Version,
+					})
+				}
+			}
+		}
+	}
+	sort.SliceStable(dependents, func(i, j int) bool {
+		if dependents[i].Repo != dependents[j].Repo {
+			return dependents[i].Repo < dependents[j].Repo
+		}
+		if dependents[i].Name != dependents[j].Name {
+			return dependents[i].Name < dependents[j].Name
+		}
+		return versionLess(dependents[i].Version, dependents[j].Version)
+	})
+	return dependents, nil
+}
+
+// versionLess compares chart versions as semantic versions, falling back to comparing them as strings
+func versionLess(a string, b string) bool {
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return va.LessThan(vb)
+}
+
+func dependencyConstraintAllows(constraint string, v *semver.Version) bool {
+	if constraint == "" {
+		constraint = "*"
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return false
+	}
+	return c.Check(v)
+}
+
+func dependencyKey(repo string, name string, version string) string {
+	return fmt.Sprintf("%s/%s-%s", repo, name, version)
+}
+
+// newDependencyResolver loads the index entries of the tenants used to resolve dependencies
+func (server *MultiTenantServer) newDependencyResolver(log cm_logger.LoggingFn, repos []string) (*dependencyResolver, *HTTPError) {
+	resolver := &dependencyResolver{entries: map[string]map[string]helm_repo.ChartVersions{}}
+	for _, repo := range repos {
+		if _, ok := resolver.entries[repo]; ok {
+			continue
+		}
+		indexFile, err := server.getIndexFile(log, repo)
+		if err != nil {
+			return nil, err
+		}
+		resolver.repos = append(resolver.repos, repo)
+		resolver.entries[repo] = indexFile.Entries
+	}
+	return resolver, nil
+}
+
+func (server *MultiTenantServer) getChartVersionDependencies(log cm_logger.LoggingFn, repo string, name string, version string, otherRepos []string) (*DependencyTree, *HTTPError) {
+	chartVersion, err := server.getChartVersion(log, repo, name, version, false)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := server.newDependencyResolver(log, append([]string{repo}, otherRepos...))
+	if err != nil {
+		return nil, err
+	}
+	return resolver.resolve(repo, chartVersion), nil
+}
+
+func (server *MultiTenantServer) getChartDependents(log cm_logger.LoggingFn, repo string, name string, version string, otherRepos []string) ([]*Dependent, *HTTPError) {
+	resolver, err := server.newDependencyResolver(log, append([]string{repo}, otherRepos...))
+	if err != nil {
+		return nil, err
+	}
+	dependents, resolveErr := resolver.dependents(name, version)
+	if resolveErr != nil {
+		return nil, &HTTPError{http.StatusBadRequest, resolveErr.Error()}
+	}
+	return dependents, nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type DependenciesTestSuite struct {
+	suite.Suite
+	Resolver *dependencyResolver
+}
+
+func (suite *DependenciesTestSuite) SetupSuite() {
+	chartVersion := func(name string, version string, dependencies ...*chart.Dependency) *helm_repo.ChartVersion {
+		return &helm_repo.ChartVersion{
+			Metadata: &chart.Metadata{Name: name, Version: version, Dependencies: dependencies},
+		}
+	}
+	suite.Resolver = &dependencyResolver{
+		repos: []string{"org1/apps", "org1/libs"},
+		entries: map[string]map[string]helm_repo.ChartVersions{
+			"org1/apps": {
+				"app": {
+					chartVersion("app", "1.0.0",
+						&chart.Dependency{Name: "common", Version: "^1.0.0"},
+						&chart.Dependency{Name: "database", Version: "~2.1"},
+						&chart.Dependency{Name: "missing", Version: "1.0.0"},
+						&chart.Dependency{Name: "vendored", Version: "0.1.0", Repository: "file://../vendored"},
+					),
+				},
+				"database": {
+					chartVersion("database", "2.1.3", &chart.Dependency{Name: "common", Version: ">=1.1.0"}),
+					chartVersion("database", "2.0.0"),
+				},
+			},
+			"org1/libs": {
+				"common": {
+					chartVersion("common", "1.2.0"),
+					chartVersion("common", "1.0.0"),
+					chartVersion("common", "2.0.0"),
+				},
+				"database": {
+					chartVersion("database", "2.1.0"),
+				},
+				"cycle": {
+					chartVersion("cycle", "1.0.0", &chart.Dependency{Name: "cycle", Version: "1.0.0"}),
+				},
+				"tool": {
+					chartVersion("tool", "1.10.0", &chart.Dependency{Name: "common", Version: "^2.0.0"}),
+					chartVersion("tool", "1.9.0", &chart.Dependency{Name: "common", Version: "^2.0.0"}),
+				},
+			},
+		},
+	}
+}
+
+func (suite *DependenciesTestSuite) TestResolve() {
+	app := suite.Resolver.entries["org1/apps"]["app"][0]
+	tree := suite.Resolver.resolve("org1/apps", app)
+	suite.Equal("app", tree.Name)
+	suite.Len(tree.Dependencies, 4)
+
+	common := tree.Dependencies[0]
+	suite.Equal(dependencyResolved, common.Status, "common resolved")
+	suite.Equal(&ResolvedDependency{Repo: "org1/libs", Version: "1.2.0"}, common.Resolved, "common resolved to newest matching version")
+
+	database := tree.Dependencies[1]
+	suite.Equal(dependencyAmbiguous, database.Status, "database found in two repos")
+	suite.Equal(&ResolvedDependency{Repo: "org1/apps", Version: "2.1.3"}, database.Resolved, "database resolved in the chart's own repo first")
+	suite.Len(database.Candidates, 2, "both database candidates listed")
+	suite.Len(database.Dependencies, 1, "transitive dependencies resolved")
+	suite.Equal("2.0.0", database.Dependencies[0].Resolved.Version, "transitive dependency resolved")
+
+	suite.Equal(dependencyUnresolved, tree.Dependencies[2].Status, "missing dependency unresolved")
+	suite.Nil(tree.Dependencies[2].Resolved)
+	suite.Equal(dependencyBundled, tree.Dependencies[3].Status, "file:// dependency bundled")
+
+	cycle := suite.Resolver.entries["org1/libs"]["cycle"][0]
+	tree = suite.Resolver.resolve("org1/libs", cycle)
+	suite.Len(tree.Dependencies, 1)
+	suite.Empty(tree.Dependencies[0].Dependencies, "dependency cycle not followed")
+
+	invalid := &helm_repo.ChartVersion{Metadata: &chart.Metadata{Name: "invalid", Version: "1.0.0",
+		Dependencies: []*chart.Dependency{{Name: "common", Version: "not a constraint"}}}}
+	tree = suite.Resolver.resolve("org1/apps", invalid)
+	suite.Equal(dependencyUnresolved, tree.Dependencies[0].Status, "invalid constraint unresolved")
+	suite.NotEmpty(tree.Dependencies[0].Error, "invalid constraint error reported")
+}
+
+func (suite *DependenciesTestSuite) TestDependents() {
+	dependents, err := suite.Resolver.dependents("common", "")
+	suite.Nil(err)
+	suite.Equal([]*Dependent{
+		{Repo: "org1/apps", Name: "app", Version: "1.0.0", Constraint: "^1.0.0"},
+		{Repo: "org1/apps", Name: "database", Version: "2.1.3", Constraint: ">=1.1.0"},
+		{Repo: "org1/libs", Name: "tool", Version: "1.9.0", Constraint: "^2.0.0"},
+		{Repo: "org1/libs", Name: "tool", Version: "1.10.0", Constraint: "^2.0.0"},
+	}, dependents, "dependents sorted by repo, name and semantic version")
+
+	dependents, err = suite.Resolver.dependents("common", "1.0.5")
+	suite.Nil(err)
+	suite.Len(dependents, 1, "only dependents allowing the version")
+
+	_, err = suite.Resolver.dependents("common", "bogus")
+	suite.NotNil(err, "error with invalid version")
+}
+
+func TestDependenciesTestSuite(t *testing.T) {
+	suite.Run(t, new(DependenciesTestSuite))
+}
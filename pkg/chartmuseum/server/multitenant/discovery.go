@@ -0,0 +1,215 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/chartmuseum/storage"
+)
+
+var errPrefixListingNotSupported = errors.New("storage backend does not support listing prefixes")
+
+type (
+	// RepoSummary describes a tenant repository found in storage
+	RepoSummary struct {
+		Name        string     `json:"name"`
+		Charts      int        `json:"charts"`
+		Versions    int        `json:"versions"`
+		LastUpdated *time.Time `json:"lastUpdated,omitempty"`
+	}
+
+	// StoragePrefixLister may be implemented by storage backends to list the prefixes
+	// ("directories") directly below a prefix, which is required to discover tenants
+	StoragePrefixLister interface {
+		ListPrefixes(prefix string) ([]string, error)
+	}
+)
+
+// listStoragePrefixes returns the names of the prefixes directly below a prefix
+func listStoragePrefixes(backend storage.Backend, prefix string) ([]string, error) {
+	switch b := backend.(type) {
+	case StoragePrefixLister:
+		return b.ListPrefixes(prefix)
+	case *storage.LocalFilesystemBackend:
+		return listLocalFilesystemPrefixes(b, prefix)
+	case *storage.AmazonS3Backend:
+		return listAmazonS3Prefixes(b, prefix)
+	}
+	return nil, errPrefixListingNotSupported
+}
+
+func listLocalFilesystemPrefixes(b *storage.LocalFilesystemBackend, prefix string) ([]string, error) {
+	var prefixes []string
+	files, err := ioutil.ReadDir(pathutil.Join(b.RootDirectory, prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return prefixes, err
+	}
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			prefixes = append(prefixes, f.Name())
+		}
+	}
+	return prefixes, nil
+}
+
+func listAmazonS3Prefixes(b *storage.AmazonS3Backend, prefix string) ([]string, error) {
+	var prefixes []string
+	prefix = strings.TrimPrefix(pathutil.Join(b.Prefix, prefix)+"/", "/")
+	s3Input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(b.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	err := b.Client.ListObjectsV2Pages(s3Input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			name := strings.Trim(strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), prefix), "/")
+			if name != "" && !strings.HasPrefix(name, ".") {
+				prefixes = append(prefixes, name)
+			}
+		}
+		return true
+	})
+	return prefixes, err
+}
+
+/*
+discoverTenants lists the tenants in storage. With a fixed depth, every prefix at that depth is a
+tenant. With a dynamic depth, every prefix containing chart packages is a tenant. If the storage
+backend cannot list prefixes, only the tenants already in the cache are returned.
+*/
+func (server *MultiTenantServer) discoverTenants(log cm_logger.LoggingFn) ([]string, error) {
+	var repos []string
+	var err error
+	switch {
+	case server.Router.DepthDynamic:
+		repos, err = server.discoverDynamicTenants("")
+	case server.Router.Depth == 0:
+		repos = []string{""}
+	default:
+		repos, err = server.discoverTenantsAtDepth("", server.Router.Depth)
+	}
+
+	if err == errPrefixListingNotSupported {
+		log(cm_logger.WarnLevel, "Storage backend does not support listing prefixes, only listing tenants in cache")
+		repos, err = server.getCachedTenants(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+func (server *MultiTenantServer) discoverTenantsAtDepth(prefix string, depth int) ([]string, error) {
+	if depth == 0 {
+		return []string{prefix}, nil
+	}
+	children, err := listStoragePrefixes(server.StorageBackend, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	for _, child := range children {
+		childRepos, err := server.discoverTenantsAtDepth(pathutil.Join(prefix, child), depth-1)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, childRepos...)
+	}
+	return repos, nil
+}
+
+func (server *MultiTenantServer) discoverDynamicTenants(prefix string) ([]string, error) {
+	var repos []string
+	objects, err := server.StorageBackend.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if object.HasExtension(cm_repo.ChartPackageFileExtension) {
+			repos = append(repos, prefix)
+			break
+		}
+	}
+	children, err := listStoragePrefixes(server.StorageBackend, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		childRepos, err := server.discoverDynamicTenants(pathutil.Join(prefix, child))
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, childRepos...)
+	}
+	return repos, nil
+}
+
+func (server *MultiTenantServer) getCachedTenants() []string {
+	server.TenantCacheKeyLock.Lock()
+	defer server.TenantCacheKeyLock.Unlock()
+	var repos []string
+	for repo := range server.Tenants {
+		repos = append(repos, repo)
+	}
+	return repos
+}
+
+// getRepos summarizes a page of repos, only loading the indexes of the repos in that page
+func (server *MultiTenantServer) getRepos(log cm_logger.LoggingFn, repos []string, offset int, limit int) ([]*RepoSummary, *HTTPError) {
+	summaries := []*RepoSummary{}
+	if offset >= len(repos) {
+		return summaries, nil
+	}
+	end := len(repos)
+	if limit != -1 && offset+limit < end {
+		end = offset + limit
+	}
+	for _, repo := range repos[offset:end] {
+		indexFile, httpErr := server.getIndexFile(log, repo)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		summary := &RepoSummary{Name: repo, Charts: len(indexFile.Entries)}
+		for _, chartVersions := range indexFile.Entries {
+			summary.Versions += len(chartVersions)
+			for _, chartVersion := range chartVersions {
+				if summary.LastUpdated == nil || chartVersion.Created.After(*summary.LastUpdated) {
+					created := chartVersion.Created
+					summary.LastUpdated = &created
+				}
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
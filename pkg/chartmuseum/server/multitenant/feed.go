@@ -0,0 +1,165 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// feedResyncEvent tells a client resuming the feed that events were missed, and index.yaml must be fetched again
+	feedResyncEvent = "resync"
+)
+
+var (
+	// number of events kept in memory to resume the feed, for all tenants
+	eventFeedBufferSize = 1000
+	// number of events queued for a client, which is disconnected if it does not keep up
+	eventFeedSubscriberBuffer = 64
+	// interval of the comments sent to keep idle connections open
+	eventFeedKeepAlive = 15 * time.Second
+)
+
+type (
+	// feedEvent is a chart event sent to the clients of the event feed
+	feedEvent struct {
+		ID        string                  `json:"-"`
+		Event     string                  `json:"event"`
+		Repo      string                  `json:"repo"`
+		Chart     *helm_repo.ChartVersion `json:"chart"`
+		Timestamp time.Time               `json:"timestamp"`
+
+		seq uint64
+	}
+
+	/*
+		eventFeed broadcasts the chart events handled by the event listener to the clients of GET /api/:repo/events,
+		keeping the latest events in a ring buffer so clients can resume after reconnecting. Event IDs are prefixed
+		with the start time of the feed, so IDs from before a restart are detected.
+	*/
+	eventFeed struct {
+		lock        sync.Mutex
+		epoch       int64
+		seq         uint64
+		buffer      []*feedEvent
+		next        int
+		subscribers map[chan *feedEvent]string
+	}
+)
+
+func newEventFeed() *eventFeed {
+	return &eventFeed{
+		epoch:       time.Now().UnixNano(),
+		buffer:      make([]*feedEvent, 0, eventFeedBufferSize),
+		subscribers: map[chan *feedEvent]string{},
+	}
+}
+
+// publish adds an event to the ring buffer and sends it to the clients of the tenant
+func (feed *eventFeed) publish(repo string, operationType operationType, chartVersion *helm_repo.ChartVersion) {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	feed.seq++
+	e := &feedEvent{
+		ID:        fmt.Sprintf("%d-%d", feed.epoch, feed.seq),
+		Event:     chartEvents[operationType],
+		Repo:      repo,
+		Chart:     chartVersion,
+		Timestamp: time.Now(),
+		seq:       feed.seq,
+	}
+	if len(feed.buffer) < cap(feed.buffer) {
+		feed.buffer = append(feed.buffer, e)
+	} else if len(feed.buffer) > 0 {
+		feed.buffer[feed.next] = e
+		feed.next = (feed.next + 1) % len(feed.buffer)
+	}
+	for subscriber, subscriberRepo := range feed.subscribers {
+		if subscriberRepo != repo {
+			continue
+		}
+		select {
+		case subscriber <- e:
+		default:
+			// the client is too slow, it resumes from the buffer once it reconnects
+			delete(feed.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+/*
+subscribe registers a client of the feed of a tenant, returning the buffered events it missed since lastEventID.
+It returns resync if some of them are no longer buffered, or if lastEventID is from a previous run of the server.
+*/
+func (feed *eventFeed) subscribe(repo string, lastEventID string) (subscriber chan *feedEvent, missed []*feedEvent, resync bool) {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	subscriber = make(chan *feedEvent, eventFeedSubscriberBuffer)
+	feed.subscribers[subscriber] = repo
+	if lastEventID == "" {
+		return subscriber, nil, false
+	}
+
+	var lastSeq uint64
+	parts := strings.SplitN(lastEventID, "-", 2)
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err == nil && len(parts) == 2 {
+		lastSeq, err = strconv.ParseUint(parts[1], 10, 64)
+	}
+	if err != nil || epoch != feed.epoch || lastSeq > feed.seq {
+		return subscriber, nil, true
+	}
+	oldest := feed.seq + 1
+	for i := 0; i < len(feed.buffer); i++ {
+		e := feed.buffer[(feed.next+i)%len(feed.buffer)]
+		if e.seq < oldest {
+			oldest = e.seq
+		}
+		if e.seq > lastSeq && e.Repo == repo {
+			missed = append(missed, e)
+		}
+	}
+	return subscriber, missed, lastSeq+1 < oldest
+}
+
+func (feed *eventFeed) unsubscribe(subscriber chan *feedEvent) {
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	if _, ok := feed.subscribers[subscriber]; ok {
+		delete(feed.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// writeFeedEvent writes an event in the Server-Sent Events format
+func writeFeedEvent(c *gin.Context, e *feedEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Event, data)
+	return err
+}
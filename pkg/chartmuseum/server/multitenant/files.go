@@ -0,0 +1,286 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	pathutil "path"
+	"sort"
+	"strings"
+	"sync"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	cm_auth "github.com/chartmuseum/auth"
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+type (
+	// ChartFile is a single file inside a chart package
+	ChartFile struct {
+		Name string `json:"name"`
+		Data string `json:"data"`
+	}
+
+	// chartFilesCache is a LRU cache of the files extracted from chart packages, bounded by their total size
+	chartFilesCache struct {
+		lock     *sync.Mutex
+		maxBytes int64
+		bytes    int64
+		entries  *list.List
+		items    map[string]*list.Element
+	}
+
+	chartFilesCacheEntry struct {
+		key    string
+		digest string
+		files  []*chart.File
+		bytes  int64
+	}
+)
+
+func newChartFilesCache(maxBytes int64) *chartFilesCache {
+	return &chartFilesCache{
+		lock:     &sync.Mutex{},
+		maxBytes: maxBytes,
+		entries:  list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+func chartFilesCacheKey(repo string, name string, version string) string {
+	return pathutil.Join(repo, cm_repo.ChartPackageFilenameFromNameVersion(name, version))
+}
+
+// get returns the cached files of a chart version, unless they were extracted from a package with another digest
+func (cache *chartFilesCache) get(key string, digest string) ([]*chart.File, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	element, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*chartFilesCacheEntry)
+	if entry.digest != digest {
+		cache.removeElement(element)
+		return nil, false
+	}
+	cache.entries.MoveToFront(element)
+	return entry.files, true
+}
+
+// add caches the files of a chart version, evicting the least recently used ones until they fit
+func (cache *chartFilesCache) add(key string, digest string, files []*chart.File) {
+	var bytes int64
+	for _, file := range files {
+		bytes += int64(len(file.Name) + len(file.Data))
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.items[key]; ok {
+		cache.removeElement(element)
+	}
+	if bytes > cache.maxBytes {
+		return
+	}
+	cache.items[key] = cache.entries.PushFront(&chartFilesCacheEntry{key: key, digest: digest, files: files, bytes: bytes})
+	cache.bytes += bytes
+	for cache.bytes > cache.maxBytes {
+		cache.removeElement(cache.entries.Back())
+	}
+}
+
+func (cache *chartFilesCache) remove(key string) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if element, ok := cache.items[key]; ok {
+		cache.removeElement(element)
+	}
+}
+
+func (cache *chartFilesCache) removeElement(element *list.Element) {
+	entry := element.Value.(*chartFilesCacheEntry)
+	cache.entries.Remove(element)
+	delete(cache.items, entry.key)
+	cache.bytes -= entry.bytes
+}
+
+// getChartFiles extracts all files from the package of a chart version, using the LRU cache if possible
+func (server *MultiTenantServer) getChartFiles(log cm_logger.LoggingFn, repo string, name string, version string) (string, []*chart.File, *HTTPError) {
+	chartVersion, httpErr := server.getChartVersion(log, repo, name, version, false)
+	if httpErr != nil {
+		return "", nil, httpErr
+	}
+	version = chartVersion.Version
+
+	key := chartFilesCacheKey(repo, name, version)
+	if files, ok := server.chartFiles.get(key, chartVersion.Digest); ok {
+		return version, files, nil
+	}
+
+	object, err := server.StorageBackend.GetObject(key)
+	if err != nil {
+		return "", nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("no chart version found for %s-%s", name, version)}
+	}
+	c, err := loader.LoadArchive(bytes.NewBuffer(object.Content))
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error loading chart package",
+			"repo", repo,
+			"package", key,
+			"error", err.Error(),
+		)
+		return "", nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	server.chartFiles.add(key, chartVersion.Digest, c.Raw)
+	return version, c.Raw, nil
+}
+
+/*
+chartFilesMiddleware serves the files inside chart packages at /api/:repo/charts/:name/:version/files/*path, any
+other request being passed on to the router. The routes of the router have a fixed number of segments, and paths
+ending with .yaml are not taken for API routes, so the paths of chart files are matched here.
+*/
+func (server *MultiTenantServer) chartFilesMiddleware(c *gin.Context) {
+	if c.Request.Method != http.MethodGet {
+		return
+	}
+	path := c.Request.URL.Path
+	if contextPath := server.Router.ContextPath; contextPath != "" {
+		if !strings.HasPrefix(path, contextPath+"/") {
+			return
+		}
+		path = strings.TrimPrefix(path, contextPath)
+	}
+	if !strings.HasPrefix(path, "/api/") {
+		return
+	}
+
+	// the repo is followed by charts/<name>/<version>/files/<path>, the first match is taken with a dynamic depth
+	parts := strings.Split(strings.TrimPrefix(path, "/api/"), "/")
+	depth := -1
+	for i := 0; i+4 < len(parts); i++ {
+		if server.Router.DepthDynamic || i == server.Router.Depth {
+			if parts[i] == "charts" && parts[i+3] == "files" {
+				depth = i
+				break
+			}
+		}
+	}
+	if depth == -1 {
+		return
+	}
+	c.Abort()
+
+	repo := strings.Join(parts[:depth], "/")
+	if err := server.validateRepo(repo); err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	if !server.authorizeRepo(c, cm_auth.PullAction, repo) {
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	file, err := server.getChartFile(log, repo, parts[depth+1], parts[depth+2], strings.Join(parts[depth+4:], "/"))
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.Data(200, chartFileContentType(file), file.Data)
+}
+
+// getChartFile returns a single file from a chart package, by its path inside the package
+func (server *MultiTenantServer) getChartFile(log cm_logger.LoggingFn, repo string, name string, version string, path string) (*chart.File, *HTTPError) {
+	version, files, httpErr := server.getChartFiles(log, repo, name, version)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	path = strings.TrimPrefix(pathutil.Clean("/"+path), "/")
+	for _, file := range files {
+		if file.Name == path {
+			return file, nil
+		}
+	}
+	return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("%s not found in %s-%s", path, name, version)}
+}
+
+// getChartReadme returns the README of a chart, preferring README.md over other top level readme files
+func (server *MultiTenantServer) getChartReadme(log cm_logger.LoggingFn, repo string, name string, version string) (*chart.File, *HTTPError) {
+	version, files, httpErr := server.getChartFiles(log, repo, name, version)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	var readme *chart.File
+	for _, file := range files {
+		lower := strings.ToLower(file.Name)
+		if lower == "readme.md" {
+			return file, nil
+		}
+		if readme == nil && strings.HasPrefix(lower, "readme") && !strings.Contains(lower, "/") {
+			readme = file
+		}
+	}
+	if readme == nil {
+		return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("README not found in %s-%s", name, version)}
+	}
+	return readme, nil
+}
+
+func (server *MultiTenantServer) getChartTemplates(log cm_logger.LoggingFn, repo string, name string, version string) ([]*ChartFile, *HTTPError) {
+	_, files, httpErr := server.getChartFiles(log, repo, name, version)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	templates := []*ChartFile{}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name, "templates/") {
+			templates = append(templates, &ChartFile{Name: file.Name, Data: string(file.Data)})
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+	return templates, nil
+}
+
+func chartFileNames(files []*chart.File) []string {
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func chartFileContentType(file *chart.File) string {
+	switch strings.ToLower(pathutil.Ext(file.Name)) {
+	case ".yaml", ".yml":
+		return "application/x-yaml"
+	case ".tpl", ".txt":
+		return "text/plain; charset=utf-8"
+	case ".md":
+		return "text/markdown; charset=utf-8"
+	case ".json":
+		return "application/json"
+	}
+	return http.DetectContentType(file.Data)
+}
@@ -17,20 +17,19 @@ limitations under the License.
 package multitenant
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	pathutil "path"
 	"strconv"
+	"strings"
 	"time"
 
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
-	cm_storage "github.com/chartmuseum/storage"
+	cm_auth "github.com/chartmuseum/auth"
 	"github.com/gin-gonic/gin"
-	"go.uber.org/zap"
 	"helm.sh/helm/v3/pkg/chart"
 	helm_repo "helm.sh/helm/v3/pkg/repo"
 )
@@ -75,10 +74,10 @@ type (
 type (
 	chartOrProvenanceFile struct {
 		filename string
-		content  []byte
+		content  []byte // provenance files are small enough to be held in memory
 		field    string // file was extracted from this form field
+		chart    *spooledChartPackage
 	}
-	filenameFromContentFn func([]byte) (string, error)
 )
 
 func (server *MultiTenantServer) getWelcomePageHandler(c *gin.Context) {
@@ -97,12 +96,44 @@ func (server *MultiTenantServer) getHealthCheckHandler(c *gin.Context) {
 func (server *MultiTenantServer) getIndexFileRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	log := server.Logger.ContextLoggingFn(c)
-	indexFile, err := server.getIndexFile(log, repo)
+	entry, err := server.getIndexCacheEntry(log, repo)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
-	c.Data(200, indexFileContentType, indexFile.Raw)
+	rendition, err := server.getIndexRendition(log, entry, false, c.GetHeader("Accept-Encoding"))
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	server.sendIndexRendition(c, rendition, entry, indexFileContentType)
+}
+
+func (server *MultiTenantServer) getIndexJSONRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	entry, err := server.getIndexCacheEntry(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	rendition, err := server.getIndexRendition(log, entry, true, c.GetHeader("Accept-Encoding"))
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	server.sendIndexRendition(c, rendition, entry, indexJSONContentType)
+}
+
+func (server *MultiTenantServer) sendIndexRendition(c *gin.Context, rendition *indexRendition, entry *cacheEntry, contentType string) {
+	c.Header("Vary", "Accept-Encoding")
+	if notModified(c, rendition.etag, entry.RepoIndex.Generated) {
+		return
+	}
+	if rendition.contentEncoding != "" {
+		c.Header("Content-Encoding", rendition.contentEncoding)
+	}
+	c.Data(200, contentType, rendition.content)
 }
 
 func (server *MultiTenantServer) getStorageObjectRequestHandler(c *gin.Context) {
@@ -114,11 +145,167 @@ func (server *MultiTenantServer) getStorageObjectRequestHandler(c *gin.Context)
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
-	c.Data(200, storageObject.ContentType, storageObject.Content)
+	defer storageObject.Content.Close()
+	etag, etagErr := server.getStorageObjectETag(log, repo, filename, storageObject)
+	if etagErr != nil {
+		c.JSON(500, gin.H{"error": etagErr.Error()})
+		return
+	}
+	c.Header("ETag", etag)
+	c.Header("Content-Type", storageObject.ContentType)
+	// handles HEAD, range and conditional requests
+	http.ServeContent(c.Writer, c.Request, filename, storageObject.LastModified, storageObject.Content)
 }
 
 func (server *MultiTenantServer) getAllChartsRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
+	offset, limit, ok := getOffsetAndLimit(c)
+	if !ok {
+		return
+	}
+
+	log := server.Logger.ContextLoggingFn(c)
+	allCharts, err := server.getAllCharts(log, repo, offset, limit)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, allCharts)
+}
+
+func (server *MultiTenantServer) searchChartsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	query, queryExists := c.GetQuery("q")
+	if !queryExists {
+		c.JSON(400, gin.H{"error": "q is required"})
+		return
+	}
+	offset, limit, ok := getOffsetAndLimit(c)
+	if !ok {
+		return
+	}
+
+	log := server.Logger.ContextLoggingFn(c)
+	results, err := server.searchCharts(log, repo, query, offset, limit)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, results)
+}
+
+func (server *MultiTenantServer) getReposRequestHandler(c *gin.Context) {
+	offset, limit, ok := getOffsetAndLimit(c)
+	if !ok {
+		return
+	}
+	repos, ok := server.getPullableRepos(c)
+	if !ok {
+		return
+	}
+
+	log := server.Logger.ContextLoggingFn(c)
+	summaries, err := server.getRepos(log, repos, offset, limit)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, summaries)
+}
+
+func (server *MultiTenantServer) getRetentionCandidatesRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
+	candidates, err := server.getRetentionCandidates(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, candidates)
+}
+
+func (server *MultiTenantServer) getWebhookDeliveriesRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	c.JSON(200, server.webhookDeliveries.list(repo))
+}
+
+func (server *MultiTenantServer) getEventsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	lastEventID := c.GetHeader("Last-Event-ID")
+	subscriber, missed, resync := server.eventFeed.subscribe(repo, lastEventID)
+	defer server.eventFeed.unsubscribe(subscriber)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// disables response buffering in nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+
+	if resync {
+		fmt.Fprintf(c.Writer, "event: %s\ndata: {}\n\n", feedResyncEvent)
+	}
+	for _, e := range missed {
+		if writeFeedEvent(c, e) != nil {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventFeedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-subscriber:
+			if !ok {
+				return // the client was too slow
+			}
+			if writeFeedEvent(c, e) != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+func (server *MultiTenantServer) getStorageUsageRequestHandler(c *gin.Context) {
+	log := server.Logger.ContextLoggingFn(c)
+	repo := c.Param("repo")
+	usage, err := server.getStorageUsage(log, repo)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, usage)
+}
+
+func (server *MultiTenantServer) getAuditRecordsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	offset, limit, ok := getOffsetAndLimit(c)
+	if !ok {
+		return
+	}
+	query := auditQuery{
+		name:    c.Query("name"),
+		version: c.Query("version"),
+		action:  c.Query("action"),
+	}
+	records, err := server.getAuditRecords(repo, query, offset, limit)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, records)
+}
+
+// getOffsetAndLimit reads the offset and limit pagination params, responding with 400 if either is invalid
+func getOffsetAndLimit(c *gin.Context) (int, int, bool) {
 	offset := 0
 	offsetString, offsetExists := c.GetQuery("offset")
 	if offsetExists {
@@ -126,7 +313,7 @@ func (server *MultiTenantServer) getAllChartsRequestHandler(c *gin.Context) {
 		offset, convErr = strconv.Atoi(offsetString)
 		if convErr != nil || offset < 0 {
 			c.JSON(400, gin.H{"error": "offset is not a valid non-negative integer"})
-			return
+			return 0, 0, false
 		}
 	}
 
@@ -137,23 +324,31 @@ func (server *MultiTenantServer) getAllChartsRequestHandler(c *gin.Context) {
 		limit, convErr = strconv.Atoi(limitString)
 		if convErr != nil || limit <= 0 {
 			c.JSON(400, gin.H{"error": "limit is not a valid positive integer"})
-			return
+			return 0, 0, false
 		}
 	}
-
-	log := server.Logger.ContextLoggingFn(c)
-	allCharts, err := server.getAllCharts(log, repo, offset, limit)
-	if err != nil {
-		c.JSON(err.Status, gin.H{"error": err.Message})
-		return
-	}
-	c.JSON(200, allCharts)
+	return offset, limit, true
 }
 
 func (server *MultiTenantServer) getChartRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	name := c.Param("name")
 	log := server.Logger.ContextLoggingFn(c)
+	constraint, constraintExists := c.GetQuery("version")
+	_, includePrereleasesExists := c.GetQuery("includePrereleases")
+	if constraintExists || includePrereleasesExists {
+		includePrereleases, ok := getIncludePrereleases(c)
+		if !ok {
+			return
+		}
+		chartVersions, err := server.getChartVersions(log, repo, name, constraint, includePrereleases)
+		if err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+		c.JSON(200, chartVersions)
+		return
+	}
 	chart, err := server.getChart(log, repo, name)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
@@ -178,8 +373,12 @@ func (server *MultiTenantServer) getChartVersionRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	name := c.Param("name")
 	version := c.Param("version")
+	includePrereleases, ok := getIncludePrereleases(c)
+	if !ok {
+		return
+	}
 	log := server.Logger.ContextLoggingFn(c)
-	chartVersion, err := server.getChartVersion(log, repo, name, version)
+	chartVersion, err := server.getChartVersion(log, repo, name, version, includePrereleases)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
@@ -191,8 +390,12 @@ func (server *MultiTenantServer) headChartVersionRequestHandler(c *gin.Context)
 	repo := c.Param("repo")
 	name := c.Param("name")
 	version := c.Param("version")
+	includePrereleases, ok := getIncludePrereleases(c)
+	if !ok {
+		return
+	}
 	log := server.Logger.ContextLoggingFn(c)
-	_, err := server.getChartVersion(log, repo, name, version)
+	_, err := server.getChartVersion(log, repo, name, version, includePrereleases)
 	if err != nil {
 		c.Status(err.Status)
 		return
@@ -200,16 +403,83 @@ func (server *MultiTenantServer) headChartVersionRequestHandler(c *gin.Context)
 	c.Status(200)
 }
 
+func (server *MultiTenantServer) getChartFilesRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	_, files, err := server.getChartFiles(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, chartFileNames(files))
+}
+
+func (server *MultiTenantServer) getChartReadmeRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	file, err := server.getChartReadme(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.Data(200, chartFileContentType(file), file.Data)
+}
+
+func (server *MultiTenantServer) getChartTemplatesRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	templates, err := server.getChartTemplates(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, templates)
+}
+
+// getIncludePrereleases reads the includePrereleases param, responding with 400 if it is invalid
+func getIncludePrereleases(c *gin.Context) (bool, bool) {
+	includePrereleasesString, includePrereleasesExists := c.GetQuery("includePrereleases")
+	if !includePrereleasesExists {
+		return false, true
+	}
+	if includePrereleasesString == "" {
+		return true, true
+	}
+	includePrereleases, convErr := strconv.ParseBool(includePrereleasesString)
+	if convErr != nil {
+		c.JSON(400, gin.H{"error": "includePrereleases is not a valid boolean"})
+		return false, false
+	}
+	return includePrereleases, true
+}
+
 func (server *MultiTenantServer) deleteChartVersionRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
 	name := c.Param("name")
 	version := c.Param("version")
 	log := server.Logger.ContextLoggingFn(c)
+	if server.getTenantSettings(log, repo).disableDelete {
+		// as if the route did not exist, which is the case when deletes are disabled for every tenant
+		c.JSON(404, gin.H{"error": "not found"})
+		return
+	}
+	record := &AuditRecord{Action: AuditActionDelete, Repo: repo, Name: name, Version: version}
+	if server.AuditStore != nil {
+		// the digest of the deleted package, while it is still indexed
+		record.Digest = server.getIndexedDigest(log, repo, name, version)
+	}
 	err := server.deleteChartVersion(log, repo, name, version)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	server.auditRequest(c, record)
 
 	server.emitEvent(c, repo, deleteChart, &helm_repo.ChartVersion{
 		Metadata: &chart.Metadata{
@@ -222,76 +492,294 @@ func (server *MultiTenantServer) deleteChartVersionRequestHandler(c *gin.Context
 	c.JSON(200, objectDeletedResponse)
 }
 
+func (server *MultiTenantServer) putChartVersionDeprecationRequestHandler(c *gin.Context) {
+	server.setChartVersionDeprecatedRequestHandler(c, true)
+}
+
+func (server *MultiTenantServer) deleteChartVersionDeprecationRequestHandler(c *gin.Context) {
+	server.setChartVersionDeprecatedRequestHandler(c, false)
+}
+
+func (server *MultiTenantServer) setChartVersionDeprecatedRequestHandler(c *gin.Context, deprecated bool) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	chartVersion, err := server.setChartVersionDeprecated(log, repo, name, version, deprecated)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+
+	server.emitEvent(c, repo, updateChart, chartVersion)
+	c.JSON(200, gin.H{"deprecated": deprecated})
+}
+
+func (server *MultiTenantServer) getChartVersionDependenciesRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	otherRepos, ok := server.getOtherRepos(c, repo)
+	if !ok {
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	tree, err := server.getChartVersionDependencies(log, repo, name, version, otherRepos)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, tree)
+}
+
+func (server *MultiTenantServer) getChartVersionLintRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	log := server.Logger.ContextLoggingFn(c)
+	report, err := server.getLintReport(log, repo, name, version)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, report)
+}
+
+func (server *MultiTenantServer) getChartDependentsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Query("version")
+	otherRepos, ok := server.getOtherRepos(c, repo)
+	if !ok {
+		return
+	}
+	log := server.Logger.ContextLoggingFn(c)
+	dependents, err := server.getChartDependents(log, repo, name, version, otherRepos)
+	if err != nil {
+		c.JSON(err.Status, gin.H{"error": err.Message})
+		return
+	}
+	c.JSON(200, dependents)
+}
+
+// getOtherRepos reads the comma-separated repos param, responding with 400 or 401 if a repo is invalid or
+// not readable. With "*", all readable repos in storage are returned.
+func (server *MultiTenantServer) getOtherRepos(c *gin.Context, repo string) ([]string, bool) {
+	reposString := c.Query("repos")
+	if reposString == "" {
+		return nil, true
+	}
+
+	var otherRepos []string
+	if reposString == "*" {
+		repos, ok := server.getPullableRepos(c)
+		if !ok {
+			return nil, false
+		}
+		for _, otherRepo := range repos {
+			if otherRepo != repo {
+				otherRepos = append(otherRepos, otherRepo)
+			}
+		}
+		return otherRepos, true
+	}
+
+	for _, otherRepo := range strings.Split(reposString, ",") {
+		otherRepo = strings.TrimSpace(otherRepo)
+		if err := server.validateRepo(otherRepo); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		if !server.authorizeRepo(c, cm_auth.PullAction, otherRepo) {
+			return nil, false
+		}
+		otherRepos = append(otherRepos, otherRepo)
+	}
+	return otherRepos, true
+}
+
+// getPullableRepos returns the repos in storage which can be pulled, responding with 500 on error
+func (server *MultiTenantServer) getPullableRepos(c *gin.Context) ([]string, bool) {
+	log := server.Logger.ContextLoggingFn(c)
+	repos, err := server.discoverTenants(log)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	var pullableRepos []string
+	for _, repo := range repos {
+		permissions, err := server.isRepoAuthorized(c, cm_auth.PullAction, repo)
+		if err != nil {
+			server.Logger.Error(err)
+			c.JSON(500, gin.H{"error": "internal server error"})
+			return nil, false
+		}
+		if permissions.Allowed {
+			pullableRepos = append(pullableRepos, repo)
+		}
+	}
+	return pullableRepos, true
+}
+
+// authorizeRepo checks an action on a repo not authorized by the router, responding with 401 if not allowed
+func (server *MultiTenantServer) authorizeRepo(c *gin.Context, action string, repo string) bool {
+	permissions, err := server.isRepoAuthorized(c, action, repo)
+	if err != nil {
+		server.Logger.Error(err)
+		c.JSON(500, gin.H{"error": "internal server error"})
+		return false
+	}
+	if !permissions.Allowed {
+		if permissions.WWWAuthenticateHeader != "" {
+			c.Header("WWW-Authenticate", permissions.WWWAuthenticateHeader)
+		}
+		c.JSON(401, gin.H{"error": "unauthorized"})
+		return false
+	}
+	return true
+}
+
+// isRepoAuthorized checks an action on a repo, pulls being allowed anonymously if the tenant has anonymous-get
+func (server *MultiTenantServer) isRepoAuthorized(c *gin.Context, action string, repo string) (*cm_auth.Permission, error) {
+	if server.Router.Authorizer == nil {
+		return &cm_auth.Permission{Allowed: true}, nil
+	}
+	if action == cm_auth.PullAction && server.getTenantSettings(server.Logger.ContextLoggingFn(c), repo).anonymousGet {
+		return &cm_auth.Permission{Allowed: true}, nil
+	}
+	namespace := repo
+	if namespace == "" {
+		namespace = cm_auth.DefaultNamespace
+	}
+	// anonymous pulls were decided above, the authorizer shared with the router is left as configured
+	authorizer := *server.Router.Authorizer
+	authorizer.AnonymousActions = nil
+	return authorizer.Authorize(c.GetHeader("Authorization"), action, namespace)
+}
+
+func (server *MultiTenantServer) promoteChartVersionRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	version := c.Param("version")
+	targetRepo, targetRepoExists := c.GetQuery("to")
+	if !targetRepoExists {
+		c.JSON(400, gin.H{"error": "to is required"})
+		return
+	}
+	_, force := c.GetQuery("force")
+
+	// the route only authorizes the source repo, promoting also requires push access to the target
+	if !server.authorizeRepo(c, cm_auth.PushAction, targetRepo) {
+		return
+	}
+
+	log := server.Logger.ContextLoggingFn(c)
+	action := server.auditUploadAction(log, targetRepo, cm_repo.ChartPackageFilenameFromNameVersion(name, version), force)
+	chartVersion, report, err := server.promoteChartVersion(log, repo, name, version, targetRepo, force)
+	if err != nil {
+		c.JSON(err.Status, report.response(gin.H{"error": err.Message}))
+		return
+	}
+	record := auditChartVersion(targetRepo, action, chartVersion)
+	record.Source = repo
+	server.auditRequest(c, record)
+
+	server.emitEvent(c, targetRepo, addChart, chartVersion)
+	c.JSON(201, report.response(objectSavedResponse))
+}
+
 func (server *MultiTenantServer) postRequestHandler(c *gin.Context) {
+	settings := server.getTenantSettings(server.Logger.ContextLoggingFn(c), c.Param("repo"))
+	server.limitUploadSize(c, settings)
 	if c.ContentType() == "multipart/form-data" {
-		server.postPackageAndProvenanceRequestHandler(c) // new route handling form-based chart and/or prov files
+		server.postPackageAndProvenanceRequestHandler(c, settings) // new route handling form-based chart and/or prov files
 	} else {
-		server.postPackageRequestHandler(c) // classic binary data, chart package only route
+		server.postPackageRequestHandler(c, settings) // classic binary data, chart package only route
 	}
 }
 
-func (server *MultiTenantServer) postPackageRequestHandler(c *gin.Context) {
+func (server *MultiTenantServer) postPackageRequestHandler(c *gin.Context, settings *tenantSettings) {
 	repo := c.Param("repo")
-	content, getContentErr := c.GetRawData()
-	if getContentErr != nil {
+	// the package is spooled to disk rather than read in memory, its size is capped by the request size limiter
+	chartPackage, spoolErr := spoolChartPackage(c.Request.Body, time.Now())
+	if spoolErr != nil {
 		if len(c.Errors) > 0 {
 			return // this is a "request too large"
 		}
-		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", getContentErr)})
+		if err := uploadTooLargeError(settings, spoolErr); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
+		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", spoolErr)})
 		return
 	}
+	defer chartPackage.remove()
 	log := server.Logger.ContextLoggingFn(c)
 	_, force := c.GetQuery("force")
-	filename, err := server.uploadChartPackage(log, repo, content, force)
+	action := server.auditUploadAction(log, repo, chartPackage.filename, force)
+	chart, report, err := server.uploadChartPackage(log, repo, chartPackage, force)
 	if err != nil {
-		c.JSON(err.Status, gin.H{"error": err.Message})
+		c.JSON(err.Status, report.response(gin.H{"error": err.Message}))
 		return
 	}
+	server.auditRequest(c, auditChartVersion(repo, action, chart))
 
-	chart, chartErr := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{
-		Path:         pathutil.Join(repo, filename),
-		Content:      content,
-		LastModified: time.Now()})
-	if chartErr != nil {
-		log(cm_logger.ErrorLevel, "cannot get chart from content", zap.Error(chartErr), zap.Binary("content", content))
-	}
 	server.emitEvent(c, repo, addChart, chart)
 
-	c.JSON(201, objectSavedResponse)
+	c.JSON(201, report.response(objectSavedResponse))
 }
 
-// TODO: whether need update cache
 func (server *MultiTenantServer) postProvenanceFileRequestHandler(c *gin.Context) {
 	repo := c.Param("repo")
+	settings := server.getTenantSettings(server.Logger.ContextLoggingFn(c), repo)
+	server.limitUploadSize(c, settings)
 	content, getContentErr := c.GetRawData()
 	if getContentErr != nil {
 		if len(c.Errors) > 0 {
 			return // this is a "request too large"
 		}
+		if err := uploadTooLargeError(settings, getContentErr); err != nil {
+			c.JSON(err.Status, gin.H{"error": err.Message})
+			return
+		}
 		c.JSON(500, gin.H{"error": fmt.Sprintf("%s", getContentErr)})
 		return
 	}
 	log := server.Logger.ContextLoggingFn(c)
 	_, force := c.GetQuery("force")
-	err := server.uploadProvenanceFile(log, repo, content, force)
+	chart, err := server.uploadProvenanceFile(log, repo, content, force)
 	if err != nil {
 		c.JSON(err.Status, gin.H{"error": err.Message})
 		return
 	}
+	if filename, err := cm_repo.ProvenanceFilenameFromContent(content); err == nil {
+		server.auditRequest(c, auditProvenanceFile(repo, filename, content))
+		server.storeOCIManifestOfProvenanceFile(log, repo, filename)
+	}
+	if chart != nil {
+		// add the signer of the verified provenance file to the index
+		server.emitEvent(c, repo, updateChart, chart)
+	}
 	c.JSON(201, objectSavedResponse)
 }
 
-func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.Context) {
-	log := server.Logger.ContextLoggingFn(&gin.Context{})
+func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.Context, settings *tenantSettings) {
 	repo := c.Param("repo")
+	log := server.Logger.ContextLoggingFn(c)
 	_, force := c.GetQuery("force")
-	var chartContent []byte
-	var path string
-	cpFiles, status, err := server.getChartAndProvFiles(c.Request, repo, force)
+	cpFiles, status, err := server.getChartAndProvFiles(log, c.Request, repo, force)
 	if status != 200 {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		if httpErr := uploadTooLargeError(settings, err); httpErr != nil {
+			c.JSON(httpErr.Status, gin.H{"error": httpErr.Message})
+			return
+		}
 		c.JSON(status, gin.H{"error": fmt.Sprintf("%s", err)})
 		return
 	}
+	defer removeChartOrProvenanceFiles(cpFiles)
 
 	if len(cpFiles) == 0 {
 		if len(c.Errors) > 0 {
@@ -304,97 +792,189 @@ func (server *MultiTenantServer) postPackageAndProvenanceRequestHandler(c *gin.C
 		return
 	}
 
+	chart, report, uploadErr := server.uploadChartOrProvenanceFiles(c, repo, cpFiles, force)
+	if uploadErr != nil {
+		c.JSON(uploadErr.Status, report.response(gin.H{"error": uploadErr.Message}))
+		return
+	}
+	if chart == nil {
+		// provenance files only
+		c.JSON(201, objectSavedResponse)
+		return
+	}
+
+	server.emitEvent(c, repo, addChart, chart)
+
+	c.JSON(201, report.response(objectSavedResponse))
+}
+
+/*
+uploadChartOrProvenanceFiles checks and stores the chart package and provenance files of a single upload together,
+returning the chart version of the package if there is one, and the report of the upload. The files must have been
+validated with validateChartOrProv.
+*/
+func (server *MultiTenantServer) uploadChartOrProvenanceFiles(c *gin.Context, repo string, cpFiles map[string]*chartOrProvenanceFile, force bool) (*helm_repo.ChartVersion, *uploadReport, *HTTPError) {
+	log := server.Logger.ContextLoggingFn(c)
+	var chart *helm_repo.ChartVersion
+
+	report := &uploadReport{}
+	if httpErr := server.checkNotUpstreamProxy(repo); httpErr != nil {
+		return nil, report, httpErr
+	}
+	for _, ppf := range cpFiles {
+		if ppf.chart == nil {
+			continue
+		}
+		if checkErr := server.checkUploadedChartPackage(log, repo, ppf.chart, report); checkErr != nil {
+			return nil, report, checkErr
+		}
+	}
+
+	provenances, verifyErr := server.verifyUploadedProvenance(log, repo, cpFiles)
+	if verifyErr != nil {
+		return nil, nil, verifyErr
+	}
+
+	files := make([]*chartOrProvenanceFile, 0, len(cpFiles))
+	for _, ppf := range cpFiles {
+		files = append(files, ppf)
+	}
+	if limitErr := server.checkStorageLimit(log, repo, files, force); limitErr != nil {
+		return nil, nil, limitErr
+	}
+
 	// At this point input is presumed valid, we now proceed to store it
-	// Undo transaction if there is an error
-	var storedFiles []*chartOrProvenanceFile
+	// Files are staged, and only published once all of them are stored
+	upload := server.newStagedUpload(repo)
+	var records []*AuditRecord
 	for _, ppf := range cpFiles {
+		if ppf.chart != nil {
+			records = append(records, auditChartVersion(repo, server.auditUploadAction(log, repo, ppf.filename, force), ppf.chart.chartVersion))
+		} else {
+			records = append(records, auditProvenanceFile(repo, ppf.filename, ppf.content))
+		}
 		server.Logger.Debugc(c, "Adding file to storage (form field)",
 			"filename", ppf.filename,
 			"field", ppf.field,
 		)
-		err := server.StorageBackend.PutObject(pathutil.Join(repo, ppf.filename), ppf.content)
-		if err == nil {
-			storedFiles = append(storedFiles, ppf)
-		} else {
-			// Clean up what's already been saved
-			for _, ppf := range storedFiles {
-				server.StorageBackend.DeleteObject(ppf.filename)
-			}
-			c.JSON(500, gin.H{"error": fmt.Sprintf("%s", err)})
-			return
+		if err := upload.stage(ppf); err != nil {
+			return nil, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
 		}
-		if ppf.field == defaultFormField {
-			// find the content of chart
-			chartContent = ppf.content
-			path = pathutil.Join(repo, ppf.filename)
+		if ppf.chart != nil {
+			// the chart version parsed when the package was received
+			chart = ppf.chart.chartVersion
 		}
 	}
-
-	chart, chartErr := cm_repo.ChartVersionFromStorageObject(cm_storage.Object{
-		Path:         path,
-		Content:      chartContent,
-		LastModified: time.Now()})
-	if chartErr != nil {
-		log(cm_logger.ErrorLevel, "cannot get chart from content", zap.Error(err), zap.Binary("content", chartContent))
+	if err := upload.publish(); err != nil {
+		return nil, nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	for _, record := range records {
+		server.auditRequest(c, record)
 	}
 
-	server.emitEvent(c, repo, addChart, chart)
-
-	c.JSON(201, objectSavedResponse)
+	for _, provenance := range provenances {
+		server.recordProvenance(log, repo, provenance)
+		if _, ok := cpFiles[provenance.filename]; !ok {
+			// provenance file uploaded without its package
+			server.emitEvent(c, repo, updateChart, provenance.chartVersion)
+		}
+	}
+	for filename, ppf := range cpFiles {
+		if ppf.chart == nil && cpFiles[strings.TrimSuffix(filename, provenanceFileSuffix)] == nil {
+			server.storeOCIManifestOfProvenanceFile(log, repo, filename)
+		}
+	}
+	for _, lint := range report.lint {
+		server.recordLintReport(log, repo, lint)
+	}
+	return chart, report, nil
 }
 
-func (server *MultiTenantServer) getChartAndProvFiles(req *http.Request, repo string, force bool) (map[string]*chartOrProvenanceFile, int, error) {
-	type fieldFuncPair struct {
+func (server *MultiTenantServer) getChartAndProvFiles(log cm_logger.LoggingFn, req *http.Request, repo string, force bool) (map[string]*chartOrProvenanceFile, int, error) {
+	type formField struct {
 		field string
-		fn    filenameFromContentFn
+		chart bool // chart package or provenance file
 	}
 
-	ffp := []fieldFuncPair{
-		{defaultFormField, cm_repo.ChartPackageFilenameFromContent},
-		{server.ChartPostFormFieldName, cm_repo.ChartPackageFilenameFromContent},
-		{defaultProvField, cm_repo.ProvenanceFilenameFromContent},
-		{server.ProvPostFormFieldName, cm_repo.ProvenanceFilenameFromContent},
+	formFields := []formField{
+		{defaultFormField, true},
+		{server.ChartPostFormFieldName, true},
+		{defaultProvField, false},
+		{server.ProvPostFormFieldName, false},
 	}
 
-	cpFiles := make(map[string]*chartOrProvenanceFile)
-	for _, ff := range ffp {
-		content, err := extractContentFromRequest(req, ff.field)
-		if err != nil {
-			return nil, 500, err
+	var fields []string
+	for _, ff := range formFields {
+		fields = append(fields, ff.field)
+	}
+	spooledFiles, err := extractFilesFromRequest(req, fields)
+	if err != nil {
+		return nil, 500, err
+	}
+	// files which are not kept (invalid or duplicates) are removed once parsed
+	defer func() {
+		for _, file := range spooledFiles {
+			file.remove()
 		}
-		if content == nil {
+	}()
+
+	cpFiles := make(map[string]*chartOrProvenanceFile)
+	for _, ff := range formFields {
+		file, ok := spooledFiles[ff.field]
+		if !ok {
 			continue
 		}
-		filename, err := ff.fn(content)
+		cpFile, status, err := newChartOrProvenanceFile(file, ff.field, ff.chart)
 		if err != nil {
-			return nil, 400, err
+			removeChartOrProvenanceFiles(cpFiles)
+			return nil, status, err
 		}
-		if _, ok := cpFiles[filename]; ok {
+		if _, ok := cpFiles[cpFile.filename]; ok {
 			continue
 		}
-		if status, err := server.validateChartOrProv(repo, filename, force); err != nil {
+		if status, err := server.validateChartOrProv(log, repo, cpFile, force); err != nil {
+			removeChartOrProvenanceFiles(cpFiles)
 			return nil, status, err
 		}
-		cpFiles[filename] = &chartOrProvenanceFile{filename, content, ff.field}
+		if cpFile.chart != nil {
+			delete(spooledFiles, ff.field)
+		}
+		cpFiles[cpFile.filename] = cpFile
 	}
 
 	return cpFiles, 200, nil
 }
 
-func extractContentFromRequest(req *http.Request, field string) ([]byte, error) {
-	file, header, _ := req.FormFile(field)
-	if file == nil || header == nil {
-		return nil, nil // field is not present
+// newChartOrProvenanceFile parses a spooled form file, reading provenance files in memory
+func newChartOrProvenanceFile(file *spooledFile, field string, chart bool) (*chartOrProvenanceFile, int, error) {
+	if chart {
+		chartPackage, err := parseChartPackage(file, time.Now())
+		if err != nil {
+			return nil, 400, err
+		}
+		return &chartOrProvenanceFile{filename: chartPackage.filename, field: field, chart: chartPackage}, 200, nil
+	}
+	content, err := file.readAll()
+	if err != nil {
+		return nil, 500, err // IO error
 	}
-	buf := bytes.NewBuffer(nil)
-	_, err := io.Copy(buf, file)
+	filename, err := cm_repo.ProvenanceFilenameFromContent(content)
 	if err != nil {
-		return nil, err // IO error
+		return nil, 400, err
 	}
-	return buf.Bytes(), nil
+	return &chartOrProvenanceFile{filename: filename, content: content, field: field}, 200, nil
 }
 
-func (server *MultiTenantServer) validateChartOrProv(repo, filename string, force bool) (int, error) {
+// putChartOrProvenanceFile stores a chart package or provenance file at a path, streaming spooled chart packages
+func (server *MultiTenantServer) putChartOrProvenanceFile(path string, ppf *chartOrProvenanceFile) error {
+	if ppf.chart != nil {
+		return putStorageFile(server.StorageBackend, path, ppf.chart.spooledFile)
+	}
+	return server.StorageBackend.PutObject(path, ppf.content)
+}
+
+func (server *MultiTenantServer) validateChartOrProv(log cm_logger.LoggingFn, repo string, ppf *chartOrProvenanceFile, force bool) (int, error) {
+	filename := ppf.filename
 	if pathutil.Base(filename) != filename {
 		return 400, fmt.Errorf("%s is improperly formatted", filename) // Name wants to break out of current directory
 	}
@@ -405,11 +985,9 @@ func (server *MultiTenantServer) validateChartOrProv(repo, filename string, forc
 	} else {
 		f = repo + "/" + filename
 	}
-	if !server.AllowOverwrite && (!server.AllowForceOverwrite || !force) {
-		_, err := server.StorageBackend.GetObject(f)
-		if err == nil {
-			return 409, fmt.Errorf("%s already exists", f) // conflict
-		}
+	settings := server.getTenantSettings(log, repo)
+	if httpErr := server.checkOverwrite(settings, f, ppf.version(), force, fmt.Sprintf("%s already exists", f)); httpErr != nil {
+		return httpErr.Status, errors.New(httpErr.Message) // conflict
 	}
 	return 200, nil
 }
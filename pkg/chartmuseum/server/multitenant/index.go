@@ -30,6 +30,20 @@ var (
 )
 
 func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo string) (*cm_repo.Index, *HTTPError) {
+	entry, err := server.getIndexCacheEntry(log, repo)
+	if entry == nil {
+		return nil, err
+	}
+	return entry.RepoIndex, err
+}
+
+// getIndexCacheEntry returns the cache entry of a repo, with its index synced with storage
+func (server *MultiTenantServer) getIndexCacheEntry(log cm_logger.LoggingFn, repo string) (*cacheEntry, *HTTPError) {
+	if proxy := server.getUpstreamProxy(repo); proxy != nil {
+		// the index of a proxy tenant is the upstream one
+		return server.getUpstreamProxyCacheEntry(log, proxy)
+	}
+
 	entry, err := server.initCacheEntry(log, repo)
 	if err != nil {
 		errStr := err.Error()
@@ -67,9 +81,9 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 				log(cm_logger.ErrorLevel, errStr,
 					"repo", repo,
 				)
-				return ir.index, &HTTPError{http.StatusInternalServerError, errStr}
+				return &cacheEntry{RepoName: repo, RepoIndex: ir.index}, &HTTPError{http.StatusInternalServerError, errStr}
 			}
-			entry.RepoIndex = ir.index
+			entry.setRepoIndex(ir.index)
 
 			if server.UseStatefiles {
 				// Dont wait, save index-cache.yaml to storage in the background.
@@ -78,7 +92,32 @@ func (server *MultiTenantServer) getIndexFile(log cm_logger.LoggingFn, repo stri
 			}
 		}
 	}
-	return entry.RepoIndex, nil
+	return entry, nil
+}
+
+// getIndexRendition returns the index.yaml, or index.json, of a cache entry in the encoding accepted by a client
+func (server *MultiTenantServer) getIndexRendition(log cm_logger.LoggingFn, entry *cacheEntry, json bool, acceptEncoding string) (*indexRendition, *HTTPError) {
+	etag := entry.RepoIndexETag
+	if etag == "" {
+		// e.g. an entry saved in the cache store by an earlier version
+		etag = indexETag(entry.RepoIndex.Raw)
+	}
+	renditions := server.indexRenditions.get(entry.RepoName, etag, entry.RepoIndex.Raw)
+	var rendition *indexRendition
+	var err error
+	if json {
+		rendition, err = renditions.json(acceptEncoding)
+	} else {
+		rendition, err = renditions.yaml(acceptEncoding)
+	}
+	if err != nil {
+		errStr := err.Error()
+		log(cm_logger.ErrorLevel, errStr,
+			"repo", entry.RepoName,
+		)
+		return nil, &HTTPError{http.StatusInternalServerError, errStr}
+	}
+	return rendition, nil
 }
 
 func (server *MultiTenantServer) saveStatefile(log cm_logger.LoggingFn, repo string, content []byte) {
@@ -0,0 +1,195 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/lint"
+	"helm.sh/helm/v3/pkg/lint/support"
+)
+
+const (
+	// LintPolicyOff does not lint uploaded chart packages
+	LintPolicyOff = "off"
+	// LintPolicyWarn lints uploaded chart packages, returning the findings without rejecting any package
+	LintPolicyWarn = "warn"
+	// LintPolicyReject lints uploaded chart packages, rejecting the ones with errors
+	LintPolicyReject = "reject"
+
+	// the namespace templates are rendered in when linting, as with helm lint
+	lintNamespace = "default"
+)
+
+var (
+	lintSeverities = map[int]string{
+		support.UnknownSev: "unknown",
+		support.InfoSev:    "info",
+		support.WarningSev: "warning",
+		support.ErrorSev:   "error",
+	}
+)
+
+type (
+	// lintReport holds the findings of Helm's lint rules on a chart package
+	lintReport struct {
+		Name     string         `json:"name"`
+		Version  string         `json:"version"`
+		Digest   string         `json:"digest"`
+		Policy   string         `json:"policy"`
+		Passed   bool           `json:"passed"`
+		LintedAt time.Time      `json:"lintedAt"`
+		Messages []*lintMessage `json:"messages"`
+	}
+
+	lintMessage struct {
+		Severity string `json:"severity"`
+		Path     string `json:"path"`
+		Message  string `json:"message"`
+	}
+)
+
+// ValidateLintPolicy checks that a lint policy is one of off, warn or reject
+func ValidateLintPolicy(policy string) error {
+	switch policy {
+	case LintPolicyOff, LintPolicyWarn, LintPolicyReject:
+		return nil
+	}
+	return fmt.Errorf("unsupported lint policy %q, must be one of %s, %s or %s", policy, LintPolicyOff, LintPolicyWarn, LintPolicyReject)
+}
+
+/*
+lintChartPackage runs Helm's lint rules (chart metadata, values and their schema, templates) on a spooled
+chart package. The rules only read charts from disk, so the package is expanded in a temporary directory.
+*/
+func lintChartPackage(chartPackage *spooledChartPackage, policy string) (*lintReport, error) {
+	dir, err := ioutil.TempDir("", "chartmuseum-lint")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := chartutil.ExpandFile(dir, chartPackage.path); err != nil {
+		return nil, err
+	}
+
+	chartVersion := chartPackage.chartVersion
+	linter := lint.All(filepath.Join(dir, chartVersion.Name), map[string]interface{}{}, lintNamespace, false)
+	report := &lintReport{
+		Name:     chartVersion.Name,
+		Version:  chartVersion.Version,
+		Digest:   chartPackage.digest,
+		Policy:   policy,
+		Passed:   linter.HighestSeverity < support.ErrorSev,
+		LintedAt: time.Now().UTC(),
+		Messages: []*lintMessage{},
+	}
+	for _, msg := range linter.Messages {
+		report.Messages = append(report.Messages, &lintMessage{
+			Severity: lintSeverities[msg.Severity],
+			// relative to the chart, rather than to the temporary directory
+			Path:    strings.TrimPrefix(msg.Path, dir+string(filepath.Separator)),
+			Message: msg.Err.Error(),
+		})
+	}
+	return report, nil
+}
+
+/*
+lintUploadedChartPackage lints a chart package uploaded to a tenant according to its lint policy. Nil is returned
+if the policy is off. With the reject policy a package failing the lint rules is rejected with a 400, the report
+being returned along with the error so the findings can be sent back.
+*/
+func (server *MultiTenantServer) lintUploadedChartPackage(log cm_logger.LoggingFn, repo string, chartPackage *spooledChartPackage) (*lintReport, *HTTPError) {
+	policy := server.getTenantSettings(log, repo).lintPolicy
+	if policy == "" || policy == LintPolicyOff {
+		return nil, nil
+	}
+	report, err := lintChartPackage(chartPackage, policy)
+	if err != nil {
+		return nil, &HTTPError{http.StatusBadRequest, fmt.Sprintf("lint: %s", err)}
+	}
+	if !report.Passed {
+		log(cm_logger.WarnLevel, "Chart package failed lint",
+			"repo", repo,
+			"package", chartPackage.filename,
+			"policy", policy,
+		)
+		if policy == LintPolicyReject {
+			return report, &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s failed lint: %s", chartPackage.filename, report.errors())}
+		}
+	}
+	return report, nil
+}
+
+// errors returns the error findings of a report, as a single message
+func (report *lintReport) errors() string {
+	var errors []string
+	for _, msg := range report.Messages {
+		if msg.Severity == lintSeverities[support.ErrorSev] {
+			errors = append(errors, fmt.Sprintf("%s: %s", msg.Path, msg.Message))
+		}
+	}
+	return strings.Join(errors, "; ")
+}
+
+// recordLintReport saves the lint report of a stored chart package in the tenant's metadata overlay
+func (server *MultiTenantServer) recordLintReport(log cm_logger.LoggingFn, repo string, report *lintReport) {
+	err := server.updateMetadataOverlay(log, repo, func(overlay *metadataOverlay) bool {
+		cvo := overlay.get(report.Name, report.Version)
+		if cvo == nil {
+			cvo = &chartVersionOverlay{}
+		}
+		cvo.Lint = report
+		overlay.set(report.Name, report.Version, cvo)
+		return true
+	})
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error saving lint report to metadata-overlay.yaml",
+			"repo", repo,
+			"name", report.Name,
+			"version", report.Version,
+			"error", err.Error(),
+		)
+	}
+}
+
+// getLintReport returns the lint report of a chart version, saved when its package was uploaded
+func (server *MultiTenantServer) getLintReport(log cm_logger.LoggingFn, repo string, name string, version string) (*lintReport, *HTTPError) {
+	chartVersion, httpErr := server.getChartVersion(log, repo, name, version, false)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	overlay, err := server.getMetadataOverlay(repo)
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	cvo := overlay.get(chartVersion.Name, chartVersion.Version)
+	// a report is only valid for the package it was made for, which may have been overwritten since
+	if cvo == nil || cvo.Lint == nil || (cvo.Lint.Digest != "" && cvo.Lint.Digest != chartVersion.Digest) {
+		return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("no lint report found for %s-%s", chartVersion.Name, chartVersion.Version)}
+	}
+	return cvo.Lint, nil
+}
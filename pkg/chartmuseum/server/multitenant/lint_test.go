@@ -0,0 +1,133 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+type LintTestSuite struct {
+	suite.Suite
+	TempDirectory string
+}
+
+func (suite *LintTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "lint")
+	suite.Nil(err, "no error creating temp dir")
+	suite.TempDirectory = dir
+}
+
+func (suite *LintTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+// saveBrokenChart packages a chart whose template does not parse, which loader.LoadArchive still accepts
+func saveBrokenChart(dir string) (string, error) {
+	broken := &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "broken", Version: "0.1.0"},
+		Templates: []*chart.File{
+			{Name: "templates/configmap.yaml", Data: []byte("kind: ConfigMap\nname: {{ .Values.name\n")},
+		},
+	}
+	return chartutil.Save(broken, dir)
+}
+
+func (suite *LintTestSuite) spoolChartPackage(filename string) *spooledChartPackage {
+	f, err := os.Open(filename)
+	suite.Nil(err, "no error opening chart package")
+	defer f.Close()
+	chartPackage, err := spoolChartPackage(f, time.Now())
+	suite.Nil(err, "no error spooling chart package")
+	return chartPackage
+}
+
+func (suite *LintTestSuite) TestLintChartPackage() {
+	chartPackage := suite.spoolChartPackage(testTarballPath)
+	defer chartPackage.remove()
+	report, err := lintChartPackage(chartPackage, LintPolicyWarn)
+	suite.Nil(err, "no error linting chart package")
+	suite.True(report.Passed, "valid chart passes lint")
+	suite.Equal("mychart", report.Name)
+	suite.Equal(chartPackage.digest, report.Digest)
+
+	filename, err := saveBrokenChart(suite.TempDirectory)
+	suite.Nil(err, "no error saving broken chart")
+	chartPackage = suite.spoolChartPackage(filename)
+	defer chartPackage.remove()
+	report, err = lintChartPackage(chartPackage, LintPolicyReject)
+	suite.Nil(err, "no error linting chart package")
+	suite.False(report.Passed, "broken chart fails lint")
+	suite.Contains(report.errors(), "templates/configmap.yaml", "error finding on the broken template")
+	for _, msg := range report.Messages {
+		suite.NotContains(msg.Path, suite.TempDirectory, "paths relative to the chart")
+	}
+}
+
+func (suite *LintTestSuite) TestValidateLintPolicy() {
+	for _, policy := range []string{LintPolicyOff, LintPolicyWarn, LintPolicyReject} {
+		suite.Nil(ValidateLintPolicy(policy), "valid lint policy %s", policy)
+	}
+	suite.NotNil(ValidateLintPolicy("strict"), "invalid lint policy")
+}
+
+func (suite *LintTestSuite) TestLintFailureResponse() {
+	filename, err := saveBrokenChart(suite.TempDirectory)
+	suite.Nil(err, "no error saving broken chart")
+	chartPackage := suite.spoolChartPackage(filename)
+	defer chartPackage.remove()
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{})
+	suite.Nil(err, "no error creating logger")
+	server := &MultiTenantServer{Logger: logger, LintPolicy: LintPolicyReject}
+	lint, httpErr := server.lintUploadedChartPackage(logger.ContextLoggingFn(&gin.Context{}), "org1", chartPackage)
+	suite.NotNil(httpErr, "broken chart rejected")
+	suite.Equal(400, httpErr.Status)
+
+	// the body of the 400 response of the upload
+	report := &uploadReport{lint: []*lintReport{lint}}
+	content, err := json.Marshal(report.response(gin.H{"error": httpErr.Message}))
+	suite.Nil(err, "no error encoding response")
+	var response struct {
+		Error      string             `json:"error"`
+		Lint       []*lintMessage     `json:"lint"`
+		Violations []*PolicyViolation `json:"violations"`
+	}
+	suite.Nil(json.Unmarshal(content, &response), "no error decoding response")
+	suite.Contains(response.Error, "broken-0.1.0.tgz failed lint")
+	suite.NotEmpty(response.Lint, "lint findings in response")
+	found := false
+	for _, msg := range response.Lint {
+		found = found || (msg.Severity == "error" && strings.Contains(msg.Message, "templates/configmap.yaml"))
+	}
+	suite.True(found, "error finding on the broken template in response")
+	suite.Empty(response.Violations, "no policy violations in response")
+}
+
+func TestLintTestSuite(t *testing.T) {
+	suite.Run(t, new(LintTestSuite))
+}
@@ -0,0 +1,880 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	pathutil "path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// media types of the manifests and blobs of Helm charts stored as OCI artifacts
+	ociManifestMediaType         = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType           = "application/vnd.cncf.helm.config.v1+json"
+	ociChartLayerMediaType       = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	ociLegacyChartLayerMediaType = "application/tar+gzip" // pushed by Helm before 3.7
+	ociProvLayerMediaType        = "application/vnd.cncf.helm.chart.provenance.v1.prov"
+
+	// ociPrefix is the prefix, below each tenant, where the OCI manifests and blobs of its charts are stored.
+	// As a nested prefix it is left out when listing the objects of the tenant.
+	ociPrefix = ".oci"
+	// ociUploadsPrefix is where the content received by blob upload sessions is stored until they are completed
+	ociUploadsPrefix = ociPrefix + "/uploads"
+	// ociBlobsPrefix is where blobs are stored, by digest, such as the configs of the charts
+	ociBlobsPrefix = ociPrefix + "/blobs"
+)
+
+var (
+	ociDigestPattern    = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	ociUploadIDPattern  = regexp.MustCompile(`^[a-f0-9]+$`)
+	ociBlobHexPattern   = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	ociAPIVersionHeader = "registry/2.0"
+)
+
+type (
+	// OCIRoute is a route of the OCI distribution API, whose path is matched with a regular expression
+	// capturing the name of the OCI repository (the tenant and the chart name) and the other params
+	OCIRoute struct {
+		Method  string
+		Path    *regexp.Regexp
+		Params  []string
+		Handler gin.HandlerFunc
+		Action  string
+	}
+
+	ociDescriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+	}
+
+	ociManifest struct {
+		SchemaVersion int              `json:"schemaVersion"`
+		MediaType     string           `json:"mediaType,omitempty"`
+		Config        *ociDescriptor   `json:"config"`
+		Layers        []*ociDescriptor `json:"layers"`
+	}
+
+	// ociUploadChunk is a chunk received by a blob upload session, the bytes from start to end (excluded) of the blob
+	ociUploadChunk struct {
+		path  string
+		start int64
+		end   int64
+	}
+)
+
+func ociDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func newOCIDescriptor(mediaType string, content []byte) *ociDescriptor {
+	return &ociDescriptor{MediaType: mediaType, Digest: ociDigest(content), Size: int64(len(content))}
+}
+
+// layers returns the chart package and provenance file layers of a manifest, nil if it has none
+func (manifest *ociManifest) layers() (*ociDescriptor, *ociDescriptor) {
+	var chartLayer, provLayer *ociDescriptor
+	for _, layer := range manifest.Layers {
+		switch layer.MediaType {
+		case ociChartLayerMediaType, ociLegacyChartLayerMediaType:
+			chartLayer = layer
+		case ociProvLayerMediaType:
+			provLayer = layer
+		}
+	}
+	return chartLayer, provLayer
+}
+
+// isCurrent tells whether the layers of a manifest are a chart package with the given digest, and its provenance file
+func (manifest *ociManifest) isCurrent(packageDigest string, prov []byte) bool {
+	chartLayer, provLayer := manifest.layers()
+	if chartLayer == nil || chartLayer.Digest != "sha256:"+packageDigest {
+		return false
+	}
+	if provLayer == nil {
+		return prov == nil
+	}
+	return prov != nil && provLayer.Digest == ociDigest(prov)
+}
+
+// OCI tags cannot contain "+", which Helm replaces with "_" in the tags of chart versions with build metadata
+func ociTagFromVersion(version string) string {
+	return strings.ReplaceAll(version, "+", "_")
+}
+
+func versionFromOCITag(tag string) string {
+	return strings.ReplaceAll(tag, "_", "+")
+}
+
+// ociBlobFilename returns where a blob is stored relative to its tenant, which is how its size is accounted for
+func ociBlobFilename(digest string) string {
+	return pathutil.Join(ociBlobsPrefix, strings.Replace(digest, ":", "/", 1))
+}
+
+func ociBlobPath(repo string, digest string) string {
+	return pathutil.Join(repo, ociBlobFilename(digest))
+}
+
+func isOCIBlobFilename(filename string) bool {
+	return ociBlobHexPattern.MatchString(filename)
+}
+
+func ociManifestPath(repo string, name string, version string) string {
+	return pathutil.Join(repo, ociPrefix, "manifests", fmt.Sprintf("%s-%s.json", name, version))
+}
+
+/*
+ociUploadChunkPath returns where a chunk of a blob upload session is stored, named after the session and its range.
+Chunks are stored directly below the uploads prefix, which is listed to find the chunks of a session and to sweep them.
+*/
+func ociUploadChunkPath(repo string, id string, start int64, end int64) string {
+	return pathutil.Join(repo, ociUploadsPrefix, fmt.Sprintf("%s-%020d-%020d", id, start, end))
+}
+
+// ociError responds with an error of the OCI distribution API, such as MANIFEST_UNKNOWN
+func ociError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{"errors": []gin.H{{"code": code, "message": message}}})
+}
+
+// ociHTTPError responds with an error of the server as an error of the OCI distribution API, with code unless its status has its own
+func ociHTTPError(c *gin.Context, httpErr *HTTPError, code string) {
+	switch {
+	case httpErr.Status == http.StatusUnauthorized:
+		code = "UNAUTHORIZED"
+	case httpErr.Status == http.StatusForbidden || httpErr.Status == http.StatusConflict || httpErr.Status == http.StatusInsufficientStorage:
+		code = "DENIED"
+	case httpErr.Status == http.StatusRequestEntityTooLarge:
+		code = "SIZE_INVALID"
+	case httpErr.Status >= 500:
+		code = "UNKNOWN"
+	}
+	ociError(c, httpErr.Status, code, httpErr.Message)
+}
+
+/*
+ociMiddleware serves the OCI distribution API below /v2/, with which Helm pushes and pulls charts as OCI artifacts,
+any other request being passed on to the router. The routes of the router only match a prefix before the repo for
+the API, so the OCI routes are matched here, the name of each OCI repository being a tenant followed by a chart name.
+*/
+func (server *MultiTenantServer) ociMiddleware(c *gin.Context) {
+	path := c.Request.URL.Path
+	if contextPath := server.Router.ContextPath; contextPath != "" {
+		if !strings.HasPrefix(path, contextPath+"/") {
+			return
+		}
+		path = strings.TrimPrefix(path, contextPath)
+	}
+	if !strings.HasPrefix(path, "/v2/") {
+		return
+	}
+
+	var route *OCIRoute
+	var values []string
+	pathMatched := false
+	for _, r := range server.ociRoutes {
+		submatches := r.Path.FindStringSubmatch(path)
+		if submatches == nil {
+			continue
+		}
+		pathMatched = true
+		if r.Method == c.Request.Method {
+			route, values = r, submatches[1:]
+			break
+		}
+	}
+	if route == nil {
+		if pathMatched {
+			c.Abort()
+			c.Header("Docker-Distribution-API-Version", ociAPIVersionHeader)
+			ociError(c, http.StatusMethodNotAllowed, "UNSUPPORTED", fmt.Sprintf("%s is not supported", c.Request.Method))
+		}
+		// not an OCI request, e.g. a chart package of a tenant named v2
+		return
+	}
+	c.Abort()
+	c.Header("Docker-Distribution-API-Version", ociAPIVersionHeader)
+
+	var repo string
+	c.Params = nil
+	for i, param := range route.Params {
+		if param != "name" {
+			c.Params = append(c.Params, gin.Param{Key: param, Value: values[i]})
+			continue
+		}
+		name := values[i]
+		if slash := strings.LastIndex(name, "/"); slash >= 0 {
+			repo, name = name[:slash], name[slash+1:]
+		}
+		if err := server.validateRepo(repo); err != nil {
+			ociError(c, http.StatusNotFound, "NAME_UNKNOWN", err.Error())
+			return
+		}
+		c.Params = append(c.Params, gin.Param{Key: "repo", Value: repo}, gin.Param{Key: "name", Value: name})
+	}
+
+	permissions, err := server.isRepoAuthorized(c, route.Action, repo)
+	if err != nil {
+		server.Logger.Error(err)
+		ociError(c, http.StatusInternalServerError, "UNKNOWN", "internal server error")
+		return
+	}
+	if !permissions.Allowed {
+		if permissions.WWWAuthenticateHeader != "" {
+			c.Header("WWW-Authenticate", permissions.WWWAuthenticateHeader)
+		}
+		ociError(c, http.StatusUnauthorized, "UNAUTHORIZED", "unauthorized")
+		return
+	}
+	route.Handler(c)
+}
+
+// ociLocation returns the path of a resource of the OCI repository of a request, as set in Location headers
+func (server *MultiTenantServer) ociLocation(c *gin.Context, resource string) string {
+	return fmt.Sprintf("%s/v2/%s/%s", server.Router.ContextPath, pathutil.Join(c.Param("repo"), c.Param("name")), resource)
+}
+
+/*
+getOCIManifest returns the manifest of a chart version, as long as its layers are still the chart package and
+provenance file in storage. Pulls only read manifests, which are stored as chart versions are added.
+*/
+func (server *MultiTenantServer) getOCIManifest(log cm_logger.LoggingFn, repo string, chartVersion *helm_repo.ChartVersion) ([]byte, *HTTPError) {
+	name, version := chartVersion.Name, chartVersion.Version
+	var prov []byte
+	if object, err := server.StorageBackend.GetObject(pathutil.Join(repo, cm_repo.ProvenanceFilenameFromNameVersion(name, version))); err == nil {
+		prov = object.Content
+	}
+	if object, err := server.StorageBackend.GetObject(ociManifestPath(repo, name, version)); err == nil {
+		manifest := &ociManifest{}
+		if json.Unmarshal(object.Content, manifest) == nil && manifest.isCurrent(chartVersion.Digest, prov) {
+			return object.Content, nil
+		}
+	}
+	return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("no manifest found for %s:%s", name, ociTagFromVersion(version))}
+}
+
+/*
+storeOCIManifest makes the manifest of an added chart version from its chart package and provenance file in storage
+(e.g. for a chart uploaded with the API), and stores it along with its config and provenance blobs so it can be pulled.
+The manifest pushed with the chart version is kept as long as it is current.
+*/
+func (server *MultiTenantServer) storeOCIManifest(log cm_logger.LoggingFn, repo string, chartVersion *helm_repo.ChartVersion) error {
+	if _, httpErr := server.getOCIManifest(log, repo, chartVersion); httpErr == nil {
+		return nil
+	}
+	name, version := chartVersion.Name, chartVersion.Version
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(name, version)
+	object, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename))
+	if err != nil {
+		return err
+	}
+	c, err := loader.LoadArchive(bytes.NewReader(object.Content))
+	if err != nil {
+		return err
+	}
+	// the config of a chart is its Chart.yaml, as pushed by helm
+	config, err := json.Marshal(c.Metadata)
+	if err != nil {
+		return err
+	}
+	manifest := &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        newOCIDescriptor(ociConfigMediaType, config),
+		Layers:        []*ociDescriptor{newOCIDescriptor(ociChartLayerMediaType, object.Content)},
+	}
+	blobs := [][]byte{config}
+	if prov, err := server.StorageBackend.GetObject(pathutil.Join(repo, cm_repo.ProvenanceFilenameFromNameVersion(name, version))); err == nil {
+		manifest.Layers = append(manifest.Layers, newOCIDescriptor(ociProvLayerMediaType, prov.Content))
+		blobs = append(blobs, prov.Content)
+	}
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		blobFilename := ociBlobFilename(ociDigest(blob))
+		if err := server.StorageBackend.PutObject(pathutil.Join(repo, blobFilename), blob); err != nil {
+			return err
+		}
+		server.recordStorageObject(repo, blobFilename, int64(len(blob)))
+	}
+	if err := server.StorageBackend.PutObject(ociManifestPath(repo, name, version), content); err != nil {
+		return err
+	}
+	log(cm_logger.DebugLevel, "OCI manifest made from chart package",
+		"repo", repo,
+		"package", filename,
+	)
+	return nil
+}
+
+/*
+resolveOCIManifest returns a chart version and its manifest from a manifest reference, either a tag (the chart version)
+or a digest. A manifest is only known by digest once it is pushed or made, so the manifest of every chart version may be
+read when resolving a digest.
+*/
+func (server *MultiTenantServer) resolveOCIManifest(log cm_logger.LoggingFn, repo string, name string, reference string) (*helm_repo.ChartVersion, []byte, *HTTPError) {
+	chartVersions, httpErr := server.getChart(log, repo, name)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+	isDigest := ociDigestPattern.MatchString(reference)
+	version := versionFromOCITag(reference)
+	for _, chartVersion := range chartVersions {
+		if !isDigest && chartVersion.Version != version {
+			continue
+		}
+		content, httpErr := server.getOCIManifest(log, repo, chartVersion)
+		if httpErr != nil {
+			return nil, nil, httpErr
+		}
+		if !isDigest || ociDigest(content) == reference {
+			return chartVersion, content, nil
+		}
+	}
+	return nil, nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("no manifest found for %s:%s", name, reference)}
+}
+
+// getOCIBlob returns a blob of a chart, either stored below the OCI prefix of the tenant or one of the chart packages
+func (server *MultiTenantServer) getOCIBlob(log cm_logger.LoggingFn, repo string, name string, digest string) ([]byte, *HTTPError) {
+	if object, err := server.StorageBackend.GetObject(ociBlobPath(repo, digest)); err == nil {
+		return object.Content, nil
+	}
+	if chartVersions, httpErr := server.getChart(log, repo, name); httpErr == nil {
+		for _, chartVersion := range chartVersions {
+			if "sha256:"+chartVersion.Digest != digest {
+				continue
+			}
+			filename := cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)
+			if object, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename)); err == nil {
+				return object.Content, nil
+			}
+		}
+	}
+	return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("blob %s not found", digest)}
+}
+
+// isStoredWithDigest tells whether a file of a tenant is stored with the given content digest
+func (server *MultiTenantServer) isStoredWithDigest(repo string, filename string, digest string) bool {
+	object, err := server.StorageBackend.GetObject(pathutil.Join(repo, filename))
+	return err == nil && ociDigest(object.Content) == digest
+}
+
+// removeOCIManifest deletes the OCI manifest of a deleted chart version, along with its config and provenance blobs
+func (server *MultiTenantServer) removeOCIManifest(repo string, name string, version string) {
+	manifestPath := ociManifestPath(repo, name, version)
+	object, err := server.StorageBackend.GetObject(manifestPath)
+	if err != nil {
+		return
+	}
+	manifest := &ociManifest{}
+	if json.Unmarshal(object.Content, manifest) == nil && manifest.Config != nil {
+		for _, descriptor := range append(manifest.Layers, manifest.Config) {
+			if ociDigestPattern.MatchString(descriptor.Digest) && server.StorageBackend.DeleteObject(ociBlobPath(repo, descriptor.Digest)) == nil {
+				server.forgetStorageObject(repo, ociBlobFilename(descriptor.Digest))
+			}
+		}
+	}
+	server.StorageBackend.DeleteObject(manifestPath)
+}
+
+/*
+sweepOrphanedOCIBlobs deletes the expired blobs of a tenant which no manifest references, such as the blobs of pushes
+which were abandoned or rejected.
+*/
+func (server *MultiTenantServer) sweepOrphanedOCIBlobs(log cm_logger.LoggingFn, repo string) {
+	manifestsPrefix := pathutil.Join(repo, ociPrefix, "manifests")
+	objects, err := server.StorageBackend.ListObjects(manifestsPrefix)
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error listing OCI manifests",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return
+	}
+	referenced := map[string]bool{}
+	for _, object := range objects {
+		object, err := server.StorageBackend.GetObject(pathutil.Join(manifestsPrefix, object.Path))
+		if err != nil {
+			return // the blobs of the manifest cannot be told apart
+		}
+		manifest := &ociManifest{}
+		if json.Unmarshal(object.Content, manifest) == nil && manifest.Config != nil {
+			for _, descriptor := range append(manifest.Layers, manifest.Config) {
+				referenced[descriptor.Digest] = true
+			}
+		}
+	}
+	swept := server.sweepExpiredObjects(log, repo, pathutil.Join(repo, ociBlobsPrefix, "sha256"), func(path string) bool {
+		return referenced["sha256:"+path]
+	})
+	for _, path := range swept {
+		server.forgetStorageObject(repo, pathutil.Join(ociBlobsPrefix, "sha256", path))
+	}
+}
+
+func (server *MultiTenantServer) getOCIBaseRequestHandler(c *gin.Context) {
+	c.JSON(200, gin.H{})
+}
+
+func (server *MultiTenantServer) getOCITagsRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	log := server.Logger.ContextLoggingFn(c)
+	chartVersions, httpErr := server.getChart(log, repo, name)
+	if httpErr != nil {
+		ociHTTPError(c, httpErr, "NAME_UNKNOWN")
+		return
+	}
+	tags := []string{}
+	for _, chartVersion := range chartVersions {
+		tags = append(tags, ociTagFromVersion(chartVersion.Version))
+	}
+	sort.Strings(tags)
+	// paginated with the last tag of the previous page, and the number of tags to return
+	if last := c.Query("last"); last != "" {
+		i := sort.SearchStrings(tags, last)
+		if i < len(tags) && tags[i] == last {
+			i++
+		}
+		tags = tags[i:]
+	}
+	if n, err := strconv.Atoi(c.Query("n")); err == nil && n >= 0 && n < len(tags) {
+		tags = tags[:n]
+	}
+	c.JSON(200, gin.H{"name": pathutil.Join(repo, name), "tags": tags})
+}
+
+func (server *MultiTenantServer) getOCIManifestRequestHandler(c *gin.Context) {
+	log := server.Logger.ContextLoggingFn(c)
+	_, content, httpErr := server.resolveOCIManifest(log, c.Param("repo"), c.Param("name"), c.Param("reference"))
+	if httpErr != nil {
+		ociHTTPError(c, httpErr, "MANIFEST_UNKNOWN")
+		return
+	}
+	c.Header("Docker-Content-Digest", ociDigest(content))
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", ociManifestMediaType)
+		c.Header("Content-Length", strconv.Itoa(len(content)))
+		c.Status(200)
+		return
+	}
+	c.Data(200, ociManifestMediaType, content)
+}
+
+func (server *MultiTenantServer) putOCIManifestRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	tag := c.Param("reference")
+	log := server.Logger.ContextLoggingFn(c)
+	if ociDigestPattern.MatchString(tag) {
+		ociError(c, 400, "TAG_INVALID", "charts are pushed with their version as tag")
+		return
+	}
+	settings := server.getTenantSettings(log, repo)
+	server.limitUploadSize(c, settings)
+	content, err := c.GetRawData()
+	if err != nil {
+		if len(c.Errors) > 0 {
+			return // this is a "request too large"
+		}
+		if httpErr := uploadTooLargeError(settings, err); httpErr != nil {
+			ociHTTPError(c, httpErr, "MANIFEST_INVALID")
+			return
+		}
+		ociError(c, 500, "UNKNOWN", err.Error())
+		return
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		ociError(c, 400, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	chartLayer, provLayer := manifest.layers()
+	if manifest.Config == nil || manifest.Config.MediaType != ociConfigMediaType || chartLayer == nil {
+		ociError(c, 400, "MANIFEST_INVALID", "manifest is not a Helm chart")
+		return
+	}
+	for _, descriptor := range append(manifest.Layers, manifest.Config) {
+		if !ociDigestPattern.MatchString(descriptor.Digest) {
+			ociError(c, 400, "DIGEST_INVALID", fmt.Sprintf("invalid digest %s", descriptor.Digest))
+			return
+		}
+	}
+	if _, httpErr := server.getOCIBlob(log, repo, name, manifest.Config.Digest); httpErr != nil {
+		ociError(c, 400, "MANIFEST_BLOB_UNKNOWN", httpErr.Message)
+		return
+	}
+	chartContent, httpErr := server.getOCIBlob(log, repo, name, chartLayer.Digest)
+	if httpErr != nil {
+		ociError(c, 400, "MANIFEST_BLOB_UNKNOWN", httpErr.Message)
+		return
+	}
+	chartPackage, err := spoolChartPackage(bytes.NewReader(chartContent), time.Now())
+	if err != nil {
+		ociError(c, 400, "MANIFEST_INVALID", err.Error())
+		return
+	}
+	defer chartPackage.remove()
+	version := versionFromOCITag(tag)
+	if chartPackage.chartVersion.Name != name || chartPackage.chartVersion.Version != version {
+		ociError(c, 400, "MANIFEST_INVALID", fmt.Sprintf("chart layer is %s, not %s:%s", chartPackage.filename, name, tag))
+		return
+	}
+
+	// only the files which are not stored yet are uploaded, pushing the same chart version again is a no-op
+	cpFiles := map[string]*chartOrProvenanceFile{}
+	if !server.isStoredWithDigest(repo, chartPackage.filename, chartLayer.Digest) {
+		cpFiles[chartPackage.filename] = &chartOrProvenanceFile{filename: chartPackage.filename, field: defaultFormField, chart: chartPackage}
+	}
+	if provLayer != nil {
+		prov, httpErr := server.getOCIBlob(log, repo, name, provLayer.Digest)
+		if httpErr != nil {
+			ociError(c, 400, "MANIFEST_BLOB_UNKNOWN", httpErr.Message)
+			return
+		}
+		provFilename := cm_repo.ProvenanceFilenameFromNameVersion(name, version)
+		if !server.isStoredWithDigest(repo, provFilename, provLayer.Digest) {
+			cpFiles[provFilename] = &chartOrProvenanceFile{filename: provFilename, content: prov, field: defaultProvField}
+		}
+	}
+	for _, cpFile := range cpFiles {
+		if status, err := server.validateChartOrProv(log, repo, cpFile, false); err != nil {
+			ociHTTPError(c, &HTTPError{status, err.Error()}, "MANIFEST_INVALID")
+			return
+		}
+	}
+	var chartVersion *helm_repo.ChartVersion
+	if len(cpFiles) > 0 {
+		chartVersion, _, httpErr = server.uploadChartOrProvenanceFiles(c, repo, cpFiles, false)
+		if httpErr != nil {
+			ociHTTPError(c, httpErr, "MANIFEST_INVALID")
+			return
+		}
+	}
+	if err := server.StorageBackend.PutObject(ociManifestPath(repo, name, version), content); err != nil {
+		ociError(c, 500, "UNKNOWN", err.Error())
+		return
+	}
+	// once stored, the chart layer is served from the chart package, a rejected push keeps it to be retried
+	if server.StorageBackend.DeleteObject(ociBlobPath(repo, chartLayer.Digest)) == nil {
+		server.forgetStorageObject(repo, ociBlobFilename(chartLayer.Digest))
+	}
+	if chartVersion != nil {
+		server.emitEvent(c, repo, addChart, chartVersion)
+	}
+
+	digest := ociDigest(content)
+	c.Header("Location", server.ociLocation(c, "manifests/"+digest))
+	c.Header("Docker-Content-Digest", digest)
+	c.Status(201)
+}
+
+func (server *MultiTenantServer) deleteOCIManifestRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	name := c.Param("name")
+	log := server.Logger.ContextLoggingFn(c)
+	if server.getTenantSettings(log, repo).disableDelete {
+		ociError(c, 405, "UNSUPPORTED", "deletes are disabled")
+		return
+	}
+	chartVersion, _, httpErr := server.resolveOCIManifest(log, repo, name, c.Param("reference"))
+	if httpErr != nil {
+		ociHTTPError(c, httpErr, "MANIFEST_UNKNOWN")
+		return
+	}
+	version := chartVersion.Version
+	record := &AuditRecord{Action: AuditActionDelete, Repo: repo, Name: name, Version: version, Digest: chartVersion.Digest}
+	if httpErr := server.deleteChartVersion(log, repo, name, version); httpErr != nil {
+		ociHTTPError(c, httpErr, "MANIFEST_UNKNOWN")
+		return
+	}
+	server.auditRequest(c, record)
+
+	server.emitEvent(c, repo, deleteChart, &helm_repo.ChartVersion{
+		Metadata: &chart.Metadata{
+			Name:    name,
+			Version: version,
+		},
+	})
+	c.Status(202)
+}
+
+func (server *MultiTenantServer) getOCIBlobRequestHandler(c *gin.Context) {
+	digest := c.Param("digest")
+	if !ociDigestPattern.MatchString(digest) {
+		ociError(c, 400, "DIGEST_INVALID", fmt.Sprintf("invalid digest %s", digest))
+		return
+	}
+	content, httpErr := server.getOCIBlob(server.Logger.ContextLoggingFn(c), c.Param("repo"), c.Param("name"), digest)
+	if httpErr != nil {
+		ociHTTPError(c, httpErr, "BLOB_UNKNOWN")
+		return
+	}
+	c.Header("Docker-Content-Digest", digest)
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Length", strconv.Itoa(len(content)))
+		c.Status(200)
+		return
+	}
+	c.Data(200, "application/octet-stream", content)
+}
+
+/*
+putOCIBlob stores an uploaded blob of a tenant, once its content is checked against its digest. Blobs are charged to
+the storage quota of the tenant like chart packages, a blob already stored being left as is.
+*/
+func (server *MultiTenantServer) putOCIBlob(c *gin.Context, digest string, content []byte) {
+	repo := c.Param("repo")
+	if !ociDigestPattern.MatchString(digest) || ociDigest(content) != digest {
+		ociError(c, 400, "DIGEST_INVALID", fmt.Sprintf("content does not match digest %s", digest))
+		return
+	}
+	filename := ociBlobFilename(digest)
+	if !server.isStoredWithDigest(repo, filename, digest) {
+		blob := &chartOrProvenanceFile{filename: filename, content: content}
+		if httpErr := server.checkStorageLimit(server.Logger.ContextLoggingFn(c), repo, []*chartOrProvenanceFile{blob}, false); httpErr != nil {
+			ociHTTPError(c, httpErr, "DENIED")
+			return
+		}
+		if err := server.StorageBackend.PutObject(pathutil.Join(repo, filename), content); err != nil {
+			ociError(c, 500, "UNKNOWN", err.Error())
+			return
+		}
+		server.recordStorageObject(repo, filename, int64(len(content)))
+	}
+	c.Header("Location", server.ociLocation(c, "blobs/"+digest))
+	c.Header("Docker-Content-Digest", digest)
+	c.Status(201)
+}
+
+// ociUploadStatus responds with the progress of a blob upload session, which has received size bytes
+func (server *MultiTenantServer) ociUploadStatus(c *gin.Context, status int, id string, size int64) {
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	c.Header("Location", server.ociLocation(c, "blobs/uploads/"+id))
+	c.Header("Docker-Upload-UUID", id)
+	c.Header("Range", fmt.Sprintf("0-%d", end))
+	c.Status(status)
+}
+
+/*
+getOCIUploadChunks returns the chunks received so far by the blob upload session of a request, in order. Each chunk
+is stored as its own object, so that an upload is only read whole once completed.
+*/
+func (server *MultiTenantServer) getOCIUploadChunks(c *gin.Context) ([]*ociUploadChunk, bool) {
+	id := c.Param("uuid")
+	if ociUploadIDPattern.MatchString(id) {
+		prefix := pathutil.Join(c.Param("repo"), ociUploadsPrefix)
+		objects, err := server.StorageBackend.ListObjects(prefix)
+		if err != nil {
+			ociError(c, 500, "UNKNOWN", err.Error())
+			return nil, false
+		}
+		var chunks []*ociUploadChunk
+		for _, object := range objects {
+			if !strings.HasPrefix(object.Path, id+"-") {
+				continue
+			}
+			chunk := &ociUploadChunk{path: pathutil.Join(prefix, object.Path)}
+			if _, err := fmt.Sscanf(strings.TrimPrefix(object.Path, id+"-"), "%d-%d", &chunk.start, &chunk.end); err == nil {
+				chunks = append(chunks, chunk)
+			}
+		}
+		if len(chunks) > 0 {
+			sort.Slice(chunks, func(i, j int) bool {
+				return chunks[i].start < chunks[j].start
+			})
+			return chunks, true
+		}
+	}
+	ociError(c, 404, "BLOB_UPLOAD_UNKNOWN", fmt.Sprintf("upload %s not found", id))
+	return nil, false
+}
+
+// ociUploadSize returns the number of bytes received by a blob upload session
+func ociUploadSize(chunks []*ociUploadChunk) int64 {
+	if len(chunks) == 0 {
+		return 0
+	}
+	return chunks[len(chunks)-1].end
+}
+
+// readOCIUpload assembles the chunks of a completed blob upload session
+func (server *MultiTenantServer) readOCIUpload(chunks []*ociUploadChunk) ([]byte, error) {
+	content := make([]byte, 0, ociUploadSize(chunks))
+	for _, chunk := range chunks {
+		if chunk.start != int64(len(content)) {
+			return nil, fmt.Errorf("missing chunk at %d", len(content))
+		}
+		object, err := server.StorageBackend.GetObject(chunk.path)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, object.Content...)
+		if int64(len(content)) != chunk.end {
+			return nil, fmt.Errorf("chunk %d-%d has %d bytes", chunk.start, chunk.end, len(object.Content))
+		}
+	}
+	return content, nil
+}
+
+// removeOCIUpload deletes the chunks of a blob upload session, which no longer exists without them
+func (server *MultiTenantServer) removeOCIUpload(chunks []*ociUploadChunk) {
+	for _, chunk := range chunks {
+		server.StorageBackend.DeleteObject(chunk.path)
+	}
+}
+
+// readOCIUploadChunk reads a chunk of a blob upload, responding with an error if the blob gets larger than the tenant allows
+func (server *MultiTenantServer) readOCIUploadChunk(c *gin.Context, settings *tenantSettings, size int64) ([]byte, bool) {
+	server.limitUploadSize(c, settings)
+	chunk, err := c.GetRawData()
+	if err != nil {
+		if len(c.Errors) > 0 {
+			return nil, false // this is a "request too large"
+		}
+		if httpErr := uploadTooLargeError(settings, err); httpErr != nil {
+			ociHTTPError(c, httpErr, "SIZE_INVALID")
+			return nil, false
+		}
+		ociError(c, 500, "UNKNOWN", err.Error())
+		return nil, false
+	}
+	if settings.maxUploadSize > 0 && size+int64(len(chunk)) > settings.maxUploadSize {
+		ociError(c, 413, "SIZE_INVALID", fmt.Sprintf("blob exceeds the max upload size of %s", formatByteSize(settings.maxUploadSize)))
+		return nil, false
+	}
+	return chunk, true
+}
+
+func (server *MultiTenantServer) postOCIUploadRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	settings := server.getTenantSettings(server.Logger.ContextLoggingFn(c), repo)
+	if digest, ok := c.GetQuery("digest"); ok {
+		// monolithic upload, the blob being the body of the request
+		content, ok := server.readOCIUploadChunk(c, settings, 0)
+		if ok {
+			server.putOCIBlob(c, digest, content)
+		}
+		return
+	}
+	// cross-repository mounts are not supported, a session is started instead as the spec allows
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+	// the session starts with an empty chunk, so that it exists before receiving any content
+	if err := server.StorageBackend.PutObject(ociUploadChunkPath(repo, uploadID, 0, 0), []byte{}); err != nil {
+		ociError(c, 500, "UNKNOWN", err.Error())
+		return
+	}
+	server.ociUploadStatus(c, 202, uploadID, 0)
+}
+
+func (server *MultiTenantServer) getOCIUploadRequestHandler(c *gin.Context) {
+	chunks, ok := server.getOCIUploadChunks(c)
+	if !ok {
+		return
+	}
+	server.ociUploadStatus(c, 204, c.Param("uuid"), ociUploadSize(chunks))
+}
+
+func (server *MultiTenantServer) patchOCIUploadRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	id := c.Param("uuid")
+	chunks, ok := server.getOCIUploadChunks(c)
+	if !ok {
+		return
+	}
+	size := ociUploadSize(chunks)
+	// chunks must be uploaded in order
+	if contentRange := c.GetHeader("Content-Range"); contentRange != "" {
+		var start, end int64
+		if _, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end); err != nil || start != size {
+			ociError(c, 416, "BLOB_UPLOAD_INVALID", fmt.Sprintf("chunk must start at %d", size))
+			return
+		}
+	}
+	chunk, ok := server.readOCIUploadChunk(c, server.getTenantSettings(server.Logger.ContextLoggingFn(c), repo), size)
+	if !ok {
+		server.removeOCIUpload(chunks)
+		return
+	}
+	if len(chunk) > 0 {
+		end := size + int64(len(chunk))
+		if err := server.StorageBackend.PutObject(ociUploadChunkPath(repo, id, size, end), chunk); err != nil {
+			ociError(c, 500, "UNKNOWN", err.Error())
+			return
+		}
+		size = end
+	}
+	server.ociUploadStatus(c, 202, id, size)
+}
+
+func (server *MultiTenantServer) putOCIUploadRequestHandler(c *gin.Context) {
+	repo := c.Param("repo")
+	chunks, ok := server.getOCIUploadChunks(c)
+	if !ok {
+		return
+	}
+	// the last chunk may be sent when completing the upload
+	chunk, ok := server.readOCIUploadChunk(c, server.getTenantSettings(server.Logger.ContextLoggingFn(c), repo), ociUploadSize(chunks))
+	if !ok {
+		server.removeOCIUpload(chunks)
+		return
+	}
+	content, err := server.readOCIUpload(chunks)
+	server.removeOCIUpload(chunks)
+	if err != nil {
+		ociError(c, 400, "BLOB_UPLOAD_INVALID", err.Error())
+		return
+	}
+	server.putOCIBlob(c, c.Query("digest"), append(content, chunk...))
+}
+
+func (server *MultiTenantServer) deleteOCIUploadRequestHandler(c *gin.Context) {
+	chunks, ok := server.getOCIUploadChunks(c)
+	if !ok {
+		return
+	}
+	server.removeOCIUpload(chunks)
+	c.Status(204)
+}
@@ -0,0 +1,350 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	pathutil "path"
+	"strings"
+	"testing"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
+
+	"github.com/chartmuseum/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type OCITestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Server        *MultiTenantServer
+}
+
+func (suite *OCITestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "oci")
+	suite.Nil(err, "no error creating temp dir")
+	suite.TempDirectory = dir
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Depth:         1,
+		MaxUploadSize: maxUploadSize,
+		Username:      "user",
+		Password:      "pass",
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 logger,
+		Router:                 router,
+		StorageBackend:         storage.NewLocalFilesystemBackend(dir),
+		EnableAPI:              true,
+		ChartPostFormFieldName: "chart",
+		ProvPostFormFieldName:  "prov",
+		IndexLimit:             1,
+		EnableOCI:              true,
+	})
+	suite.Nil(err, "no error creating server")
+	suite.Server = server
+}
+
+func (suite *OCITestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *OCITestSuite) doRequest(method string, url string, body []byte, header ...string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	c.Request, _ = http.NewRequest(method, url, reader)
+	c.Request.SetBasicAuth("user", "pass")
+	for i := 0; i+1 < len(header); i += 2 {
+		c.Request.Header.Set(header[i], header[i+1])
+	}
+	suite.Server.Router.HandleContext(c)
+	return recorder
+}
+
+func (suite *OCITestSuite) errorCode(res *httptest.ResponseRecorder) string {
+	var response struct {
+		Errors []struct {
+			Code string `json:"code"`
+		} `json:"errors"`
+	}
+	suite.Nil(json.Unmarshal(res.Body.Bytes(), &response), "no error decoding OCI error")
+	suite.Len(response.Errors, 1)
+	return response.Errors[0].Code
+}
+
+// waitForIndex waits for the index of a tenant to list a chart package, the index being updated asynchronously
+func (suite *OCITestSuite) waitForIndex(repo string, filename string) {
+	suite.Eventually(func() bool {
+		return strings.Contains(suite.doRequest("GET", "/"+repo+"/index.yaml", nil).Body.String(), filename)
+	}, time.Second, 10*time.Millisecond, "%s indexed in %s", filename, repo)
+}
+
+func (suite *OCITestSuite) TestPushAndPull() {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest("GET", "/v2/", nil)
+	suite.Server.Router.HandleContext(c)
+	suite.Equal(401, recorder.Code, "401 GET /v2/ without credentials")
+	suite.NotEmpty(recorder.Header().Get("WWW-Authenticate"), "authentication challenge")
+	res := suite.doRequest("GET", "/v2/", nil)
+	suite.Equal(200, res.Code, "200 GET /v2/")
+	suite.Equal("registry/2.0", res.Header().Get("Docker-Distribution-API-Version"))
+
+	chartContent, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	config := []byte(`{"name":"mychart","version":"0.1.0","apiVersion":"v1"}`)
+
+	// the config blob in a single request
+	res = suite.doRequest("POST", "/v2/org/mychart/blobs/uploads/?digest="+ociDigest(config), config)
+	suite.Equal(201, res.Code, "201 POST /v2/org/mychart/blobs/uploads/?digest=")
+	suite.Equal(ociDigest(config), res.Header().Get("Docker-Content-Digest"))
+
+	// the chart layer in chunks
+	res = suite.doRequest("POST", "/v2/org/mychart/blobs/uploads/", nil)
+	suite.Equal(202, res.Code, "202 POST /v2/org/mychart/blobs/uploads/")
+	location := res.Header().Get("Location")
+	suite.Contains(location, "/v2/org/mychart/blobs/uploads/")
+	half := len(chartContent) / 2
+	res = suite.doRequest("PATCH", location, chartContent[:half], "Content-Range", fmt.Sprintf("0-%d", half-1))
+	suite.Equal(202, res.Code, "202 PATCH upload")
+	suite.Equal(fmt.Sprintf("0-%d", half-1), res.Header().Get("Range"))
+	res = suite.doRequest("PATCH", location, chartContent[half:], "Content-Range", "0-1")
+	suite.Equal(416, res.Code, "416 PATCH upload out of order")
+	res = suite.doRequest("GET", location, nil)
+	suite.Equal(204, res.Code, "204 GET upload")
+	uploadID := location[strings.LastIndex(location, "/")+1:]
+	chunk, err := suite.Server.StorageBackend.GetObject(ociUploadChunkPath("org", uploadID, 0, int64(half)))
+	suite.Nil(err, "no error getting the first chunk on its own")
+	suite.Equal(chartContent[:half], chunk.Content)
+	res = suite.doRequest("PUT", location+"?digest="+ociDigest(chartContent), chartContent[half:])
+	suite.Equal(201, res.Code, "201 PUT upload")
+	objects, err := suite.Server.StorageBackend.ListObjects("org/" + ociUploadsPrefix)
+	suite.Nil(err, "no error listing the uploads")
+	suite.Empty(objects, "upload chunks removed once assembled")
+	res = suite.doRequest("HEAD", "/v2/org/mychart/blobs/"+ociDigest(chartContent), nil)
+	suite.Equal(200, res.Code, "200 HEAD chart layer")
+	suite.Equal(fmt.Sprint(len(chartContent)), res.Header().Get("Content-Length"))
+
+	manifest, err := json.Marshal(&ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		Config:        newOCIDescriptor(ociConfigMediaType, config),
+		Layers:        []*ociDescriptor{newOCIDescriptor(ociChartLayerMediaType, chartContent)},
+	})
+	suite.Nil(err, "no error encoding manifest")
+	res = suite.doRequest("PUT", "/v2/org/mychart/manifests/0.2.0", manifest)
+	suite.Equal(400, res.Code, "400 PUT manifest tagged with another version")
+	suite.Equal("MANIFEST_INVALID", suite.errorCode(res))
+	res = suite.doRequest("PUT", "/v2/org/mychart/manifests/0.1.0", manifest)
+	suite.Equal(201, res.Code, "201 PUT manifest")
+	suite.Equal(ociDigest(manifest), res.Header().Get("Docker-Content-Digest"))
+
+	suite.waitForIndex("org", "mychart-0.1.0.tgz")
+
+	for _, reference := range []string{"0.1.0", ociDigest(manifest)} {
+		res = suite.doRequest("GET", "/v2/org/mychart/manifests/"+reference, nil)
+		suite.Equal(200, res.Code, "200 GET manifest %s", reference)
+		suite.Equal(manifest, res.Body.Bytes(), "pushed manifest returned")
+	}
+	res = suite.doRequest("GET", "/v2/org/mychart/blobs/"+ociDigest(chartContent), nil)
+	suite.Equal(200, res.Code, "200 GET chart layer")
+	suite.Equal(chartContent, res.Body.Bytes())
+	res = suite.doRequest("GET", "/v2/org/mychart/blobs/"+ociDigest(config), nil)
+	suite.Equal(200, res.Code, "200 GET config")
+	suite.Equal(config, res.Body.Bytes())
+
+	res = suite.doRequest("GET", "/v2/org/mychart/tags/list", nil)
+	suite.Equal(200, res.Code, "200 GET tags")
+	suite.JSONEq(`{"name":"org/mychart","tags":["0.1.0"]}`, res.Body.String())
+
+	res = suite.doRequest("DELETE", "/v2/org/mychart/manifests/0.1.0", nil)
+	suite.Equal(202, res.Code, "202 DELETE manifest")
+	_, err = suite.Server.StorageBackend.GetObject("org/mychart-0.1.0.tgz")
+	suite.NotNil(err, "chart package deleted")
+	_, err = suite.Server.StorageBackend.GetObject(ociManifestPath("org", "mychart", "0.1.0"))
+	suite.NotNil(err, "manifest deleted")
+}
+
+func (suite *OCITestSuite) TestPullUploadedChart() {
+	chartContent, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	provContent, err := ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	res := suite.doRequest("POST", "/api/classic/charts", chartContent)
+	suite.Equal(201, res.Code, "201 POST /api/classic/charts")
+	res = suite.doRequest("POST", "/api/classic/prov", provContent)
+	suite.Equal(201, res.Code, "201 POST /api/classic/prov")
+	suite.waitForIndex("classic", "mychart-0.1.0.tgz")
+	_, err = suite.Server.StorageBackend.GetObject(ociManifestPath("classic", "mychart", "0.1.0"))
+	suite.Nil(err, "manifest stored once the chart version is added")
+
+	// the manifest is made again with the provenance layer once the provenance file event is handled
+	suite.Eventually(func() bool {
+		res = suite.doRequest("HEAD", "/v2/classic/mychart/manifests/0.1.0", nil)
+		return res.Code == 200
+	}, time.Second, 10*time.Millisecond, "200 HEAD manifest")
+	digest := res.Header().Get("Docker-Content-Digest")
+	res = suite.doRequest("GET", "/v2/classic/mychart/manifests/0.1.0", nil)
+	suite.Equal(200, res.Code, "200 GET manifest")
+	suite.Equal(digest, ociDigest(res.Body.Bytes()), "same manifest for HEAD and GET")
+	manifest := &ociManifest{}
+	suite.Nil(json.Unmarshal(res.Body.Bytes(), manifest), "no error decoding manifest")
+	chartLayer, provLayer := manifest.layers()
+	suite.Equal(ociDigest(chartContent), chartLayer.Digest)
+	suite.Equal(ociDigest(provContent), provLayer.Digest)
+
+	res = suite.doRequest("GET", "/v2/classic/mychart/blobs/"+manifest.Config.Digest, nil)
+	suite.Equal(200, res.Code, "200 GET config")
+	suite.Contains(res.Body.String(), `"name":"mychart"`)
+	res = suite.doRequest("GET", "/v2/classic/mychart/blobs/"+chartLayer.Digest, nil)
+	suite.Equal(200, res.Code, "200 GET chart layer")
+	suite.Equal(chartContent, res.Body.Bytes())
+	res = suite.doRequest("GET", "/v2/classic/mychart/blobs/"+provLayer.Digest, nil)
+	suite.Equal(200, res.Code, "200 GET provenance layer")
+	suite.Equal(provContent, res.Body.Bytes())
+	res = suite.doRequest("GET", "/v2/classic/mychart/manifests/"+digest, nil)
+	suite.Equal(200, res.Code, "200 GET manifest by digest")
+
+	// pulls only read the stored manifest
+	suite.Nil(suite.Server.StorageBackend.DeleteObject(ociManifestPath("classic", "mychart", "0.1.0")), "no error deleting manifest")
+	res = suite.doRequest("GET", "/v2/classic/mychart/manifests/0.1.0", nil)
+	suite.Equal(404, res.Code, "404 GET manifest no longer stored")
+	_, err = suite.Server.StorageBackend.GetObject(ociManifestPath("classic", "mychart", "0.1.0"))
+	suite.NotNil(err, "manifest not stored by a pull")
+}
+
+func (suite *OCITestSuite) TestBlobStorage() {
+	quota := &StorageQuota{Repo: "quota", Quota: ByteSize("8")}
+	suite.Nil(quota.compile(), "no error compiling storage quota")
+	suite.Server.StorageQuotas = []*StorageQuota{quota}
+	log := suite.Server.Logger.ContextLoggingFn(&gin.Context{})
+
+	// blobs are charged to the storage quota of the tenant
+	res := suite.doRequest("POST", "/v2/quota/mychart/blobs/uploads/?digest="+ociDigest([]byte("too large")), []byte("too large"))
+	suite.Equal(507, res.Code, "507 POST blob over the storage quota")
+	suite.Equal("DENIED", suite.errorCode(res))
+	blob := []byte("blob")
+	for i := 0; i < 2; i++ {
+		res = suite.doRequest("POST", "/v2/quota/mychart/blobs/uploads/?digest="+ociDigest(blob), blob)
+		suite.Equal(201, res.Code, "201 POST blob within the storage quota")
+	}
+	usage, httpErr := suite.Server.getStorageUsage(log, "quota")
+	suite.Nil(httpErr, "no error getting storage usage")
+	suite.Equal(int64(len(blob)), usage.Bytes, "blob charged once")
+	suite.Equal(1, usage.Objects)
+
+	// blobs which no manifest references are swept once they expire
+	suite.Server.StorageQuotas = nil
+	chartContent, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res = suite.doRequest("POST", "/api/quota/charts", chartContent)
+	suite.Equal(201, res.Code, "201 POST /api/quota/charts")
+	suite.waitForIndex("quota", "mychart-0.1.0.tgz")
+	object, err := suite.Server.StorageBackend.GetObject(ociManifestPath("quota", "mychart", "0.1.0"))
+	suite.Nil(err, "manifest stored")
+	manifest := &ociManifest{}
+	suite.Nil(json.Unmarshal(object.Content, manifest), "no error decoding manifest")
+	old := time.Now().Add(-2 * time.Hour)
+	for _, digest := range []string{ociDigest(blob), manifest.Config.Digest} {
+		suite.Nil(os.Chtimes(pathutil.Join(suite.TempDirectory, ociBlobPath("quota", digest)), old, old), "no error aging blob")
+	}
+	suite.Server.StagingTimeout = time.Hour
+	suite.Server.sweepStagedUploadsOfRepo(log, "quota")
+	_, err = suite.Server.StorageBackend.GetObject(ociBlobPath("quota", ociDigest(blob)))
+	suite.NotNil(err, "orphaned blob swept")
+	_, err = suite.Server.StorageBackend.GetObject(ociBlobPath("quota", manifest.Config.Digest))
+	suite.Nil(err, "config blob of a manifest kept")
+	usage, httpErr = suite.Server.getStorageUsage(log, "quota")
+	suite.Nil(httpErr, "no error getting storage usage")
+	suite.Equal(2, usage.Objects, "swept blob no longer charged")
+
+	// so are the chunks of upload sessions which were never completed
+	res = suite.doRequest("POST", "/v2/quota/mychart/blobs/uploads/", nil)
+	suite.Equal(202, res.Code, "202 POST /v2/quota/mychart/blobs/uploads/")
+	location := res.Header().Get("Location")
+	res = suite.doRequest("PATCH", location, blob)
+	suite.Equal(202, res.Code, "202 PATCH upload")
+	uploadID := location[strings.LastIndex(location, "/")+1:]
+	for _, chunkPath := range []string{ociUploadChunkPath("quota", uploadID, 0, 0), ociUploadChunkPath("quota", uploadID, 0, int64(len(blob)))} {
+		suite.Nil(os.Chtimes(pathutil.Join(suite.TempDirectory, chunkPath), old, old), "no error aging upload chunk")
+	}
+	suite.Server.sweepStagedUploadsOfRepo(log, "quota")
+	res = suite.doRequest("GET", location, nil)
+	suite.Equal(404, res.Code, "404 GET swept upload")
+	suite.Equal("BLOB_UPLOAD_UNKNOWN", suite.errorCode(res))
+}
+
+func (suite *OCITestSuite) TestErrors() {
+	res := suite.doRequest("GET", "/v2/org/mychart/manifests/9.9.9", nil)
+	suite.Equal(404, res.Code, "404 GET unknown manifest")
+	suite.Equal("MANIFEST_UNKNOWN", suite.errorCode(res))
+	res = suite.doRequest("GET", "/v2/org/mychart/blobs/"+ociDigest([]byte("unknown")), nil)
+	suite.Equal(404, res.Code, "404 GET unknown blob")
+	suite.Equal("BLOB_UNKNOWN", suite.errorCode(res))
+	res = suite.doRequest("GET", "/v2/org/mychart/blobs/md5:abc", nil)
+	suite.Equal(400, res.Code, "400 GET blob with invalid digest")
+	suite.Equal("DIGEST_INVALID", suite.errorCode(res))
+	res = suite.doRequest("GET", "/v2/org/team/mychart/tags/list", nil)
+	suite.Equal(404, res.Code, "404 GET tags of a repo deeper than the depth")
+	suite.Equal("NAME_UNKNOWN", suite.errorCode(res))
+	res = suite.doRequest("PATCH", "/v2/org/mychart/blobs/uploads/abc", []byte("chunk"))
+	suite.Equal(404, res.Code, "404 PATCH unknown upload")
+	suite.Equal("BLOB_UPLOAD_UNKNOWN", suite.errorCode(res))
+	res = suite.doRequest("POST", "/v2/org/mychart/blobs/uploads/?digest="+ociDigest([]byte("other")), []byte("blob"))
+	suite.Equal(400, res.Code, "400 POST blob not matching its digest")
+	suite.Equal("DIGEST_INVALID", suite.errorCode(res))
+	res = suite.doRequest("DELETE", "/v2/org/mychart/blobs/"+ociDigest([]byte("blob")), nil)
+	suite.Equal(405, res.Code, "405 DELETE blob")
+	suite.Equal("UNSUPPORTED", suite.errorCode(res))
+
+	// the max upload size of a tenant applies to blobs and manifests
+	maxUploadSize := ByteSize("4")
+	overrides := &TenantOverrides{Repo: "tiny", MaxUploadSize: &maxUploadSize}
+	suite.Nil(overrides.compile(), "no error compiling tenant overrides")
+	suite.Server.TenantOverrides = []*TenantOverrides{overrides}
+	res = suite.doRequest("POST", "/v2/tiny/mychart/blobs/uploads/?digest="+ociDigest([]byte("too large")), []byte("too large"))
+	suite.Equal(413, res.Code, "413 POST blob larger than the max upload size")
+	suite.Equal("SIZE_INVALID", suite.errorCode(res))
+	res = suite.doRequest("PUT", "/v2/tiny/mychart/manifests/0.1.0", []byte(`{"schemaVersion": 2}`))
+	suite.Equal(413, res.Code, "413 PUT manifest larger than the max upload size")
+	suite.Equal("SIZE_INVALID", suite.errorCode(res))
+
+	// other requests below /v2/ are passed on to the router, v2 being a valid tenant name
+	res = suite.doRequest("GET", "/v2/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /v2/index.yaml")
+}
+
+func TestOCITestSuite(t *testing.T) {
+	suite.Run(t, new(OCITestSuite))
+}
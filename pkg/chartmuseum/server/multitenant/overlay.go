@@ -0,0 +1,219 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"net/http"
+	pathutil "path"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/ghodss/yaml"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+var (
+	// MetadataOverlayFilename is the per-tenant file holding chart version metadata set through the API
+	MetadataOverlayFilename = "metadata-overlay.yaml"
+)
+
+type (
+	// metadataOverlay holds chart version metadata which is not part of the chart packages,
+	// keyed by chart name and version. It is merged into the index every time it is regenerated.
+	metadataOverlay struct {
+		Entries map[string]map[string]*chartVersionOverlay `json:"entries"`
+	}
+
+	chartVersionOverlay struct {
+		Deprecated *bool             `json:"deprecated,omitempty"`
+		Provenance *provenanceRecord `json:"provenance,omitempty"`
+		Lint       *lintReport       `json:"lint,omitempty"`
+	}
+)
+
+func newMetadataOverlay() *metadataOverlay {
+	return &metadataOverlay{Entries: map[string]map[string]*chartVersionOverlay{}}
+}
+
+func (overlay *metadataOverlay) get(name string, version string) *chartVersionOverlay {
+	if versions, ok := overlay.Entries[name]; ok {
+		return versions[version]
+	}
+	return nil
+}
+
+func (overlay *metadataOverlay) set(name string, version string, cvo *chartVersionOverlay) {
+	if _, ok := overlay.Entries[name]; !ok {
+		overlay.Entries[name] = map[string]*chartVersionOverlay{}
+	}
+	overlay.Entries[name][version] = cvo
+}
+
+func (overlay *metadataOverlay) remove(name string, version string) bool {
+	versions, ok := overlay.Entries[name]
+	if !ok {
+		return false
+	}
+	if _, ok := versions[version]; !ok {
+		return false
+	}
+	delete(versions, version)
+	if len(versions) == 0 {
+		delete(overlay.Entries, name)
+	}
+	return true
+}
+
+// apply merges the overlay into the chart versions of an index, returning true if anything changed
+func (overlay *metadataOverlay) apply(index *cm_repo.Index) bool {
+	changed := false
+	for name, versions := range overlay.Entries {
+		for _, chartVersion := range index.Entries[name] {
+			cvo, ok := versions[chartVersion.Version]
+			if !ok || chartVersion.Metadata == nil {
+				continue
+			}
+			if cvo.Deprecated != nil && chartVersion.Deprecated != *cvo.Deprecated {
+				chartVersion.Deprecated = *cvo.Deprecated
+				changed = true
+			}
+			if cvo.Provenance != nil && cvo.Provenance.apply(chartVersion) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+func (server *MultiTenantServer) getMetadataOverlay(repo string) (*metadataOverlay, error) {
+	object, err := server.StorageBackend.GetObject(pathutil.Join(repo, MetadataOverlayFilename))
+	if err != nil {
+		// no overlay saved for this tenant yet
+		return newMetadataOverlay(), nil
+	}
+	overlay := newMetadataOverlay()
+	err = yaml.Unmarshal(object.Content, overlay)
+	if err != nil {
+		return nil, err
+	}
+	if overlay.Entries == nil {
+		overlay.Entries = map[string]map[string]*chartVersionOverlay{}
+	}
+	return overlay, nil
+}
+
+func (server *MultiTenantServer) saveMetadataOverlay(repo string, overlay *metadataOverlay) error {
+	content, err := yaml.Marshal(overlay)
+	if err != nil {
+		return err
+	}
+	return server.StorageBackend.PutObject(pathutil.Join(repo, MetadataOverlayFilename), content)
+}
+
+// applyMetadataOverlay merges the tenant's metadata overlay into an index before it is regenerated
+func (server *MultiTenantServer) applyMetadataOverlay(log cm_logger.LoggingFn, repo string, index *cm_repo.Index) bool {
+	overlay, err := server.getMetadataOverlay(repo)
+	if err != nil {
+		log(cm_logger.WarnLevel, "metadata-overlay.yaml found but could not be parsed",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return false
+	}
+	return overlay.apply(index)
+}
+
+// updateMetadataOverlay modifies the tenant's metadata overlay in storage, serializing concurrent writers
+func (server *MultiTenantServer) updateMetadataOverlay(log cm_logger.LoggingFn, repo string, fn func(*metadataOverlay) bool) error {
+	if _, err := server.initCacheEntry(log, repo); err != nil {
+		return err
+	}
+	tenant := server.Tenants[repo]
+	tenant.MetadataOverlayLock.Lock()
+	defer tenant.MetadataOverlayLock.Unlock()
+
+	overlay, err := server.getMetadataOverlay(repo)
+	if err != nil {
+		return err
+	}
+	if !fn(overlay) {
+		return nil
+	}
+	log(cm_logger.DebugLevel, "Saving metadata-overlay.yaml",
+		"repo", repo,
+	)
+	return server.saveMetadataOverlay(repo, overlay)
+}
+
+func (server *MultiTenantServer) setChartVersionDeprecated(log cm_logger.LoggingFn, repo string, name string, version string, deprecated bool) (*helm_repo.ChartVersion, *HTTPError) {
+	if httpErr := server.checkNotUpstreamProxy(repo); httpErr != nil {
+		return nil, httpErr
+	}
+	chart, httpErr := server.getChart(log, repo, name)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	var chartVersion *helm_repo.ChartVersion
+	for _, cv := range chart {
+		if cv.Version == version {
+			chartVersion = cv
+			break
+		}
+	}
+	if chartVersion == nil {
+		return nil, &HTTPError{http.StatusNotFound, fmt.Sprintf("no chart version found for %s-%s", name, version)}
+	}
+
+	err := server.updateMetadataOverlay(log, repo, func(overlay *metadataOverlay) bool {
+		cvo := overlay.get(name, version)
+		if cvo == nil {
+			cvo = &chartVersionOverlay{}
+		}
+		cvo.Deprecated = &deprecated
+		overlay.set(name, version, cvo)
+		return true
+	})
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+
+	// copy the chart version so the cached index is only modified by the event listener,
+	// using the relative package URL expected by Index.UpdateEntry
+	metadata := *chartVersion.Metadata
+	metadata.Deprecated = deprecated
+	updated := *chartVersion
+	updated.Metadata = &metadata
+	updated.URLs = []string{fmt.Sprintf("charts/%s", cm_repo.ChartPackageFilenameFromNameVersion(name, version))}
+	return &updated, nil
+}
+
+// removeChartVersionOverlay drops the overlay of a deleted chart version, so it is not applied to a later upload
+func (server *MultiTenantServer) removeChartVersionOverlay(log cm_logger.LoggingFn, repo string, name string, version string) {
+	err := server.updateMetadataOverlay(log, repo, func(overlay *metadataOverlay) bool {
+		return overlay.remove(name, version)
+	})
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error removing chart version from metadata-overlay.yaml",
+			"repo", repo,
+			"name", name,
+			"version", version,
+			"error", err.Error(),
+		)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"regexp"
+	"strings"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ghodss/yaml"
+)
+
+// the rules of the upload policies, as reported in violations
+const (
+	PolicyRuleSemver2             = "semver2"
+	PolicyRuleNamePattern         = "namePattern"
+	PolicyRuleRequiredAnnotations = "requiredAnnotations"
+	PolicyRuleRequireMaintainers  = "requireMaintainers"
+	PolicyRuleMaxPackageSize      = "maxPackageSize"
+	PolicyRuleAPIVersions         = "apiVersions"
+	PolicyRuleDisallowPrereleases = "disallowPrereleases"
+	PolicyRuleKubeVersion         = "kubeVersion"
+)
+
+type (
+	/*
+		UploadPolicy holds rules a chart package must follow to be stored in the tenants matching Repo (a glob,
+		as in path.Match, matching every tenant when empty). The rules of every matching policy apply:
+
+			policies:
+			# org-wide publishing standards
+			- repo: org1/*
+			  namePattern: ^org1-[a-z0-9-]+$
+			  requiredAnnotations: [org1.example.com/owner]
+			  requireMaintainers: true
+			  apiVersions: [v2]
+			  requireKubeVersion: true
+			# no prereleases in the release tenant
+			- repo: org1/release
+			  disallowPrereleases: true
+			  maxPackageSize: 1Mi
+			  kubeVersion: 1.21.0
+	*/
+	UploadPolicy struct {
+		Repo                string   `json:"repo,omitempty"`
+		NamePattern         string   `json:"namePattern,omitempty"`
+		RequiredAnnotations []string `json:"requiredAnnotations,omitempty"`
+		RequireMaintainers  bool     `json:"requireMaintainers,omitempty"`
+		MaxPackageSize      ByteSize `json:"maxPackageSize,omitempty"`
+		APIVersions         []string `json:"apiVersions,omitempty"`
+		DisallowPrereleases bool     `json:"disallowPrereleases,omitempty"`
+		RequireKubeVersion  bool     `json:"requireKubeVersion,omitempty"`
+		// KubeVersion is a Kubernetes version the kubeVersion constraint of the charts must allow
+		KubeVersion string `json:"kubeVersion,omitempty"`
+
+		namePattern    *regexp.Regexp
+		maxPackageSize int64
+		kubeVersion    *semver.Version
+	}
+
+	// PolicyViolation is a rule of the upload policy which a chart package does not follow
+	PolicyViolation struct {
+		Rule    string `json:"rule"`
+		Message string `json:"message"`
+	}
+
+	uploadPolicyConfig struct {
+		Policies []*UploadPolicy `json:"policies"`
+	}
+)
+
+// LoadUploadPolicies reads and validates the upload policies in a YAML file
+func LoadUploadPolicies(filename string) ([]*UploadPolicy, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &uploadPolicyConfig{}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	for i, policy := range config.Policies {
+		if err := policy.compile(); err != nil {
+			return nil, fmt.Errorf("upload policy %d: %s", i+1, err)
+		}
+	}
+	return config.Policies, nil
+}
+
+// compile validates the repo glob of the policy and parses its name pattern, max package size and Kubernetes version
+func (policy *UploadPolicy) compile() error {
+	if _, err := pathutil.Match(policy.Repo, ""); err != nil {
+		return fmt.Errorf("invalid repo glob %q: %s", policy.Repo, err)
+	}
+	if policy.NamePattern != "" {
+		namePattern, err := regexp.Compile(policy.NamePattern)
+		if err != nil {
+			return fmt.Errorf("invalid name pattern %q: %s", policy.NamePattern, err)
+		}
+		policy.namePattern = namePattern
+	}
+	if policy.MaxPackageSize != "" {
+		size, err := ParseByteSize(string(policy.MaxPackageSize))
+		if err != nil {
+			return err
+		}
+		policy.maxPackageSize = size
+	}
+	if policy.KubeVersion != "" {
+		kubeVersion, err := semver.NewVersion(policy.KubeVersion)
+		if err != nil {
+			return fmt.Errorf("invalid kubeVersion %q: %s", policy.KubeVersion, err)
+		}
+		policy.kubeVersion = kubeVersion
+	}
+	return nil
+}
+
+func (policy *UploadPolicy) matches(repo string) bool {
+	if policy.Repo == "" {
+		return true
+	}
+	ok, _ := pathutil.Match(policy.Repo, repo)
+	return ok
+}
+
+// check returns the rules of the policy which a chart package does not follow
+func (policy *UploadPolicy) check(chartPackage *spooledChartPackage) []*PolicyViolation {
+	var violations []*PolicyViolation
+	violate := func(rule string, format string, args ...interface{}) {
+		violations = append(violations, &PolicyViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+	metadata := chartPackage.chartVersion.Metadata
+
+	if policy.namePattern != nil && !policy.namePattern.MatchString(metadata.Name) {
+		violate(PolicyRuleNamePattern, "chart name %s does not match %s", metadata.Name, policy.NamePattern)
+	}
+	for _, annotation := range policy.RequiredAnnotations {
+		if metadata.Annotations[annotation] == "" {
+			violate(PolicyRuleRequiredAnnotations, "annotation %s is required", annotation)
+		}
+	}
+	if policy.RequireMaintainers && len(metadata.Maintainers) == 0 {
+		violate(PolicyRuleRequireMaintainers, "at least one maintainer is required")
+	}
+	if policy.maxPackageSize > 0 && chartPackage.size > policy.maxPackageSize {
+		violate(PolicyRuleMaxPackageSize, "package size %s exceeds %s", formatByteSize(chartPackage.size), formatByteSize(policy.maxPackageSize))
+	}
+	if len(policy.APIVersions) > 0 && !containsString(policy.APIVersions, metadata.APIVersion) {
+		violate(PolicyRuleAPIVersions, "apiVersion %s is not one of %s", metadata.APIVersion, strings.Join(policy.APIVersions, ", "))
+	}
+	if policy.DisallowPrereleases {
+		if version, err := semver.NewVersion(metadata.Version); err == nil && version.Prerelease() != "" {
+			violate(PolicyRuleDisallowPrereleases, "prerelease version %s is not allowed", metadata.Version)
+		}
+	}
+	if metadata.KubeVersion == "" {
+		if policy.RequireKubeVersion {
+			violate(PolicyRuleKubeVersion, "a kubeVersion constraint is required")
+		}
+	} else if policy.kubeVersion != nil {
+		constraint, err := semver.NewConstraint(metadata.KubeVersion)
+		if err != nil {
+			violate(PolicyRuleKubeVersion, "invalid kubeVersion constraint %s: %s", metadata.KubeVersion, err)
+		} else if !constraint.Check(policy.kubeVersion) {
+			violate(PolicyRuleKubeVersion, "kubeVersion %s does not allow Kubernetes %s", metadata.KubeVersion, policy.KubeVersion)
+		}
+	}
+	return violations
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUploadPolicy returns the rules of the policies of a tenant which a chart package does not follow, semver2 included
+func (server *MultiTenantServer) checkUploadPolicy(log cm_logger.LoggingFn, repo string, chartPackage *spooledChartPackage) []*PolicyViolation {
+	var violations []*PolicyViolation
+	if server.getTenantSettings(log, repo).enforceSemver2 {
+		if _, err := semver.StrictNewVersion(chartPackage.chartVersion.Version); err != nil {
+			violations = append(violations, &PolicyViolation{
+				Rule:    PolicyRuleSemver2,
+				Message: fmt.Errorf("semver2 validation: %w", err).Error(),
+			})
+		}
+	}
+	for _, policy := range server.UploadPolicies {
+		if policy.matches(repo) {
+			violations = append(violations, policy.check(chartPackage)...)
+		}
+	}
+	return violations
+}
+
+// policyViolationError is the error of an upload rejected for violating the policies of a tenant
+func policyViolationError(filename string, violations []*PolicyViolation) *HTTPError {
+	var messages []string
+	for _, violation := range violations {
+		messages = append(messages, violation.Message)
+	}
+	return &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s violates the upload policy: %s", filename, strings.Join(messages, "; "))}
+}
+
+/*
+checkUploadedChartPackage checks a chart package uploaded to a tenant against its upload policies, and lints it
+according to its lint policy. The policy violations and lint findings are added to the report of the upload.
+*/
+func (server *MultiTenantServer) checkUploadedChartPackage(log cm_logger.LoggingFn, repo string, chartPackage *spooledChartPackage, report *uploadReport) *HTTPError {
+	if violations := server.checkUploadPolicy(log, repo, chartPackage); len(violations) > 0 {
+		log(cm_logger.WarnLevel, "Chart package violates the upload policy",
+			"repo", repo,
+			"package", chartPackage.filename,
+		)
+		report.violations = append(report.violations, violations...)
+		return policyViolationError(chartPackage.filename, violations)
+	}
+	lintReport, httpErr := server.lintUploadedChartPackage(log, repo, chartPackage)
+	if lintReport != nil {
+		report.lint = append(report.lint, lintReport)
+	}
+	return httpErr
+}
@@ -0,0 +1,148 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"io/ioutil"
+	"os"
+	pathutil "path"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type PolicyTestSuite struct {
+	suite.Suite
+}
+
+func testChartPackage(metadata *chart.Metadata, size int64) *spooledChartPackage {
+	return &spooledChartPackage{
+		spooledFile:  &spooledFile{size: size},
+		filename:     metadata.Name + "-" + metadata.Version + ".tgz",
+		chartVersion: &helm_repo.ChartVersion{Metadata: metadata},
+	}
+}
+
+func violatedRules(violations []*PolicyViolation) []string {
+	var rules []string
+	for _, violation := range violations {
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+func (suite *PolicyTestSuite) TestLoadUploadPolicies() {
+	dir, err := ioutil.TempDir("", "policies")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+
+	filename := pathutil.Join(dir, "policies.yaml")
+	err = ioutil.WriteFile(filename, []byte(`policies:
+- repo: org1/*
+  namePattern: ^org1-
+  maxPackageSize: 1Mi
+  kubeVersion: 1.21.0
+`), 0644)
+	suite.Nil(err, "no error writing upload policies")
+	policies, err := LoadUploadPolicies(filename)
+	suite.Nil(err, "no error loading upload policies")
+	suite.Len(policies, 1)
+	suite.Equal(int64(1024*1024), policies[0].maxPackageSize)
+	suite.True(policies[0].matches("org1/team1"))
+	suite.False(policies[0].matches("org2"))
+
+	for _, content := range []string{
+		"policies:\n- repo: \"[\"\n",
+		"policies:\n- namePattern: \"(\"\n",
+		"policies:\n- maxPackageSize: lots\n",
+		"policies:\n- kubeVersion: latest\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		suite.Nil(err, "no error writing upload policies")
+		_, err = LoadUploadPolicies(filename)
+		suite.NotNil(err, "error loading invalid upload policies: %s", content)
+	}
+}
+
+func (suite *PolicyTestSuite) TestCheck() {
+	policy := &UploadPolicy{
+		NamePattern:         "^org1-",
+		RequiredAnnotations: []string{"org1.example.com/owner"},
+		RequireMaintainers:  true,
+		MaxPackageSize:      "1K",
+		APIVersions:         []string{chart.APIVersionV2},
+		DisallowPrereleases: true,
+		RequireKubeVersion:  true,
+		KubeVersion:         "1.21.0",
+	}
+	suite.Nil(policy.compile(), "no error compiling upload policy")
+
+	compliant := testChartPackage(&chart.Metadata{
+		APIVersion:  chart.APIVersionV2,
+		Name:        "org1-app",
+		Version:     "1.0.0",
+		Annotations: map[string]string{"org1.example.com/owner": "team1"},
+		Maintainers: []*chart.Maintainer{{Name: "team1"}},
+		KubeVersion: ">=1.19.0",
+	}, 512)
+	suite.Empty(policy.check(compliant), "compliant chart package")
+
+	violating := testChartPackage(&chart.Metadata{
+		APIVersion: chart.APIVersionV1,
+		Name:       "app",
+		Version:    "1.0.0-rc.1",
+	}, 2048)
+	suite.Equal([]string{
+		PolicyRuleNamePattern,
+		PolicyRuleRequiredAnnotations,
+		PolicyRuleRequireMaintainers,
+		PolicyRuleMaxPackageSize,
+		PolicyRuleAPIVersions,
+		PolicyRuleDisallowPrereleases,
+		PolicyRuleKubeVersion,
+	}, violatedRules(policy.check(violating)))
+
+	compliant.chartVersion.KubeVersion = "<1.20.0"
+	violations := policy.check(compliant)
+	suite.Equal([]string{PolicyRuleKubeVersion}, violatedRules(violations))
+	suite.Equal("kubeVersion <1.20.0 does not allow Kubernetes 1.21.0", violations[0].Message)
+
+	server := &MultiTenantServer{EnforceSemver2: true, UploadPolicies: []*UploadPolicy{{Repo: "org2", RequireMaintainers: true}}}
+	suite.Equal([]string{PolicyRuleSemver2}, violatedRules(server.checkUploadPolicy(nil, "org1", testChartPackage(&chart.Metadata{Name: "app", Version: "1.0"}, 0))))
+	suite.Equal([]string{PolicyRuleRequireMaintainers}, violatedRules(server.checkUploadPolicy(nil, "org2", violating)))
+}
+
+func (suite *PolicyTestSuite) TestUploadReportResponse() {
+	var report *uploadReport
+	suite.Equal(objectSavedResponse, report.response(objectSavedResponse), "no report")
+	report = &uploadReport{lint: []*lintReport{{Messages: []*lintMessage{{Severity: "info", Path: "Chart.yaml", Message: "icon is recommended"}}}}}
+	response := report.response(objectSavedResponse)
+	suite.Equal(true, response["saved"])
+	suite.Equal(report.lint[0].Messages, response["lint"])
+	suite.Nil(response["violations"])
+	suite.Equal(gin.H{"saved": true}, objectSavedResponse, "response shared by handlers left unchanged")
+
+	report.violations = []*PolicyViolation{{Rule: PolicyRuleRequireMaintainers, Message: "at least one maintainer is required"}}
+	suite.Equal(report.violations, report.response(gin.H{"error": "rejected"})["violations"])
+}
+
+func TestPolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(PolicyTestSuite))
+}
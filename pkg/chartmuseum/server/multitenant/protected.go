@@ -0,0 +1,98 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// the version in the Chart.yaml signed by a provenance file, as matched by chartmuseum to name provenance files
+var provenanceVersionRegexp = regexp.MustCompile("\nversion:[ *](.+)")
+
+// CompileProtectedVersions parses the patterns of the chart versions which are immutable once published
+func CompileProtectedVersions(patterns []string) ([]*regexp.Regexp, error) {
+	var protectedVersions []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protected version pattern %q: %s", pattern, err)
+		}
+		protectedVersions = append(protectedVersions, re)
+	}
+	return protectedVersions, nil
+}
+
+/*
+isProtectedVersion tells whether a chart version of the tenant can never be overwritten or deleted once published,
+being a release (a semver version without prerelease) when releases are protected, or matching a protected pattern.
+*/
+func (settings *tenantSettings) isProtectedVersion(version string) bool {
+	if settings.protectReleases {
+		if v, err := semver.NewVersion(version); err == nil && v.Prerelease() == "" {
+			return true
+		}
+	}
+	for _, re := range settings.protectedVersions {
+		if re.MatchString(version) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+provenanceVersion returns the chart version signed by a provenance file, from the Chart.yaml in its message, empty
+if it has none. Versions are not taken from filenames, which are ambiguous: app-1.0.0-20201010.tgz reads as version 20201010.
+*/
+func provenanceVersion(content []byte) string {
+	match := provenanceVersionRegexp.FindSubmatch(content)
+	if match == nil {
+		return ""
+	}
+	return strings.TrimSpace(string(match[1]))
+}
+
+/*
+checkOverwrite returns a 409 if a file already stored at path cannot be replaced by an upload, either because
+overwrites are not allowed, with message, or because its chart version is protected, which ?force does not bypass.
+*/
+func (server *MultiTenantServer) checkOverwrite(settings *tenantSettings, path string, version string, force bool, message string) *HTTPError {
+	protected := settings.isProtectedVersion(version)
+	if !protected && settings.canOverwrite(force) {
+		return nil
+	}
+	if _, err := server.StorageBackend.GetObject(path); err != nil {
+		return nil
+	}
+	if protected {
+		message = fmt.Sprintf("%s is a protected version and cannot be overwritten", version)
+	}
+	return &HTTPError{http.StatusConflict, message}
+}
+
+// checkDelete returns a 403 if a chart version of a tenant is protected and cannot be deleted
+func checkDelete(settings *tenantSettings, version string) *HTTPError {
+	if settings.isProtectedVersion(version) {
+		return &HTTPError{http.StatusForbidden, fmt.Sprintf("%s is a protected version and cannot be deleted", version)}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProtectedTestSuite struct {
+	suite.Suite
+}
+
+func (suite *ProtectedTestSuite) TestIsProtectedVersion() {
+	settings := &tenantSettings{protectReleases: true}
+	suite.True(settings.isProtectedVersion("1.0.0"), "release protected")
+	suite.False(settings.isProtectedVersion("1.1.0-dev.3"), "prerelease not protected")
+	suite.False(settings.isProtectedVersion("not-semver"), "invalid version not protected")
+
+	protectedVersions, err := CompileProtectedVersions([]string{"^2\\.", "-rc\\."})
+	suite.Nil(err, "no error compiling protected versions")
+	settings = &tenantSettings{protectedVersions: protectedVersions}
+	suite.False(settings.isProtectedVersion("1.0.0"), "release not protected")
+	suite.True(settings.isProtectedVersion("2.0.0-dev.1"), "version matching pattern protected")
+	suite.True(settings.isProtectedVersion("1.1.0-rc.1"), "version matching pattern protected")
+
+	_, err = CompileProtectedVersions([]string{"("})
+	suite.NotNil(err, "error compiling invalid pattern")
+}
+
+func (suite *ProtectedTestSuite) TestProvenanceVersion() {
+	prov := "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA512\n\napiVersion: v2\nname: app\nversion: 1.0.0-20201010\n\n...\n"
+	suite.Equal("1.0.0-20201010", provenanceVersion([]byte(prov)))
+	suite.Equal("", provenanceVersion([]byte("not a provenance file")))
+}
+
+func TestProtectedTestSuite(t *testing.T) {
+	suite.Run(t, new(ProtectedTestSuite))
+}
@@ -0,0 +1,223 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"sort"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// provenanceFileSuffix is appended to the filename of a chart package to get its provenance file
+	provenanceFileSuffix = ".prov"
+)
+
+var (
+	// SignedByAnnotation is the chart version annotation holding the identity of the key which signed its provenance file
+	SignedByAnnotation = "chartmuseum.com/signed-by"
+)
+
+type (
+	// provenanceRecord is the result of verifying the provenance file of a chart version against the server keyring
+	provenanceRecord struct {
+		SignedBy   string    `json:"signedBy"`
+		KeyID      string    `json:"keyId"`
+		Digest     string    `json:"digest"`
+		VerifiedAt time.Time `json:"verifiedAt"`
+
+		// the verified chart package and its chart version, used to update the index
+		filename     string
+		chartVersion *helm_repo.ChartVersion
+	}
+)
+
+/*
+verifyProvenance verifies the provenance file of a chart package against the server keyring, checking both
+the signature and the digest of the package. If either the package or the provenance file is nil it is read
+from storage. Nothing is verified (and nil is returned) if no keyring is configured or if the package has no
+provenance file.
+*/
+func (server *MultiTenantServer) verifyProvenance(log cm_logger.LoggingFn, repo string, packageFilename string, chartPackage *spooledChartPackage, provContent []byte) (*provenanceRecord, *HTTPError) {
+	if server.ProvenanceVerifier == nil {
+		return nil, nil
+	}
+	provFilename := packageFilename + provenanceFileSuffix
+	if provContent == nil {
+		object, err := server.StorageBackend.GetObject(pathutil.Join(repo, provFilename))
+		if err != nil {
+			// unsigned chart package
+			return nil, nil
+		}
+		provContent = object.Content
+	}
+	if chartPackage == nil {
+		object, err := server.StorageBackend.GetObject(pathutil.Join(repo, packageFilename))
+		if err != nil {
+			return nil, &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s must be uploaded before its provenance file", packageFilename)}
+		}
+		file, err := spoolFile(bytes.NewReader(object.Content))
+		if err != nil {
+			return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+		}
+		defer file.remove()
+		if chartPackage, err = parseChartPackage(file, object.LastModified); err != nil {
+			return nil, &HTTPError{http.StatusBadRequest, err.Error()}
+		}
+	}
+
+	// the helm provenance package only verifies files on disk, the package is spooled under its own filename
+	provFile, err := ioutil.TempFile("", "chartmuseum-provenance")
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	defer os.Remove(provFile.Name())
+	_, err = provFile.Write(provContent)
+	if closeErr := provFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+
+	verification, err := server.ProvenanceVerifier.Verify(chartPackage.path, provFile.Name())
+	if err != nil {
+		log(cm_logger.WarnLevel, "Provenance verification failed",
+			"repo", repo,
+			"package", packageFilename,
+			"error", err.Error(),
+		)
+		return nil, &HTTPError{http.StatusBadRequest, fmt.Sprintf("provenance verification failed: %s", err)}
+	}
+
+	record := &provenanceRecord{
+		Digest:       strings.TrimPrefix(verification.FileHash, "sha256:"),
+		VerifiedAt:   time.Now(),
+		filename:     packageFilename,
+		chartVersion: chartPackage.chartVersion,
+	}
+	if signedBy := verification.SignedBy; signedBy != nil {
+		record.KeyID = fmt.Sprintf("%X", signedBy.PrimaryKey.KeyId)
+		var names []string
+		for name, identity := range signedBy.Identities {
+			if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+				names = []string{name}
+				break
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			record.SignedBy = names[0]
+		}
+	}
+	log(cm_logger.DebugLevel, "Provenance verified",
+		"repo", repo,
+		"package", packageFilename,
+		"signed_by", record.SignedBy,
+	)
+	return record, nil
+}
+
+// verifyUploadedProvenance verifies the provenance of the chart packages and provenance files of a multipart upload
+func (server *MultiTenantServer) verifyUploadedProvenance(log cm_logger.LoggingFn, repo string, cpFiles map[string]*chartOrProvenanceFile) ([]*provenanceRecord, *HTTPError) {
+	var records []*provenanceRecord
+	for _, ppf := range cpFiles {
+		var record *provenanceRecord
+		var err *HTTPError
+		if strings.HasSuffix(ppf.filename, provenanceFileSuffix) {
+			packageFilename := strings.TrimSuffix(ppf.filename, provenanceFileSuffix)
+			if _, ok := cpFiles[packageFilename]; ok {
+				// verified with the chart package
+				continue
+			}
+			record, err = server.verifyProvenance(log, repo, packageFilename, nil, ppf.content)
+		} else {
+			var provContent []byte
+			if prov, ok := cpFiles[ppf.filename+provenanceFileSuffix]; ok {
+				provContent = prov.content
+			}
+			record, err = server.verifyProvenance(log, repo, ppf.filename, ppf.chart, provContent)
+			if err == nil {
+				err = server.checkChartPackageSigned(repo, ppf.filename, record)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// recordProvenance saves a verified provenance in the tenant's metadata overlay, so the signer is added to the index
+func (server *MultiTenantServer) recordProvenance(log cm_logger.LoggingFn, repo string, record *provenanceRecord) {
+	name := record.chartVersion.Name
+	version := record.chartVersion.Version
+	err := server.updateMetadataOverlay(log, repo, func(overlay *metadataOverlay) bool {
+		cvo := overlay.get(name, version)
+		if cvo == nil {
+			cvo = &chartVersionOverlay{}
+		}
+		cvo.Provenance = record
+		overlay.set(name, version, cvo)
+		return true
+	})
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error saving provenance to metadata-overlay.yaml",
+			"repo", repo,
+			"name", name,
+			"version", version,
+			"error", err.Error(),
+		)
+	}
+}
+
+/*
+apply sets the signer annotation of a chart version, returning true if it changed. The annotation is
+removed if the package was replaced since its provenance was verified.
+*/
+func (record *provenanceRecord) apply(chartVersion *helm_repo.ChartVersion) bool {
+	verified := record.Digest == "" || chartVersion.Digest == "" || record.Digest == chartVersion.Digest
+	signedBy, ok := chartVersion.Annotations[SignedByAnnotation]
+	if verified == ok && (!verified || signedBy == record.SignedBy) {
+		return false
+	}
+	annotations := map[string]string{}
+	for key, value := range chartVersion.Annotations {
+		annotations[key] = value
+	}
+	if verified {
+		annotations[SignedByAnnotation] = record.SignedBy
+	} else {
+		delete(annotations, SignedByAnnotation)
+	}
+	chartVersion.Annotations = annotations
+	return true
+}
@@ -0,0 +1,347 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	pathutil "path"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// the last index fetched from the upstream repository is kept below this prefix of a proxy tenant
+	upstreamIndexPrefix = ".proxy"
+)
+
+var (
+	// chart packages, and the indexes of large public repositories, can take a while to download
+	upstreamTimeout = 5 * time.Minute
+)
+
+type (
+	/*
+		UpstreamProxy makes the tenant Repo a caching proxy of the upstream chart repository at URL. Its index.yaml is
+		the upstream one, fetched on an interval, and its chart packages are fetched from upstream on their first
+		download, then served from storage:
+
+			proxies:
+			# the public repositories our clusters depend on
+			- repo: mirror/bitnami
+			  url: https://charts.bitnami.com/bitnami
+			- repo: mirror/internal
+			  url: https://charts.example.com/internal
+			  username: mirror
+			  password: changeme
+	*/
+	UpstreamProxy struct {
+		Repo     string `json:"repo"`
+		URL      string `json:"url"`
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+
+		lock sync.Mutex
+		// digest of the upstream index the entry was built from
+		digest string
+		entry  *cacheEntry
+		files  map[string]*upstreamFile
+	}
+
+	// upstreamFile is where a chart package of a proxy tenant is fetched from, with its digest from the upstream index
+	upstreamFile struct {
+		url    string
+		digest string
+	}
+
+	upstreamProxyConfig struct {
+		Proxies []*UpstreamProxy `json:"proxies"`
+	}
+)
+
+// LoadUpstreamProxies reads and validates the upstream repositories proxied by tenants in a YAML file
+func LoadUpstreamProxies(filename string) ([]*UpstreamProxy, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &upstreamProxyConfig{}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	repos := map[string]bool{}
+	for i, proxy := range config.Proxies {
+		if err := proxy.validate(); err != nil {
+			return nil, fmt.Errorf("proxy %d: %s", i+1, err)
+		}
+		if repos[proxy.Repo] {
+			return nil, fmt.Errorf("proxy %d: repo %s proxies another upstream", i+1, proxy.Repo)
+		}
+		repos[proxy.Repo] = true
+	}
+	return config.Proxies, nil
+}
+
+// validate checks the URL and repo of the proxy, removing the trailing slashes of both
+func (proxy *UpstreamProxy) validate() error {
+	proxy.URL = strings.TrimSuffix(proxy.URL, "/")
+	u, err := url.Parse(proxy.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", proxy.URL)
+	}
+	proxy.Repo = strings.Trim(proxy.Repo, "/")
+	if (proxy.Repo != "" && pathutil.Clean(proxy.Repo) != proxy.Repo) || strings.HasPrefix(proxy.Repo, ".") {
+		return fmt.Errorf("%s is improperly formatted", proxy.Repo)
+	}
+	return nil
+}
+
+// fetch gets a file from the upstream repository, sending the credentials of the proxy to its host only
+func (proxy *UpstreamProxy) fetch(fileURL string) ([]byte, int, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if upstream, err := url.Parse(proxy.URL); err == nil && req.URL.Host == upstream.Host && proxy.Username != "" {
+		req.SetBasicAuth(proxy.Username, proxy.Password)
+	}
+	client := &http.Client{Timeout: upstreamTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, res.StatusCode, nil
+	}
+	content, err := ioutil.ReadAll(res.Body)
+	return content, res.StatusCode, err
+}
+
+func (server *MultiTenantServer) getUpstreamProxy(repo string) *UpstreamProxy {
+	for _, proxy := range server.UpstreamProxies {
+		if proxy.Repo == repo {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// checkNotUpstreamProxy returns a 403 for changes to a tenant proxying an upstream repository, which is read-only
+func (server *MultiTenantServer) checkNotUpstreamProxy(repo string) *HTTPError {
+	if proxy := server.getUpstreamProxy(repo); proxy != nil {
+		return &HTTPError{http.StatusForbidden, fmt.Sprintf("repo is a read-only proxy of %s", proxy.URL)}
+	}
+	return nil
+}
+
+/*
+refreshUpstreamProxy fetches the index of the upstream repository of a proxy tenant, and keeps it in storage.
+While the upstream repository is unavailable, the last index fetched keeps being served, loaded from
+storage if the server was restarted since.
+*/
+func (server *MultiTenantServer) refreshUpstreamProxy(log cm_logger.LoggingFn, proxy *UpstreamProxy) error {
+	objectPath := pathutil.Join(proxy.Repo, upstreamIndexPrefix, "index.yaml")
+	content, status, err := proxy.fetch(proxy.URL + "/index.yaml")
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("upstream returned %d", status)
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error fetching upstream index",
+			"repo", proxy.Repo,
+			"url", proxy.URL,
+			"error", err.Error(),
+		)
+		proxy.lock.Lock()
+		loaded := proxy.entry != nil
+		proxy.lock.Unlock()
+		if loaded {
+			return err
+		}
+		object, storageErr := server.StorageBackend.GetObject(objectPath)
+		if storageErr != nil {
+			return err
+		}
+		content = object.Content
+	} else if err := server.StorageBackend.PutObject(objectPath, content); err != nil {
+		log(cm_logger.WarnLevel, "Error saving upstream index",
+			"repo", proxy.Repo,
+			"error", err.Error(),
+		)
+	}
+	return server.loadUpstreamIndex(log, proxy, content)
+}
+
+/*
+loadUpstreamIndex builds the index of a proxy tenant from the index of its upstream repository, its chart
+versions pointing to the tenant, which fetches each package from the URL of the upstream index on first download.
+*/
+func (server *MultiTenantServer) loadUpstreamIndex(log cm_logger.LoggingFn, proxy *UpstreamProxy, content []byte) error {
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	proxy.lock.Lock()
+	unchanged := proxy.digest == digest
+	proxy.lock.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	upstream := &helm_repo.IndexFile{}
+	if err := yaml.Unmarshal(content, upstream); err != nil {
+		return fmt.Errorf("invalid upstream index: %s", err)
+	}
+	base, err := url.Parse(proxy.URL + "/")
+	if err != nil {
+		return err
+	}
+	index := cm_repo.NewIndex(server.getTenantSettings(log, proxy.Repo).chartURL, proxy.Repo, &cm_repo.ServerInfo{
+		ContextPath: server.Router.ContextPath,
+	})
+	files := map[string]*upstreamFile{}
+	for _, chartVersions := range upstream.Entries {
+		for _, chartVersion := range chartVersions {
+			if chartVersion == nil || chartVersion.Metadata == nil || len(chartVersion.URLs) == 0 {
+				continue
+			}
+			filename := cm_repo.ChartPackageFilenameFromNameVersion(chartVersion.Name, chartVersion.Version)
+			if pathutil.Base(filename) != filename {
+				continue
+			}
+			ref, err := url.Parse(chartVersion.URLs[0])
+			if err != nil {
+				continue
+			}
+			files[filename] = &upstreamFile{url: base.ResolveReference(ref).String(), digest: chartVersion.Digest}
+			chartVersion.URLs = []string{"charts/" + filename}
+			index.AddEntry(chartVersion)
+		}
+	}
+	if err := index.Regenerate(); err != nil {
+		return err
+	}
+	entry := newCacheEntry(proxy.Repo, index)
+
+	proxy.lock.Lock()
+	proxy.digest = digest
+	proxy.entry = entry
+	proxy.files = files
+	proxy.lock.Unlock()
+	log(cm_logger.DebugLevel, "Upstream index loaded",
+		"repo", proxy.Repo,
+		"url", proxy.URL,
+		"charts", len(index.Entries),
+	)
+	return nil
+}
+
+// getUpstreamProxyCacheEntry returns the cache entry of a proxy tenant, fetching the upstream index on first use
+func (server *MultiTenantServer) getUpstreamProxyCacheEntry(log cm_logger.LoggingFn, proxy *UpstreamProxy) (*cacheEntry, *HTTPError) {
+	proxy.lock.Lock()
+	entry := proxy.entry
+	proxy.lock.Unlock()
+	if entry != nil {
+		return entry, nil
+	}
+	if err := server.refreshUpstreamProxy(log, proxy); err != nil {
+		return nil, &HTTPError{http.StatusBadGateway, fmt.Sprintf("upstream index unavailable: %s", err)}
+	}
+	proxy.lock.Lock()
+	defer proxy.lock.Unlock()
+	return proxy.entry, nil
+}
+
+/*
+fetchUpstreamFile fetches a chart package or provenance file of a proxy tenant which is not in storage yet
+from the upstream repository, and stores it. Chart packages are checked against the digest of the upstream index.
+*/
+func (server *MultiTenantServer) fetchUpstreamFile(log cm_logger.LoggingFn, proxy *UpstreamProxy, filename string) *HTTPError {
+	if _, httpErr := server.getUpstreamProxyCacheEntry(log, proxy); httpErr != nil {
+		return httpErr
+	}
+	packageFilename := strings.TrimSuffix(filename, provenanceFileSuffix)
+	proxy.lock.Lock()
+	file := proxy.files[packageFilename]
+	proxy.lock.Unlock()
+	if file == nil {
+		return &HTTPError{http.StatusNotFound, "object not found"}
+	}
+	fileURL := file.url
+	if filename != packageFilename {
+		fileURL += provenanceFileSuffix
+	}
+
+	// concurrent first downloads of a file all fetch it, storing the same content
+	content, status, err := proxy.fetch(fileURL)
+	if err == nil && status != http.StatusOK {
+		if status == http.StatusNotFound {
+			return &HTTPError{http.StatusNotFound, "object not found"}
+		}
+		err = fmt.Errorf("upstream returned %d", status)
+	}
+	if err == nil && filename == packageFilename && file.digest != "" {
+		if digest := sha256.Sum256(content); hex.EncodeToString(digest[:]) != file.digest {
+			err = fmt.Errorf("digest of %s does not match the upstream index", filename)
+		}
+	}
+	if err != nil {
+		log(cm_logger.WarnLevel, "Error fetching file from upstream",
+			"repo", proxy.Repo,
+			"url", fileURL,
+			"error", err.Error(),
+		)
+		return &HTTPError{http.StatusBadGateway, err.Error()}
+	}
+	if err := server.StorageBackend.PutObject(pathutil.Join(proxy.Repo, filename), content); err != nil {
+		return &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	log(cm_logger.DebugLevel, "File fetched from upstream",
+		"repo", proxy.Repo,
+		"url", fileURL,
+	)
+	return nil
+}
+
+func (server *MultiTenantServer) refreshUpstreamProxies() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	for _, proxy := range server.UpstreamProxies {
+		// errors are logged, the last index fetched is still served
+		server.refreshUpstreamProxy(log, proxy)
+	}
+}
+
+func (server *MultiTenantServer) initUpstreamProxyTimer() {
+	if server.ProxyInterval > 0 && len(server.UpstreamProxies) > 0 {
+		go func() {
+			t := time.NewTicker(server.ProxyInterval)
+			for range t.C {
+				server.refreshUpstreamProxies()
+			}
+		}()
+	}
+}
@@ -0,0 +1,263 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	pathutil "path"
+	"sync"
+	"testing"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
+
+	"github.com/chartmuseum/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxyTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	ChartContent  []byte
+	Upstream      *httptest.Server
+
+	// what the upstream repository serves, and the requests it received, by path
+	lock     sync.Mutex
+	files    map[string][]byte
+	requests map[string]int
+}
+
+func (suite *ProxyTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "proxy")
+	suite.Nil(err, "no error creating temp dir")
+	suite.TempDirectory = dir
+
+	suite.ChartContent, err = ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	provContent, err := ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	suite.files = map[string][]byte{
+		"/charts/mychart-0.1.0.tgz":      suite.ChartContent,
+		"/charts/mychart-0.1.0.tgz.prov": provContent,
+		"/charts/otherchart-0.1.0.tgz":   suite.ChartContent,
+	}
+	suite.requests = map[string]int{}
+	suite.Upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.lock.Lock()
+		defer suite.lock.Unlock()
+		suite.requests[r.URL.Path]++
+		if username, password, _ := r.BasicAuth(); username != "mirror" || password != "changeme" {
+			w.WriteHeader(401)
+			return
+		}
+		content, ok := suite.files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(content)
+	}))
+	suite.files["/index.yaml"] = suite.upstreamIndex(fmt.Sprintf("%x", sha256.Sum256(suite.ChartContent)))
+}
+
+func (suite *ProxyTestSuite) TearDownTest() {
+	suite.Upstream.Close()
+	os.RemoveAll(suite.TempDirectory)
+}
+
+// upstreamIndex is an index with a chart package URL relative to the repository, and another with an absolute URL
+func (suite *ProxyTestSuite) upstreamIndex(otherchartDigest string) []byte {
+	return []byte(fmt.Sprintf(`apiVersion: v1
+entries:
+  mychart:
+  - apiVersion: v1
+    name: mychart
+    version: 0.1.0
+    digest: %x
+    urls:
+    - charts/mychart-0.1.0.tgz
+  otherchart:
+  - apiVersion: v1
+    name: otherchart
+    version: 0.1.0
+    digest: %s
+    urls:
+    - %s/charts/otherchart-0.1.0.tgz
+generated: "2021-01-01T00:00:00Z"
+`, sha256.Sum256(suite.ChartContent), otherchartDigest, suite.Upstream.URL))
+}
+
+func (suite *ProxyTestSuite) setUpstreamFile(path string, content []byte) {
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	if content == nil {
+		delete(suite.files, path)
+	} else {
+		suite.files[path] = content
+	}
+}
+
+func (suite *ProxyTestSuite) upstreamRequests(path string) int {
+	suite.lock.Lock()
+	defer suite.lock.Unlock()
+	return suite.requests[path]
+}
+
+func (suite *ProxyTestSuite) newServer() *MultiTenantServer {
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{})
+	suite.Nil(err, "no error creating logger")
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:        logger,
+		Depth:         1,
+		MaxUploadSize: maxUploadSize,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 logger,
+		Router:                 router,
+		StorageBackend:         storage.NewLocalFilesystemBackend(suite.TempDirectory),
+		EnableAPI:              true,
+		ChartPostFormFieldName: "chart",
+		ProvPostFormFieldName:  "prov",
+		IndexLimit:             1,
+		UpstreamProxies: []*UpstreamProxy{
+			{Repo: "mirror", URL: suite.Upstream.URL, Username: "mirror", Password: "changeme"},
+		},
+	})
+	suite.Nil(err, "no error creating server")
+	return server
+}
+
+func (suite *ProxyTestSuite) doRequest(server *MultiTenantServer, method string, url string, body []byte) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest(method, url, bytes.NewReader(body))
+	server.Router.HandleContext(c)
+	return recorder
+}
+
+func (suite *ProxyTestSuite) TestProxy() {
+	server := suite.newServer()
+	res := suite.doRequest(server, "GET", "/mirror/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /mirror/index.yaml")
+	suite.Contains(res.Body.String(), "- charts/mychart-0.1.0.tgz", "chart package URL relative to the proxy")
+	suite.Contains(res.Body.String(), "- charts/otherchart-0.1.0.tgz", "absolute chart package URL rewritten")
+	res = suite.doRequest(server, "GET", "/api/mirror/charts/mychart", nil)
+	suite.Equal(200, res.Code, "200 GET /api/mirror/charts/mychart")
+
+	for i := 0; i < 2; i++ {
+		res = suite.doRequest(server, "GET", "/mirror/charts/mychart-0.1.0.tgz", nil)
+		suite.Equal(200, res.Code, "200 GET /mirror/charts/mychart-0.1.0.tgz")
+		suite.Equal(suite.ChartContent, res.Body.Bytes())
+		res = suite.doRequest(server, "GET", "/mirror/charts/mychart-0.1.0.tgz.prov", nil)
+		suite.Equal(200, res.Code, "200 GET /mirror/charts/mychart-0.1.0.tgz.prov")
+	}
+	suite.Equal(1, suite.upstreamRequests("/charts/mychart-0.1.0.tgz"), "chart package fetched once")
+	suite.Equal(1, suite.upstreamRequests("/charts/mychart-0.1.0.tgz.prov"), "provenance file fetched once")
+	object, err := server.StorageBackend.GetObject("mirror/mychart-0.1.0.tgz")
+	suite.Nil(err, "chart package stored")
+	suite.Equal(suite.ChartContent, object.Content)
+
+	res = suite.doRequest(server, "GET", "/mirror/charts/nochart-0.1.0.tgz", nil)
+	suite.Equal(404, res.Code, "404 GET chart package not in the upstream index")
+
+	// the package does not match the digest of the upstream index
+	suite.setUpstreamFile("/index.yaml", suite.upstreamIndex(fmt.Sprintf("%x", sha256.Sum256([]byte("other")))))
+	suite.Nil(server.refreshUpstreamProxy(server.Logger.ContextLoggingFn(&gin.Context{}), server.UpstreamProxies[0]))
+	res = suite.doRequest(server, "GET", "/mirror/charts/otherchart-0.1.0.tgz", nil)
+	suite.Equal(502, res.Code, "502 GET chart package not matching its digest")
+	_, err = server.StorageBackend.GetObject("mirror/otherchart-0.1.0.tgz")
+	suite.NotNil(err, "chart package not matching its digest not stored")
+
+	res = suite.doRequest(server, "POST", "/api/mirror/charts", suite.ChartContent)
+	suite.Equal(403, res.Code, "403 POST /api/mirror/charts")
+	res = suite.doRequest(server, "DELETE", "/api/mirror/charts/mychart/0.1.0", nil)
+	suite.Equal(403, res.Code, "403 DELETE /api/mirror/charts/mychart/0.1.0")
+	res = suite.doRequest(server, "POST", "/api/other/charts", suite.ChartContent)
+	suite.Equal(201, res.Code, "201 POST /api/other/charts")
+}
+
+func (suite *ProxyTestSuite) TestRefresh() {
+	server := suite.newServer()
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	proxy := server.UpstreamProxies[0]
+	res := suite.doRequest(server, "GET", "/mirror/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /mirror/index.yaml")
+	suite.NotContains(res.Body.String(), "0.2.0")
+
+	index := bytes.Replace(suite.upstreamIndex(""), []byte("version: 0.1.0"), []byte("version: 0.2.0"), 1)
+	suite.setUpstreamFile("/index.yaml", index)
+	suite.Nil(server.refreshUpstreamProxy(log, proxy), "no error refreshing upstream index")
+	res = suite.doRequest(server, "GET", "/mirror/index.yaml", nil)
+	suite.Contains(res.Body.String(), "mychart-0.2.0.tgz", "new chart version of the upstream index")
+
+	// the last index fetched is served while the upstream repository is down, even after a restart
+	suite.setUpstreamFile("/index.yaml", nil)
+	suite.NotNil(server.refreshUpstreamProxy(log, proxy), "error refreshing upstream index")
+	res = suite.doRequest(server, "GET", "/mirror/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /mirror/index.yaml while upstream is down")
+	suite.Contains(res.Body.String(), "mychart-0.2.0.tgz")
+	server = suite.newServer()
+	res = suite.doRequest(server, "GET", "/mirror/index.yaml", nil)
+	suite.Equal(200, res.Code, "200 GET /mirror/index.yaml after a restart while upstream is down")
+	suite.Contains(res.Body.String(), "mychart-0.2.0.tgz")
+
+	// without an index fetched before
+	os.RemoveAll(pathutil.Join(suite.TempDirectory, "mirror"))
+	server = suite.newServer()
+	res = suite.doRequest(server, "GET", "/mirror/index.yaml", nil)
+	suite.Equal(502, res.Code, "502 GET /mirror/index.yaml without upstream index")
+}
+
+func (suite *ProxyTestSuite) TestLoadUpstreamProxies() {
+	filename := pathutil.Join(suite.TempDirectory, "proxies.yaml")
+	err := ioutil.WriteFile(filename, []byte(`proxies:
+- repo: mirror/bitnami/
+  url: https://charts.bitnami.com/bitnami/
+- repo: mirror/internal
+  url: https://charts.example.com/internal
+  username: mirror
+  password: changeme
+`), 0644)
+	suite.Nil(err, "no error writing proxies config")
+	proxies, err := LoadUpstreamProxies(filename)
+	suite.Nil(err, "no error loading proxies")
+	suite.Len(proxies, 2)
+	suite.Equal("mirror/bitnami", proxies[0].Repo)
+	suite.Equal("https://charts.bitnami.com/bitnami", proxies[0].URL)
+
+	for _, content := range []string{
+		"proxies:\n- repo: mirror\n  url: ftp://example.com\n",
+		"proxies:\n- repo: mirror/../other\n  url: https://example.com\n",
+		"proxies:\n- repo: mirror\n  url: https://example.com\n- repo: mirror\n  url: https://example.org\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		suite.Nil(err, "no error writing proxies config")
+		_, err = LoadUpstreamProxies(filename)
+		suite.NotNil(err, "error loading invalid proxies: %s", content)
+	}
+}
+
+func TestProxyTestSuite(t *testing.T) {
+	suite.Run(t, new(ProxyTestSuite))
+}
@@ -0,0 +1,473 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	pathutil "path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/chartmuseum/storage"
+	"github.com/ghodss/yaml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// the usage tracked for a tenant is reconciled with storage on this interval, to account for other replicas
+	storageUsageRescanInterval = 5 * time.Minute
+
+	byteSizeRegexp = regexp.MustCompile(`^([0-9]+)\s*([kKmMgGtT]?)(i?)[bB]?$`)
+
+	storageUsedBytesGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_used_bytes",
+			Help:      "Bytes used by the chart packages and provenance files of a repo",
+		},
+		[]string{"repo"},
+	)
+	storageObjectsGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_objects",
+			Help:      "Number of chart packages and provenance files of a repo",
+		},
+		[]string{"repo"},
+	)
+	storageQuotaBytesGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "chartmuseum",
+			Name:      "storage_quota_bytes",
+			Help:      "Storage quota of a repo in bytes, 0 if it has none",
+		},
+		[]string{"repo"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storageUsedBytesGaugeVec, storageObjectsGaugeVec, storageQuotaBytesGaugeVec)
+}
+
+type (
+	/*
+		StorageQuota overrides the default storage quota for the tenants matching Repo (a glob, as in
+		path.Match). The first matching quota applies, and a quota of 0 lifts the default one:
+
+			quotas:
+			# the org1 tenants push large charts
+			- repo: org1/*
+			  quota: 50Gi
+			- repo: sandbox
+			  quota: 0
+	*/
+	StorageQuota struct {
+		Repo  string   `json:"repo"`
+		Quota ByteSize `json:"quota"`
+
+		bytes int64
+	}
+
+	// ByteSize is a size in a YAML file, written as a number of bytes or as a string with a unit
+	ByteSize string
+
+	// StorageUsage is the storage used by the chart packages and provenance files of a tenant
+	StorageUsage struct {
+		Repo       string `json:"repo"`
+		Bytes      int64  `json:"bytes"`
+		Objects    int    `json:"objects"`
+		Quota      int64  `json:"quota,omitempty"`
+		MaxObjects int    `json:"maxObjects,omitempty"`
+	}
+
+	// StorageObjectSizeLister may be implemented by storage backends to list the objects below a prefix with their size
+	StorageObjectSizeLister interface {
+		ListObjectSizes(prefix string) (map[string]int64, error)
+	}
+
+	storageQuotaConfig struct {
+		Quotas []*StorageQuota `json:"quotas"`
+	}
+
+	// tenantStorageUsage is the size of each chart package, provenance file and OCI blob of a tenant, by filename
+	tenantStorageUsage struct {
+		lock    sync.Mutex
+		objects map[string]int64
+		bytes   int64
+		scanned time.Time
+	}
+
+	/*
+		storageUsageTracker keeps the storage usage of each tenant, scanned from storage when first needed
+		and then updated as files are published and deleted, so uploads do not list the tenant.
+	*/
+	storageUsageTracker struct {
+		lock    sync.Mutex
+		tenants map[string]*tenantStorageUsage
+	}
+)
+
+// LoadStorageQuotas reads and validates the storage quota overrides in a YAML file
+func LoadStorageQuotas(filename string) ([]*StorageQuota, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &storageQuotaConfig{}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	for i, quota := range config.Quotas {
+		if err := quota.compile(); err != nil {
+			return nil, fmt.Errorf("storage quota %d: %s", i+1, err)
+		}
+	}
+	return config.Quotas, nil
+}
+
+// compile validates the repo glob of the quota and parses its size
+func (quota *StorageQuota) compile() error {
+	if _, err := pathutil.Match(quota.Repo, ""); err != nil {
+		return fmt.Errorf("invalid repo glob %q: %s", quota.Repo, err)
+	}
+	bytes, err := ParseByteSize(string(quota.Quota))
+	if err != nil {
+		return err
+	}
+	quota.bytes = bytes
+	return nil
+}
+
+// UnmarshalJSON accepts both numbers and strings
+func (size *ByteSize) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*size = ByteSize(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*size = ByteSize(n)
+	return nil
+}
+
+// ParseByteSize parses a number of bytes, with an optional decimal (K, M, G, T) or binary (Ki, Mi, Gi, Ti) unit
+func ParseByteSize(s string) (int64, error) {
+	match := byteSizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	base := int64(1000)
+	if match[3] != "" {
+		if match[2] == "" {
+			return 0, fmt.Errorf("invalid size %q", s)
+		}
+		base = 1024
+	}
+	exponent := 0
+	if match[2] != "" {
+		exponent = strings.Index("KMGT", strings.ToUpper(match[2])) + 1
+	}
+	for i := 0; i < exponent; i++ {
+		if n > (1<<63-1)/base {
+			return 0, fmt.Errorf("size %q is too large", s)
+		}
+		n *= base
+	}
+	return n, nil
+}
+
+// formatByteSize formats a number of bytes with a binary unit, for error messages
+func formatByteSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	unit := -1
+	for value >= 1024 && unit < 3 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[unit])
+}
+
+// getStorageQuota returns the quota of a tenant in bytes, 0 if it has none
+func (server *MultiTenantServer) getStorageQuota(repo string) int64 {
+	for _, quota := range server.StorageQuotas {
+		if ok, _ := pathutil.Match(quota.Repo, repo); ok {
+			return quota.bytes
+		}
+	}
+	return server.StorageQuota
+}
+
+func newStorageUsageTracker() *storageUsageTracker {
+	return &storageUsageTracker{tenants: map[string]*tenantStorageUsage{}}
+}
+
+func (tracker *storageUsageTracker) tenant(repo string, create bool) *tenantStorageUsage {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	usage, ok := tracker.tenants[repo]
+	if !ok && create {
+		usage = &tenantStorageUsage{}
+		tracker.tenants[repo] = usage
+	}
+	return usage
+}
+
+/*
+withStorageUsage calls fn with the usage of a tenant, holding its lock. The usage is scanned from storage
+the first time, and again once older than the rescan interval.
+*/
+func (server *MultiTenantServer) withStorageUsage(repo string, fn func(usage *tenantStorageUsage)) error {
+	usage := server.storageUsage.tenant(repo, true)
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+	if usage.objects == nil || time.Since(usage.scanned) > storageUsageRescanInterval {
+		objects, err := listStorageObjectSizes(server.StorageBackend, repo, isChartOrProvenanceFilename)
+		if err != nil {
+			return err
+		}
+		if server.EnableOCI {
+			// the blobs pushed over OCI are charged to the tenant as well, until they are swept or replaced by a chart package
+			blobs, err := listStorageObjectSizes(server.StorageBackend, pathutil.Join(repo, ociBlobsPrefix, "sha256"), isOCIBlobFilename)
+			if err != nil {
+				return err
+			}
+			for name, size := range blobs {
+				objects[pathutil.Join(ociBlobsPrefix, "sha256", name)] = size
+			}
+		}
+		usage.objects = map[string]int64{}
+		usage.bytes = 0
+		for filename, size := range objects {
+			usage.objects[filename] = size
+			usage.bytes += size
+		}
+		usage.scanned = time.Now()
+	}
+	fn(usage)
+	server.updateStorageUsageMetrics(repo, usage)
+	return nil
+}
+
+// recordStorageObject accounts for a published file, if the usage of the tenant is tracked
+func (server *MultiTenantServer) recordStorageObject(repo string, filename string, size int64) {
+	usage := server.storageUsage.tenant(repo, false)
+	if usage == nil {
+		return
+	}
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+	if usage.objects == nil {
+		return
+	}
+	usage.bytes += size - usage.objects[filename]
+	usage.objects[filename] = size
+	server.updateStorageUsageMetrics(repo, usage)
+}
+
+// forgetStorageObject accounts for a deleted file, if the usage of the tenant is tracked
+func (server *MultiTenantServer) forgetStorageObject(repo string, filename string) {
+	usage := server.storageUsage.tenant(repo, false)
+	if usage == nil {
+		return
+	}
+	usage.lock.Lock()
+	defer usage.lock.Unlock()
+	if size, ok := usage.objects[filename]; ok {
+		usage.bytes -= size
+		delete(usage.objects, filename)
+	}
+	server.updateStorageUsageMetrics(repo, usage)
+}
+
+func (server *MultiTenantServer) updateStorageUsageMetrics(repo string, usage *tenantStorageUsage) {
+	storageUsedBytesGaugeVec.WithLabelValues(repo).Set(float64(usage.bytes))
+	storageObjectsGaugeVec.WithLabelValues(repo).Set(float64(len(usage.objects)))
+	storageQuotaBytesGaugeVec.WithLabelValues(repo).Set(float64(server.getStorageQuota(repo)))
+}
+
+func isChartOrProvenanceFilename(filename string) bool {
+	return strings.HasSuffix(filename, "."+cm_repo.ChartPackageFileExtension) ||
+		strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension)
+}
+
+// getStorageUsage returns the storage used by a tenant, with its limits
+func (server *MultiTenantServer) getStorageUsage(log cm_logger.LoggingFn, repo string) (*StorageUsage, *HTTPError) {
+	result := &StorageUsage{
+		Repo:       repo,
+		Quota:      server.getStorageQuota(repo),
+		MaxObjects: server.getTenantSettings(log, repo).maxStorageObjects,
+	}
+	err := server.withStorageUsage(repo, func(usage *tenantStorageUsage) {
+		result.Bytes = usage.bytes
+		result.Objects = len(usage.objects)
+	})
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	return result, nil
+}
+
+/*
+checkStorageLimit checks that storing the files of an upload keeps the tenant within its maximum number of
+objects and its storage quota. Files overwriting existing ones only count for the difference in size.
+*/
+func (server *MultiTenantServer) checkStorageLimit(log cm_logger.LoggingFn, repo string, files []*chartOrProvenanceFile, force bool) *HTTPError {
+	settings := server.getTenantSettings(log, repo)
+	quota := server.getStorageQuota(repo)
+	if settings.maxStorageObjects <= 0 && quota <= 0 {
+		return nil
+	}
+	var httpErr *HTTPError
+	err := server.withStorageUsage(repo, func(usage *tenantStorageUsage) {
+		overwrite := settings.canOverwrite(force)
+		objects := len(usage.objects)
+		bytes := usage.bytes
+		var uploaded int64
+		for _, file := range files {
+			size := file.size()
+			uploaded += size
+			if existing, ok := usage.objects[file.filename]; ok && overwrite {
+				bytes += size - existing
+				continue
+			}
+			objects++
+			bytes += size
+		}
+		if settings.maxStorageObjects > 0 && objects > settings.maxStorageObjects && objects > len(usage.objects) {
+			httpErr = &HTTPError{http.StatusInsufficientStorage, "repo has reached storage limit"}
+			return
+		}
+		if quota > 0 && bytes > quota && bytes > usage.bytes {
+			httpErr = &HTTPError{http.StatusInsufficientStorage, fmt.Sprintf(
+				"repo has reached storage quota: %s used of %s, the upload needs %s",
+				formatByteSize(usage.bytes), formatByteSize(quota), formatByteSize(uploaded))}
+		}
+	})
+	if err != nil {
+		return &HTTPError{http.StatusInternalServerError, err.Error()}
+	}
+	return httpErr
+}
+
+/*
+listStorageObjectSizes returns the size of the objects directly below a prefix whose filename passes filter, keyed by
+path relative to the prefix.
+*/
+func listStorageObjectSizes(backend storage.Backend, prefix string, filter func(filename string) bool) (map[string]int64, error) {
+	var sizes map[string]int64
+	var err error
+	switch b := backend.(type) {
+	case StorageObjectSizeLister:
+		sizes, err = b.ListObjectSizes(prefix)
+	case *storage.LocalFilesystemBackend:
+		sizes, err = listLocalFilesystemObjectSizes(b, prefix)
+	case *storage.AmazonS3Backend:
+		sizes, err = listAmazonS3ObjectSizes(b, prefix)
+	default:
+		return listFetchedObjectSizes(backend, prefix, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for filename := range sizes {
+		if !filter(filename) {
+			delete(sizes, filename)
+		}
+	}
+	return sizes, nil
+}
+
+// listFetchedObjectSizes lists the objects below a prefix with backends which do not list their size, fetching them
+func listFetchedObjectSizes(backend storage.Backend, prefix string, filter func(filename string) bool) (map[string]int64, error) {
+	objects, err := backend.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{}
+	for _, object := range objects {
+		if !filter(object.Path) {
+			continue // only the accounted objects are fetched
+		}
+		// the path of the fetched object is the full path with some backends, the listed one is relative to the prefix
+		fetched, err := backend.GetObject(pathutil.Join(prefix, object.Path))
+		if err != nil {
+			return nil, err
+		}
+		sizes[object.Path] = int64(len(fetched.Content))
+	}
+	return sizes, nil
+}
+
+func listLocalFilesystemObjectSizes(b *storage.LocalFilesystemBackend, prefix string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	files, err := ioutil.ReadDir(pathutil.Join(b.RootDirectory, prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return sizes, err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			sizes[f.Name()] = f.Size()
+		}
+	}
+	return sizes, nil
+}
+
+func listAmazonS3ObjectSizes(b *storage.AmazonS3Backend, prefix string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	prefix = strings.TrimPrefix(pathutil.Join(b.Prefix, prefix)+"/", "/")
+	s3Input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(b.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	err := b.Client.ListObjectsV2Pages(s3Input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if name != "" {
+				sizes[name] = aws.Int64Value(object.Size)
+			}
+		}
+		return true
+	})
+	return sizes, err
+}
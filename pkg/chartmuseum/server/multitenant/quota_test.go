@@ -0,0 +1,138 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"io/ioutil"
+	"os"
+	pathutil "path"
+	"testing"
+
+	"github.com/chartmuseum/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+// fullPathBackend returns objects with their full path, as the Google Cloud Storage and Azure backends do
+type fullPathBackend struct {
+	storage.Backend
+}
+
+func (b fullPathBackend) GetObject(path string) (storage.Object, error) {
+	object, err := b.Backend.GetObject(path)
+	object.Path = path
+	return object, err
+}
+
+type QuotaTestSuite struct {
+	suite.Suite
+}
+
+func (suite *QuotaTestSuite) TestParseByteSize() {
+	for s, expected := range map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"500K":   500 * 1000,
+		"500kB":  500 * 1000,
+		"200Mi":  200 * 1024 * 1024,
+		"10 GiB": 10 * 1024 * 1024 * 1024,
+		"2T":     2 * 1000 * 1000 * 1000 * 1000,
+	} {
+		n, err := ParseByteSize(s)
+		suite.Nil(err, "no error parsing %s", s)
+		suite.Equal(expected, n, "size of %s", s)
+	}
+	for _, s := range []string{"", "-1", "1.5G", "10X", "i", "99999999999T"} {
+		_, err := ParseByteSize(s)
+		suite.NotNil(err, "error parsing %q", s)
+	}
+}
+
+func (suite *QuotaTestSuite) TestFormatByteSize() {
+	suite.Equal("512 B", formatByteSize(512))
+	suite.Equal("1.5 KiB", formatByteSize(1536))
+	suite.Equal("200.0 MiB", formatByteSize(200*1024*1024))
+}
+
+func (suite *QuotaTestSuite) TestListStorageObjectSizes() {
+	dir, err := ioutil.TempDir("", "quotas")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+	backend := fullPathBackend{storage.NewLocalFilesystemBackend(dir)}
+	suite.Nil(backend.PutObject("org1/mychart-0.1.0.tgz", []byte("0123456789")), "no error storing chart package")
+	suite.Nil(backend.PutObject("org1/mychart-0.1.0.tgz.prov", []byte("01234")), "no error storing provenance file")
+
+	sizes, err := listStorageObjectSizes(backend, "org1", isChartOrProvenanceFilename)
+	suite.Nil(err, "no error listing object sizes")
+	suite.Equal(map[string]int64{"mychart-0.1.0.tgz": 10, "mychart-0.1.0.tgz.prov": 5}, sizes, "sizes keyed by filename")
+
+	// overwrites and deletes are accounted for by filename
+	server := &MultiTenantServer{StorageBackend: backend, storageUsage: newStorageUsageTracker()}
+	getUsage := func() (bytes int64, objects int) {
+		suite.Nil(server.withStorageUsage("org1", func(usage *tenantStorageUsage) {
+			bytes, objects = usage.bytes, len(usage.objects)
+		}))
+		return
+	}
+	bytes, objects := getUsage()
+	suite.Equal(int64(15), bytes)
+	suite.Equal(2, objects)
+	server.recordStorageObject("org1", "mychart-0.1.0.tgz", 20)
+	bytes, objects = getUsage()
+	suite.Equal(int64(25), bytes, "overwrite counted once")
+	suite.Equal(2, objects)
+	server.forgetStorageObject("org1", "mychart-0.1.0.tgz.prov")
+	bytes, objects = getUsage()
+	suite.Equal(int64(20), bytes, "delete subtracted")
+	suite.Equal(1, objects)
+}
+
+func (suite *QuotaTestSuite) TestLoadStorageQuotas() {
+	dir, err := ioutil.TempDir("", "quotas")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+
+	filename := pathutil.Join(dir, "quotas.yaml")
+	err = ioutil.WriteFile(filename, []byte(`quotas:
+- repo: org1/*
+  quota: 50Gi
+- repo: sandbox
+  quota: 0
+`), 0644)
+	suite.Nil(err, "no error writing quotas config")
+	quotas, err := LoadStorageQuotas(filename)
+	suite.Nil(err, "no error loading storage quotas")
+	suite.Len(quotas, 2)
+
+	server := &MultiTenantServer{StorageQuota: 1000, StorageQuotas: quotas}
+	suite.Equal(int64(50*1024*1024*1024), server.getStorageQuota("org1/team1"), "quota override")
+	suite.Equal(int64(0), server.getStorageQuota("sandbox"), "default quota lifted")
+	suite.Equal(int64(1000), server.getStorageQuota("org2"), "default quota")
+
+	for _, content := range []string{
+		"quotas:\n- repo: org1\n  quota: lots\n",
+		"quotas:\n- repo: \"[\"\n  quota: 1G\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		suite.Nil(err, "no error writing quotas config")
+		_, err = LoadStorageQuotas(filename)
+		suite.NotNil(err, "error loading invalid storage quotas: %s", content)
+	}
+}
+
+func TestQuotaTestSuite(t *testing.T) {
+	suite.Run(t, new(QuotaTestSuite))
+}
@@ -0,0 +1,177 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+var (
+	indexJSONContentType = "application/json"
+)
+
+type (
+	// indexRenditions holds the encodings of an index, each computed on its first request
+	indexRenditions struct {
+		lock     sync.Mutex
+		etag     string
+		raw      []byte
+		contents map[string][]byte
+	}
+
+	// indexRenditionsCache keeps in memory the renditions of the current index of each repo
+	indexRenditionsCache struct {
+		lock    sync.Mutex
+		entries map[string]*indexRenditions
+	}
+
+	// indexRendition is the content of an index in the encoding negotiated with a client
+	indexRendition struct {
+		content         []byte
+		contentEncoding string
+		etag            string
+	}
+)
+
+func newIndexRenditionsCache() *indexRenditionsCache {
+	return &indexRenditionsCache{entries: map[string]*indexRenditions{}}
+}
+
+// get returns the renditions of the index of a repo, starting over when its ETag has changed
+func (cache *indexRenditionsCache) get(repo string, etag string, raw []byte) *indexRenditions {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	renditions, ok := cache.entries[repo]
+	if !ok || renditions.etag != etag {
+		renditions = &indexRenditions{etag: etag, raw: raw, contents: map[string][]byte{}}
+		cache.entries[repo] = renditions
+	}
+	return renditions
+}
+
+// yaml returns the index.yaml rendition for the Accept-Encoding header of a client
+func (renditions *indexRenditions) yaml(acceptEncoding string) (*indexRendition, error) {
+	return renditions.negotiate(acceptEncoding, "yaml", renditions.etag, renditions.raw)
+}
+
+// json returns the index.json rendition for the Accept-Encoding header of a client
+func (renditions *indexRenditions) json(acceptEncoding string) (*indexRendition, error) {
+	content, err := renditions.content("json", func() ([]byte, error) {
+		return yaml.YAMLToJSON(renditions.raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return renditions.negotiate(acceptEncoding, "json", variantETag(renditions.etag, "json"), content)
+}
+
+// negotiate picks brotli over gzip over no compression, each encoding having its own ETag
+func (renditions *indexRenditions) negotiate(acceptEncoding string, format string, etag string, content []byte) (*indexRendition, error) {
+	accepted := acceptedEncodings(acceptEncoding)
+	var encoding string
+	var compressFn func([]byte) ([]byte, error)
+	switch {
+	case accepted[encodingBrotli]:
+		encoding, compressFn = encodingBrotli, compressBrotli
+	case accepted[encodingGzip]:
+		encoding, compressFn = encodingGzip, compressGzip
+	default:
+		return &indexRendition{content, "", etag}, nil
+	}
+	compressed, err := renditions.content(format+"-"+encoding, func() ([]byte, error) {
+		return compressFn(content)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &indexRendition{compressed, encoding, variantETag(etag, encoding)}, nil
+}
+
+// content returns a rendition computed before, or computes it
+func (renditions *indexRenditions) content(key string, compute func() ([]byte, error)) ([]byte, error) {
+	renditions.lock.Lock()
+	defer renditions.lock.Unlock()
+	if content, ok := renditions.contents[key]; ok {
+		return content, nil
+	}
+	content, err := compute()
+	if err != nil {
+		return nil, err
+	}
+	renditions.contents[key] = content
+	return content, nil
+}
+
+// acceptedEncodings parses an Accept-Encoding header, leaving out the encodings refused with q=0
+func acceptedEncodings(acceptEncoding string) map[string]bool {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if encoding == "" {
+			continue
+		}
+		refused := false
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				refused = err != nil || q <= 0
+			}
+		}
+		accepted[encoding] = !refused
+	}
+	return accepted
+}
+
+// variantETag derives the ETag of another representation of the same content
+func variantETag(etag string, variant string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + variant + `"`
+}
+
+func compressGzip(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return compress(&buf, gzip.NewWriter(&buf), content)
+}
+
+func compressBrotli(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return compress(&buf, brotli.NewWriterLevel(&buf, brotli.DefaultCompression), content)
+}
+
+func compress(buf *bytes.Buffer, w io.WriteCloser, content []byte) ([]byte, error) {
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,363 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type (
+	/*
+		RetentionRule selects chart versions to prune from storage. Repo and Chart are globs
+		(as in path.Match) restricting the tenants and charts the rule applies to, and match
+		everything when empty. A version is pruned when any matching rule selects it and no
+		matching rule protects it:
+
+			# keep the newest 20 versions of every chart
+			- keepLatest: 20
+			# delete prereleases older than 30 days
+			- prereleasesOnly: true
+			  maxAge: 30d
+			# never delete 1.x versions of charts in the org1 tenants
+			- repo: org1/*
+			  protect: ["^1\\."]
+
+		When both keepLatest and maxAge are set, a version is selected only if it is older
+		than maxAge and not one of the newest keepLatest versions.
+	*/
+	RetentionRule struct {
+		Repo            string   `json:"repo,omitempty"`
+		Chart           string   `json:"chart,omitempty"`
+		KeepLatest      int      `json:"keepLatest,omitempty"`
+		MaxAge          string   `json:"maxAge,omitempty"`
+		PrereleasesOnly bool     `json:"prereleasesOnly,omitempty"`
+		Protect         []string `json:"protect,omitempty"`
+
+		maxAge  time.Duration
+		protect []*regexp.Regexp
+	}
+
+	// RetentionCandidate is a chart version which would be pruned by the retention rules
+	RetentionCandidate struct {
+		Name    string    `json:"name"`
+		Version string    `json:"version"`
+		Created time.Time `json:"created"`
+		Reason  string    `json:"reason"`
+	}
+
+	retentionConfig struct {
+		Rules []*RetentionRule `json:"rules"`
+	}
+)
+
+// LoadRetentionRules reads and validates the retention rules in a YAML file
+func LoadRetentionRules(filename string) ([]*RetentionRule, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &retentionConfig{}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	for i, rule := range config.Rules {
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("retention rule %d: %s", i+1, err)
+		}
+	}
+	return config.Rules, nil
+}
+
+// compile validates the rule and parses its max age and protected version patterns
+func (rule *RetentionRule) compile() error {
+	if _, err := pathutil.Match(rule.Repo, ""); err != nil {
+		return fmt.Errorf("invalid repo glob %q: %s", rule.Repo, err)
+	}
+	if _, err := pathutil.Match(rule.Chart, ""); err != nil {
+		return fmt.Errorf("invalid chart glob %q: %s", rule.Chart, err)
+	}
+	if rule.KeepLatest < 0 {
+		return fmt.Errorf("keepLatest must not be negative")
+	}
+	if rule.MaxAge != "" {
+		maxAge, err := parseRetentionAge(rule.MaxAge)
+		if err != nil {
+			return err
+		}
+		rule.maxAge = maxAge
+	}
+	rule.protect = nil
+	for _, pattern := range rule.Protect {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid protect pattern %q: %s", pattern, err)
+		}
+		rule.protect = append(rule.protect, re)
+	}
+	return nil
+}
+
+// parseRetentionAge parses a duration, additionally accepting a number of days such as "30d"
+func parseRetentionAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid maxAge %q", s)
+	}
+	return d, nil
+}
+
+func (rule *RetentionRule) matches(repo string, name string) bool {
+	if rule.Repo != "" {
+		if ok, _ := pathutil.Match(rule.Repo, repo); !ok {
+			return false
+		}
+	}
+	if rule.Chart != "" {
+		if ok, _ := pathutil.Match(rule.Chart, name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *RetentionRule) protects(version string) bool {
+	for _, re := range rule.protect {
+		if re.MatchString(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectVersions returns the versions selected by the rule, keyed by version with the reason.
+// The chart versions must be sorted newest first.
+func (rule *RetentionRule) selectVersions(chartVersions helm_repo.ChartVersions, now time.Time) map[string]string {
+	selected := map[string]string{}
+	if rule.KeepLatest == 0 && rule.maxAge == 0 {
+		return selected
+	}
+	kept := 0
+	for _, chartVersion := range chartVersions {
+		if rule.PrereleasesOnly && !isPrerelease(chartVersion.Version) {
+			continue
+		}
+		kept++
+		if rule.KeepLatest > 0 && kept <= rule.KeepLatest {
+			continue
+		}
+		if rule.maxAge > 0 {
+			if chartVersion.Created.IsZero() || now.Sub(chartVersion.Created) <= rule.maxAge {
+				continue
+			}
+			selected[chartVersion.Version] = fmt.Sprintf("older than %s", rule.MaxAge)
+		} else {
+			selected[chartVersion.Version] = fmt.Sprintf("not in newest %d versions", rule.KeepLatest)
+		}
+		if rule.PrereleasesOnly {
+			selected[chartVersion.Version] = "prerelease " + selected[chartVersion.Version]
+		}
+	}
+	return selected
+}
+
+func isPrerelease(version string) bool {
+	v, err := semver.NewVersion(version)
+	return err == nil && v.Prerelease() != ""
+}
+
+// retentionCandidates applies the rules matching a tenant to its index entries
+func retentionCandidates(rules []*RetentionRule, repo string, entries map[string]helm_repo.ChartVersions, now time.Time) []*RetentionCandidate {
+	candidates := []*RetentionCandidate{}
+	for name, chartVersions := range entries {
+		sorted := make(helm_repo.ChartVersions, len(chartVersions))
+		copy(sorted, chartVersions)
+		sort.Sort(sort.Reverse(sorted))
+
+		var matching []*RetentionRule
+		for _, rule := range rules {
+			if rule.matches(repo, name) {
+				matching = append(matching, rule)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+
+		selected := map[string]string{}
+		for _, rule := range matching {
+			for version, reason := range rule.selectVersions(sorted, now) {
+				if _, ok := selected[version]; !ok {
+					selected[version] = reason
+				}
+			}
+		}
+
+		for _, chartVersion := range sorted {
+			reason, ok := selected[chartVersion.Version]
+			if !ok {
+				continue
+			}
+			protected := false
+			for _, rule := range matching {
+				if rule.protects(chartVersion.Version) {
+					protected = true
+					break
+				}
+			}
+			if protected {
+				continue
+			}
+			candidates = append(candidates, &RetentionCandidate{
+				Name:    name,
+				Version: chartVersion.Version,
+				Created: chartVersion.Created,
+				Reason:  reason,
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates
+}
+
+func (server *MultiTenantServer) getRetentionCandidates(log cm_logger.LoggingFn, repo string) ([]*RetentionCandidate, *HTTPError) {
+	if server.getUpstreamProxy(repo) != nil {
+		// a proxy tenant mirrors its upstream repository
+		return []*RetentionCandidate{}, nil
+	}
+	indexFile, err := server.getIndexFile(log, repo)
+	if err != nil {
+		return nil, &HTTPError{http.StatusInternalServerError, err.Message}
+	}
+	candidates := retentionCandidates(server.RetentionRules, repo, indexFile.Entries, time.Now())
+	// protected versions are never deleted, whatever the rules
+	settings := server.getTenantSettings(log, repo)
+	unprotected := []*RetentionCandidate{}
+	for _, candidate := range candidates {
+		if !settings.isProtectedVersion(candidate.Version) {
+			unprotected = append(unprotected, candidate)
+		}
+	}
+	return unprotected, nil
+}
+
+// pruneRepository deletes the chart versions selected by the retention rules from a tenant
+func (server *MultiTenantServer) pruneRepository(log cm_logger.LoggingFn, repo string) {
+	if server.getTenantSettings(log, repo).disableDelete {
+		log(cm_logger.DebugLevel, "Retention rules not enforced, chart deletion is disabled",
+			"repo", repo,
+		)
+		return
+	}
+	candidates, err := server.getRetentionCandidates(log, repo)
+	if err != nil {
+		log(cm_logger.ErrorLevel, err.Message,
+			"repo", repo,
+		)
+		return
+	}
+	for _, candidate := range candidates {
+		record := &AuditRecord{
+			Action:  AuditActionDelete,
+			Repo:    repo,
+			Name:    candidate.Name,
+			Version: candidate.Version,
+			Reason:  candidate.Reason,
+		}
+		if server.AuditStore != nil {
+			record.Digest = server.getIndexedDigest(log, repo, candidate.Name, candidate.Version)
+		}
+		err := server.deleteChartVersion(log, repo, candidate.Name, candidate.Version)
+		if err != nil {
+			log(cm_logger.WarnLevel, "Error pruning chart version",
+				"repo", repo,
+				"name", candidate.Name,
+				"version", candidate.Version,
+				"error", err.Message,
+			)
+			continue
+		}
+		log(cm_logger.InfoLevel, "Pruned chart version",
+			"repo", repo,
+			"name", candidate.Name,
+			"version", candidate.Version,
+			"reason", candidate.Reason,
+		)
+		server.appendAuditRecord(log, record)
+		server.emitEvent(&gin.Context{}, repo, deleteChart, &helm_repo.ChartVersion{
+			Metadata: &chart.Metadata{
+				Name:    candidate.Name,
+				Version: candidate.Version,
+			},
+		})
+	}
+}
+
+func (server *MultiTenantServer) pruneRepositories() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	repos, err := server.discoverTenants(log)
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error discovering tenants",
+			"error", err.Error(),
+		)
+		return
+	}
+	server.Logger.Info("Applying retention rules to all tenants")
+	for _, repo := range repos {
+		server.pruneRepository(log, repo)
+	}
+}
+
+func (server *MultiTenantServer) initRetentionTimer() {
+	if server.RetentionInterval > 0 && len(server.RetentionRules) > 0 {
+		// deletion may still be enabled for some tenants by their overrides
+		if server.DisableDelete && len(server.TenantOverrides) == 0 && !server.EnableTenantYAML {
+			server.Logger.Warn("Retention rules are not enforced since chart deletion is disabled")
+			return
+		}
+		go func() {
+			t := time.NewTicker(server.RetentionInterval)
+			for range t.C {
+				server.pruneRepositories()
+			}
+		}()
+	}
+}
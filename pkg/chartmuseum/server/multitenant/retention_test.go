@@ -0,0 +1,131 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"io/ioutil"
+	"os"
+	pathutil "path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type RetentionTestSuite struct {
+	suite.Suite
+	Now     time.Time
+	Entries map[string]helm_repo.ChartVersions
+}
+
+func (suite *RetentionTestSuite) SetupSuite() {
+	suite.Now = time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	chartVersion := func(name string, version string, age time.Duration) *helm_repo.ChartVersion {
+		return &helm_repo.ChartVersion{
+			Metadata: &chart.Metadata{Name: name, Version: version},
+			Created:  suite.Now.Add(-age),
+		}
+	}
+	day := 24 * time.Hour
+	suite.Entries = map[string]helm_repo.ChartVersions{
+		"mychart": {
+			chartVersion("mychart", "2.1.0-rc.2", 1*day),
+			chartVersion("mychart", "2.1.0-rc.1", 40*day),
+			chartVersion("mychart", "2.0.0", 50*day),
+			chartVersion("mychart", "1.1.0", 100*day),
+			chartVersion("mychart", "1.0.0", 200*day),
+		},
+		"otherchart": {
+			chartVersion("otherchart", "0.2.0", 1*day),
+			chartVersion("otherchart", "0.1.0", 400*day),
+		},
+	}
+}
+
+func (suite *RetentionTestSuite) candidates(repo string, rules ...*RetentionRule) []string {
+	for _, rule := range rules {
+		suite.Nil(rule.compile(), "no error compiling rule")
+	}
+	var result []string
+	for _, candidate := range retentionCandidates(rules, repo, suite.Entries, suite.Now) {
+		result = append(result, candidate.Name+"-"+candidate.Version)
+	}
+	return result
+}
+
+func (suite *RetentionTestSuite) TestKeepLatest() {
+	suite.Equal([]string{"mychart-1.1.0", "mychart-1.0.0"},
+		suite.candidates("", &RetentionRule{Chart: "my*", KeepLatest: 3}))
+	suite.Equal([]string{"mychart-1.0.0"},
+		suite.candidates("", &RetentionRule{KeepLatest: 4}))
+}
+
+func (suite *RetentionTestSuite) TestPrereleaseMaxAge() {
+	suite.Equal([]string{"mychart-2.1.0-rc.1"},
+		suite.candidates("", &RetentionRule{PrereleasesOnly: true, MaxAge: "30d"}))
+	suite.Equal([]string{"mychart-1.0.0", "otherchart-0.1.0"},
+		suite.candidates("", &RetentionRule{MaxAge: "4000h", KeepLatest: 1}))
+}
+
+func (suite *RetentionTestSuite) TestProtect() {
+	suite.Equal([]string{"mychart-2.0.0"},
+		suite.candidates("", &RetentionRule{KeepLatest: 2}, &RetentionRule{Protect: []string{`^1\.`, `^0\.`}}))
+	suite.Equal([]string{"mychart-2.1.0-rc.1", "mychart-2.0.0", "mychart-1.1.0", "mychart-1.0.0", "otherchart-0.1.0"},
+		suite.candidates("", &RetentionRule{KeepLatest: 1}, &RetentionRule{Repo: "org1/*", Protect: []string{`^1\.`}}))
+	suite.Equal([]string{"mychart-2.1.0-rc.1", "mychart-2.0.0", "otherchart-0.1.0"},
+		suite.candidates("org1/team1", &RetentionRule{KeepLatest: 1}, &RetentionRule{Repo: "org1/*", Protect: []string{`^1\.`}}))
+}
+
+func (suite *RetentionTestSuite) TestLoadRetentionRules() {
+	dir, err := ioutil.TempDir("", "retention")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+
+	filename := pathutil.Join(dir, "retention.yaml")
+	err = ioutil.WriteFile(filename, []byte(`rules:
+- keepLatest: 20
+- prereleasesOnly: true
+  maxAge: 30d
+- repo: org1/*
+  protect: ["^1\\."]
+`), 0644)
+	suite.Nil(err, "no error writing retention config")
+	rules, err := LoadRetentionRules(filename)
+	suite.Nil(err, "no error loading retention rules")
+	suite.Len(rules, 3)
+	suite.Equal(20, rules[0].KeepLatest)
+	suite.Equal(30*24*time.Hour, rules[1].maxAge)
+	suite.True(rules[2].protects("1.2.3"), "protect pattern compiled")
+
+	for _, content := range []string{
+		"rules:\n- maxAge: forever\n",
+		"rules:\n- protect: [\"(\"]\n",
+		"rules:\n- chart: \"[\"\n",
+		"rules:\n- keepLatest: -1\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		suite.Nil(err, "no error writing retention config")
+		_, err = LoadRetentionRules(filename)
+		suite.NotNil(err, "error loading invalid retention rules: %s", content)
+	}
+}
+
+func TestRetentionTestSuite(t *testing.T) {
+	suite.Run(t, new(RetentionTestSuite))
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package multitenant
 
 import (
+	"regexp"
+
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
 
 	cm_auth "github.com/chartmuseum/auth"
@@ -33,15 +35,34 @@ func (s *MultiTenantServer) Routes() []*cm_router.Route {
 
 	helmChartRepositoryRoutes := []*cm_router.Route{
 		{"GET", "/:repo/index.yaml", s.getIndexFileRequestHandler, cm_auth.PullAction},
+		{"GET", "/:repo/index.json", s.getIndexJSONRequestHandler, cm_auth.PullAction},
 		{"GET", "/:repo/charts/:filename", s.getStorageObjectRequestHandler, cm_auth.PullAction},
+		{"HEAD", "/:repo/charts/:filename", s.getStorageObjectRequestHandler, cm_auth.PullAction},
 	}
 
 	chartManipulationRoutes := []*cm_router.Route{
+		{"GET", "/api/repos", s.getReposRequestHandler, cm_auth.PullAction},
 		{"GET", "/api/:repo/charts", s.getAllChartsRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/search", s.searchChartsRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/retention", s.getRetentionCandidatesRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/webhooks/deliveries", s.getWebhookDeliveriesRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/events", s.getEventsRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/audit", s.getAuditRecordsRequestHandler, cm_auth.PushAction},
+		{"GET", "/api/:repo/usage", s.getStorageUsageRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/dependents/:name", s.getChartDependentsRequestHandler, cm_auth.PullAction},
 		{"HEAD", "/api/:repo/charts/:name", s.headChartRequestHandler, cm_auth.PullAction},
 		{"GET", "/api/:repo/charts/:name", s.getChartRequestHandler, cm_auth.PullAction},
 		{"HEAD", "/api/:repo/charts/:name/:version", s.headChartVersionRequestHandler, cm_auth.PullAction},
 		{"GET", "/api/:repo/charts/:name/:version", s.getChartVersionRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/charts/:name/:version/dependencies", s.getChartVersionDependenciesRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/charts/:name/:version/lint", s.getChartVersionLintRequestHandler, cm_auth.PullAction},
+		// the files themselves, at files/*path, are served by chartFilesMiddleware
+		{"GET", "/api/:repo/charts/:name/:version/files", s.getChartFilesRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/charts/:name/:version/readme", s.getChartReadmeRequestHandler, cm_auth.PullAction},
+		{"GET", "/api/:repo/charts/:name/:version/templates", s.getChartTemplatesRequestHandler, cm_auth.PullAction},
+		{"PUT", "/api/:repo/charts/:name/:version/deprecation", s.putChartVersionDeprecationRequestHandler, cm_auth.PushAction},
+		{"DELETE", "/api/:repo/charts/:name/:version/deprecation", s.deleteChartVersionDeprecationRequestHandler, cm_auth.PushAction},
+		{"POST", "/api/:repo/charts/:name/:version/promote", s.promoteChartVersionRequestHandler, cm_auth.PullAction},
 		{"POST", "/api/:repo/charts", s.postRequestHandler, cm_auth.PushAction},
 		{"POST", "/api/:repo/prov", s.postProvenanceFileRequestHandler, cm_auth.PushAction},
 	}
@@ -53,9 +74,56 @@ func (s *MultiTenantServer) Routes() []*cm_router.Route {
 		routes = append(routes, chartManipulationRoutes...)
 	}
 
-	if s.APIEnabled && !s.DisableDelete {
+	if s.APIEnabled {
+		// registered even with DisableDelete, which may be overridden by tenant
 		routes = append(routes, &cm_router.Route{"DELETE", "/api/:repo/charts/:name/:version", s.deleteChartVersionRequestHandler, cm_auth.PushAction})
 	}
 
+	for _, route := range routes {
+		if route.Action == cm_auth.PullAction {
+			route.Handler = s.authorizePull(route.Handler)
+			route.Action = ""
+		}
+	}
+
+	return routes
+}
+
+// OCIRoutes are the routes of the OCI distribution API, served by ociMiddleware
+func (s *MultiTenantServer) OCIRoutes() []*OCIRoute {
+	var routes []*OCIRoute
+
+	tagsPath := regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+	manifestPath := regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	blobPath := regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	uploadsPath := regexp.MustCompile(`^/v2/(.+)/blobs/uploads/$`)
+	uploadPath := regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]+)$`)
+
+	ociPullRoutes := []*OCIRoute{
+		{"GET", regexp.MustCompile(`^/v2/$`), nil, s.getOCIBaseRequestHandler, cm_auth.PullAction},
+		{"GET", tagsPath, []string{"name"}, s.getOCITagsRequestHandler, cm_auth.PullAction},
+		{"GET", manifestPath, []string{"name", "reference"}, s.getOCIManifestRequestHandler, cm_auth.PullAction},
+		{"HEAD", manifestPath, []string{"name", "reference"}, s.getOCIManifestRequestHandler, cm_auth.PullAction},
+		{"GET", blobPath, []string{"name", "digest"}, s.getOCIBlobRequestHandler, cm_auth.PullAction},
+		{"HEAD", blobPath, []string{"name", "digest"}, s.getOCIBlobRequestHandler, cm_auth.PullAction},
+	}
+
+	ociPushRoutes := []*OCIRoute{
+		{"PUT", manifestPath, []string{"name", "reference"}, s.putOCIManifestRequestHandler, cm_auth.PushAction},
+		{"DELETE", manifestPath, []string{"name", "reference"}, s.deleteOCIManifestRequestHandler, cm_auth.PushAction},
+		{"POST", uploadsPath, []string{"name"}, s.postOCIUploadRequestHandler, cm_auth.PushAction},
+		{"GET", uploadPath, []string{"name", "uuid"}, s.getOCIUploadRequestHandler, cm_auth.PushAction},
+		{"PATCH", uploadPath, []string{"name", "uuid"}, s.patchOCIUploadRequestHandler, cm_auth.PushAction},
+		{"PUT", uploadPath, []string{"name", "uuid"}, s.putOCIUploadRequestHandler, cm_auth.PushAction},
+		{"DELETE", uploadPath, []string{"name", "uuid"}, s.deleteOCIUploadRequestHandler, cm_auth.PushAction},
+	}
+
+	routes = append(routes, ociPullRoutes...)
+
+	// pushing requires the API, as uploading chart packages does
+	if s.APIEnabled {
+		routes = append(routes, ociPushRoutes...)
+	}
+
 	return routes
 }
@@ -0,0 +1,230 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	searchFieldAny         = ""
+	searchFieldName        = "name"
+	searchFieldDescription = "description"
+	searchFieldKeyword     = "keyword"
+	searchFieldMaintainer  = "maintainer"
+	searchFieldAnnotation  = "annotation"
+)
+
+type (
+	// SearchResult is a single chart matched by a search query
+	SearchResult struct {
+		Name  string                  `json:"name"`
+		Score int                     `json:"score"`
+		Chart *helm_repo.ChartVersion `json:"chart"`
+	}
+
+	searchTerm struct {
+		field string
+		key   string // annotation key, only set for annotation terms
+		value string
+	}
+)
+
+/*
+parseSearchQuery splits a search query into terms. Terms are separated by whitespace
+and may be quoted with double quotes to include spaces. A term may be prefixed by a field
+name to restrict where it is matched:
+
+	name:mychart
+	description:"in-memory cache"
+	keyword:database
+	maintainer:alice
+	annotation:category          (annotation key exists)
+	annotation:category=Database (annotation key has value)
+
+Terms without a field are matched against every field.
+*/
+func parseSearchQuery(query string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, token := range tokenizeSearchQuery(query) {
+		term := searchTerm{field: searchFieldAny, value: token}
+		if i := strings.Index(token, ":"); i > 0 && !strings.HasPrefix(token, `"`) {
+			field := strings.ToLower(token[:i])
+			value := strings.Trim(token[i+1:], `"`)
+			switch field {
+			case searchFieldName, searchFieldDescription, searchFieldKeyword, searchFieldMaintainer:
+				term = searchTerm{field: field, value: value}
+			case searchFieldAnnotation:
+				term = searchTerm{field: field, key: value}
+				if j := strings.Index(value, "="); j >= 0 {
+					term.key = value[:j]
+					term.value = value[j+1:]
+				}
+				if term.key == "" {
+					return nil, fmt.Errorf("annotation filter requires a key")
+				}
+			default:
+				return nil, fmt.Errorf("unknown search field: %s", field)
+			}
+		}
+		term.key = strings.ToLower(term.key)
+		term.value = strings.ToLower(strings.Trim(term.value, `"`))
+		if term.value == "" && term.field != searchFieldAnnotation {
+			continue
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("search query is empty")
+	}
+	return terms, nil
+}
+
+func tokenizeSearchQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// scoreChartVersion ranks a chart version against all terms, returning 0 if any term does not match
+func scoreChartVersion(chartVersion *helm_repo.ChartVersion, terms []searchTerm) int {
+	if chartVersion == nil || chartVersion.Metadata == nil {
+		return 0
+	}
+	total := 0
+	for _, term := range terms {
+		score := 0
+		switch term.field {
+		case searchFieldName:
+			score = scoreName(chartVersion, term.value)
+		case searchFieldDescription:
+			score = scoreDescription(chartVersion, term.value)
+		case searchFieldKeyword:
+			score = scoreKeywords(chartVersion, term.value)
+		case searchFieldMaintainer:
+			score = scoreMaintainers(chartVersion, term.value)
+		case searchFieldAnnotation:
+			score = scoreAnnotations(chartVersion, term.key, term.value)
+		default:
+			score = scoreName(chartVersion, term.value) +
+				scoreDescription(chartVersion, term.value) +
+				scoreKeywords(chartVersion, term.value) +
+				scoreMaintainers(chartVersion, term.value) +
+				scoreAnnotations(chartVersion, "", term.value)
+		}
+		if score == 0 {
+			return 0
+		}
+		total += score
+	}
+	return total
+}
+
+func scoreName(chartVersion *helm_repo.ChartVersion, value string) int {
+	name := strings.ToLower(chartVersion.Name)
+	switch {
+	case name == value:
+		return 100
+	case strings.HasPrefix(name, value):
+		return 50
+	case strings.Contains(name, value):
+		return 25
+	}
+	return 0
+}
+
+func scoreDescription(chartVersion *helm_repo.ChartVersion, value string) int {
+	if strings.Contains(strings.ToLower(chartVersion.Description), value) {
+		return 10
+	}
+	return 0
+}
+
+func scoreKeywords(chartVersion *helm_repo.ChartVersion, value string) int {
+	score := 0
+	for _, keyword := range chartVersion.Keywords {
+		keyword = strings.ToLower(keyword)
+		if keyword == value {
+			return 30
+		}
+		if strings.Contains(keyword, value) {
+			score = 10
+		}
+	}
+	return score
+}
+
+func scoreMaintainers(chartVersion *helm_repo.ChartVersion, value string) int {
+	score := 0
+	for _, maintainer := range chartVersion.Maintainers {
+		if maintainer == nil {
+			continue
+		}
+		name := strings.ToLower(maintainer.Name)
+		email := strings.ToLower(maintainer.Email)
+		if name == value || email == value {
+			return 20
+		}
+		if strings.Contains(name, value) || strings.Contains(email, value) {
+			score = 10
+		}
+	}
+	return score
+}
+
+// scoreAnnotations matches annotation values, optionally restricted to a single key.
+// With a key and no value, the presence of the key is a match.
+func scoreAnnotations(chartVersion *helm_repo.ChartVersion, key string, value string) int {
+	score := 0
+	for k, v := range chartVersion.Annotations {
+		if key != "" && strings.ToLower(k) != key {
+			continue
+		}
+		v = strings.ToLower(v)
+		switch {
+		case value == "":
+			return 10
+		case v == value:
+			return 20
+		case strings.Contains(v, value):
+			score = 5
+		}
+	}
+	return score
+}
@@ -0,0 +1,97 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type SearchTestSuite struct {
+	suite.Suite
+	Postgres *helm_repo.ChartVersion
+	Redis    *helm_repo.ChartVersion
+}
+
+func (suite *SearchTestSuite) SetupSuite() {
+	suite.Postgres = &helm_repo.ChartVersion{
+		Metadata: &chart.Metadata{
+			Name:        "postgresql",
+			Version:     "1.0.0",
+			Description: "Chart for PostgreSQL, an object-relational database",
+			Keywords:    []string{"database", "sql"},
+			Maintainers: []*chart.Maintainer{{Name: "alice", Email: "alice@example.com"}},
+			Annotations: map[string]string{"category": "Database"},
+		},
+	}
+	suite.Redis = &helm_repo.ChartVersion{
+		Metadata: &chart.Metadata{
+			Name:        "redis",
+			Version:     "2.0.0",
+			Description: "Open source, advanced key-value store",
+			Keywords:    []string{"cache", "nosql"},
+			Maintainers: []*chart.Maintainer{{Name: "bob"}},
+		},
+	}
+}
+
+func (suite *SearchTestSuite) TestParseSearchQuery() {
+	terms, err := parseSearchQuery(`postgres keyword:database description:"relational database" annotation:category=Database annotation:tier`)
+	suite.Nil(err, "no error parsing query")
+	suite.Equal([]searchTerm{
+		{field: searchFieldAny, value: "postgres"},
+		{field: searchFieldKeyword, value: "database"},
+		{field: searchFieldDescription, value: "relational database"},
+		{field: searchFieldAnnotation, key: "category", value: "database"},
+		{field: searchFieldAnnotation, key: "tier"},
+	}, terms)
+
+	_, err = parseSearchQuery("bogus:value")
+	suite.NotNil(err, "error parsing unknown field")
+
+	_, err = parseSearchQuery("annotation:=value")
+	suite.NotNil(err, "error parsing annotation without key")
+
+	_, err = parseSearchQuery("   ")
+	suite.NotNil(err, "error parsing empty query")
+}
+
+func (suite *SearchTestSuite) TestScoreChartVersion() {
+	score := func(chartVersion *helm_repo.ChartVersion, query string) int {
+		terms, err := parseSearchQuery(query)
+		suite.Nil(err, "no error parsing query")
+		return scoreChartVersion(chartVersion, terms)
+	}
+
+	suite.True(score(suite.Postgres, "keyword:database") > 0, "keyword filter matches")
+	suite.Equal(0, score(suite.Redis, "keyword:database"), "keyword filter excludes")
+	suite.True(score(suite.Postgres, "maintainer:alice@example.com") > 0, "maintainer email matches")
+	suite.True(score(suite.Postgres, "annotation:category") > 0, "annotation key matches")
+	suite.Equal(0, score(suite.Redis, "annotation:category"), "missing annotation key excludes")
+	suite.Equal(0, score(suite.Postgres, "database nosql"), "all terms must match")
+
+	suite.True(score(suite.Redis, "redis") > score(suite.Redis, "store"), "name match ranks above description match")
+	suite.True(score(suite.Postgres, "postgresql") > score(suite.Postgres, "postgres"), "exact name ranks above prefix")
+	suite.True(score(suite.Postgres, "database") > score(suite.Redis, "nosql"), "matches in several fields rank higher")
+}
+
+func TestSearchTestSuite(t *testing.T) {
+	suite.Run(t, new(SearchTestSuite))
+}
@@ -19,6 +19,7 @@ package multitenant
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 
@@ -27,9 +28,11 @@ import (
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
+	cm_auth "github.com/chartmuseum/auth"
 	"github.com/chartmuseum/storage"
 	cm_storage "github.com/chartmuseum/storage"
 	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/provenance"
 )
 
 var (
@@ -68,6 +71,34 @@ type (
 		TenantCacheKeyLock     *sync.Mutex
 		CacheInterval          time.Duration
 		EventChan              chan event
+		RetentionRules         []*RetentionRule
+		RetentionInterval      time.Duration
+		ProvenanceVerifier     *provenance.Signatory
+		RequireSignedCharts    bool
+		SignedOnlyRepos        []string
+		StagingTimeout         time.Duration
+		Webhooks               []*Webhook
+		AuditStore             AuditStore
+		StorageQuota           int64
+		StorageQuotas          []*StorageQuota
+		AnonymousGet           bool
+		TenantOverrides        []*TenantOverrides
+		EnableTenantYAML       bool
+		LintPolicy             string
+		UploadPolicies         []*UploadPolicy
+		ProtectReleases        bool
+		ProtectedVersions      []*regexp.Regexp
+		EnableOCI              bool
+		ociRoutes              []*OCIRoute
+		UpstreamProxies        []*UpstreamProxy
+		ProxyInterval          time.Duration
+		chartFiles             *chartFilesCache
+		indexRenditions        *indexRenditionsCache
+		webhookDeliveries      *webhookDeliveryLog
+		eventFeed              *eventFeed
+		storageUsage           *storageUsageTracker
+		storedTenantOverrides  *tenantOverridesCache
+		stagedUploads          *stagedUploadTracker
 	}
 
 	// MultiTenantServerOptions are options for constructing a MultiTenantServer
@@ -91,11 +122,32 @@ type (
 		UseStatefiles          bool
 		EnforceSemver2         bool
 		CacheInterval          time.Duration
+		RetentionRules         []*RetentionRule
+		RetentionInterval      time.Duration
+		ChartFilesCacheSize    int64
+		ProvenanceVerifier     *provenance.Signatory
+		RequireSignedCharts    bool
+		SignedOnlyRepos        []string
+		StagingTimeout         time.Duration
+		Webhooks               []*Webhook
+		AuditStore             AuditStore
+		StorageQuota           int64
+		StorageQuotas          []*StorageQuota
+		TenantOverrides        []*TenantOverrides
+		EnableTenantYAML       bool
+		LintPolicy             string
+		UploadPolicies         []*UploadPolicy
+		ProtectReleases        bool
+		ProtectedVersions      []*regexp.Regexp
+		EnableOCI              bool
+		UpstreamProxies        []*UpstreamProxy
+		ProxyInterval          time.Duration
 	}
 
 	tenantInternals struct {
 		FetchedObjectsLock      *sync.Mutex
 		RegenerationLock        *sync.Mutex
+		MetadataOverlayLock     *sync.Mutex
 		FetchedObjectsChans     []chan fetchedObjects
 		RegeneratedIndexesChans []chan indexRegeneration
 	}
@@ -141,9 +193,57 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 		Tenants:                map[string]*tenantInternals{},
 		TenantCacheKeyLock:     &sync.Mutex{},
 		CacheInterval:          options.CacheInterval,
+		RetentionRules:         options.RetentionRules,
+		RetentionInterval:      options.RetentionInterval,
+		ProvenanceVerifier:     options.ProvenanceVerifier,
+		RequireSignedCharts:    options.RequireSignedCharts,
+		SignedOnlyRepos:        options.SignedOnlyRepos,
+		StagingTimeout:         options.StagingTimeout,
+		Webhooks:               options.Webhooks,
+		AuditStore:             options.AuditStore,
+		StorageQuota:           options.StorageQuota,
+		StorageQuotas:          options.StorageQuotas,
+		TenantOverrides:        options.TenantOverrides,
+		EnableTenantYAML:       options.EnableTenantYAML,
+		LintPolicy:             options.LintPolicy,
+		UploadPolicies:         options.UploadPolicies,
+		ProtectReleases:        options.ProtectReleases,
+		ProtectedVersions:      options.ProtectedVersions,
+		EnableOCI:              options.EnableOCI,
+		UpstreamProxies:        options.UpstreamProxies,
+		ProxyInterval:          options.ProxyInterval,
+		chartFiles:             newChartFilesCache(options.ChartFilesCacheSize),
+		indexRenditions:        newIndexRenditionsCache(),
+		webhookDeliveries:      newWebhookDeliveryLog(),
+		eventFeed:              newEventFeed(),
+		storageUsage:           newStorageUsageTracker(),
+		storedTenantOverrides:  newTenantOverridesCache(),
+		stagedUploads:          newStagedUploadTracker(),
+	}
+
+	for _, proxy := range server.UpstreamProxies {
+		if err := server.validateRepo(proxy.Repo); err != nil {
+			return nil, fmt.Errorf("invalid proxy repo: %s", err)
+		}
+	}
+
+	// pulls are authorized by the server, so that anonymous-get may be overridden by tenant
+	if authorizer := server.Router.Authorizer; authorizer != nil {
+		for _, action := range authorizer.AnonymousActions {
+			if action == cm_auth.PullAction {
+				server.AnonymousGet = true
+			}
+		}
 	}
 
 	server.Router.SetRoutes(server.Routes())
+	if server.APIEnabled {
+		server.Router.Use(server.chartFilesMiddleware)
+	}
+	if server.EnableOCI {
+		server.ociRoutes = server.OCIRoutes()
+		server.Router.Use(server.ociMiddleware)
+	}
 	err := server.primeCache()
 
 	if options.GenIndex && server.Router.Depth == 0 {
@@ -153,6 +253,9 @@ func NewMultiTenantServer(options MultiTenantServerOptions) (*MultiTenantServer,
 	server.EventChan = make(chan event, server.IndexLimit)
 	go server.startEventListener()
 	server.initCacheTimer()
+	server.initRetentionTimer()
+	server.initStagingSweepTimer()
+	server.initUpstreamProxyTimer()
 
 	return server, err
 }
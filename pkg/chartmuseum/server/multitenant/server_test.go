@@ -17,7 +17,12 @@ limitations under the License.
 package multitenant
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -26,6 +31,7 @@ import (
 	"net/http/httptest"
 	"os"
 	pathutil "path"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -34,9 +40,15 @@ import (
 	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
 	"helm.sh/chartmuseum/pkg/repo"
 
+	"github.com/andybalholm/brotli"
 	"github.com/chartmuseum/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
 )
 
 var maxUploadSize = 1024 * 1024 * 20
@@ -45,6 +57,7 @@ var maxUploadSize = 1024 * 1024 * 20
 var testTarballPath = "../../../../testdata/charts/mychart/mychart-0.1.0.tgz"
 var testTarballPathV2 = "../../../../testdata/charts/mychart/mychart-0.2.0.tgz"
 var testProvfilePath = "../../../../testdata/charts/mychart/mychart-0.1.0.tgz.prov"
+var testKeyringPath = "../../../../testdata/pgp/helm-test-key.pub"
 var otherTestTarballPath = "../../../../testdata/charts/otherchart/otherchart-0.1.0.tgz"
 var otherTestProvfilePath = "../../../../testdata/charts/otherchart/otherchart-0.1.0.tgz.prov"
 var badTestTarballPath = "../../../../testdata/badcharts/mybadchart/mybadchart-1.0.0.tgz"
@@ -825,6 +838,1313 @@ func (suite *MultiTenantServerTestSuite) TestMetrics() {
 	suite.True(strings.Contains(metrics, "chartmuseum_chart_versions_served_total{repo=\"b\"} 0"))
 }
 
+func (suite *MultiTenantServerTestSuite) TestDeprecation() {
+	server := suite.Depth1Server
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	body := bytes.NewBuffer(content)
+	res := suite.doRequest("depth1", "POST", "/api/deprecation/charts", body, "")
+	suite.Equal(201, res.Status(), "201 POST /api/deprecation/charts")
+
+	res = suite.doRequest("depth1", "PUT", "/api/deprecation/charts/mychart/0.1.0/deprecation", nil, "")
+	suite.Equal(200, res.Status(), "200 PUT /api/deprecation/charts/mychart/0.1.0/deprecation")
+
+	res = suite.doRequest("depth1", "PUT", "/api/deprecation/charts/mychart/9.9.9/deprecation", nil, "")
+	suite.Equal(404, res.Status(), "404 PUT /api/deprecation/charts/mychart/9.9.9/deprecation")
+
+	res = suite.doRequest("depth1", "PUT", "/api/deprecation/charts/fakechart/0.1.0/deprecation", nil, "")
+	suite.Equal(404, res.Status(), "404 PUT /api/deprecation/charts/fakechart/0.1.0/deprecation")
+
+	overlay, err := server.getMetadataOverlay("deprecation")
+	suite.Nil(err, "no error reading metadata overlay")
+	suite.True(*overlay.get("mychart", "0.1.0").Deprecated, "deprecation saved in metadata overlay")
+
+	// a full rebuild (e.g. from the cache timer) keeps the deprecation
+	entry := &cacheEntry{RepoName: "deprecation", RepoIndex: server.newRepositoryIndex(log, "deprecation")}
+	objects, err := server.fetchChartsInStorage(log, "deprecation")
+	suite.Nil(err, "no error on fetchChartsInStorage")
+	diff := storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects, server.TimestampTolerance)
+	index, err := server.regenerateRepositoryIndexWorker(log, entry, diff)
+	suite.Nil(err, "no error regenerating repo index")
+	suite.True(index.Entries["mychart"][0].Deprecated, "chart version deprecated after rebuild")
+	suite.Contains(string(index.Raw), "deprecated: true", "index.yaml marks chart version deprecated")
+	suite.NotContains(index.Entries, "metadata", "metadata overlay not indexed as a chart")
+
+	// chart URLs are set on every chart version of a rebuilt index
+	server.ChartURL = "https://chartmuseum.com"
+	entry = &cacheEntry{RepoName: "deprecation", RepoIndex: server.newRepositoryIndex(log, "deprecation")}
+	diff = storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects, server.TimestampTolerance)
+	index, err = server.regenerateRepositoryIndexWorker(log, entry, diff)
+	suite.Nil(err, "no error regenerating repo index with chart URL")
+	suite.Equal([]string{"https://chartmuseum.com/deprecation/charts/mychart-0.1.0.tgz"}, index.Entries["mychart"][0].URLs)
+	server.ChartURL = ""
+
+	res = suite.doRequest("depth1", "DELETE", "/api/deprecation/charts/mychart/0.1.0/deprecation", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/deprecation/charts/mychart/0.1.0/deprecation")
+
+	overlay, err = server.getMetadataOverlay("deprecation")
+	suite.Nil(err, "no error reading metadata overlay")
+	suite.False(*overlay.get("mychart", "0.1.0").Deprecated, "undeprecation saved in metadata overlay")
+
+	res = suite.doRequest("depth1", "DELETE", "/api/deprecation/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/deprecation/charts/mychart/0.1.0")
+
+	overlay, err = server.getMetadataOverlay("deprecation")
+	suite.Nil(err, "no error reading metadata overlay")
+	suite.Nil(overlay.get("mychart", "0.1.0"), "deleted chart version removed from metadata overlay")
+}
+
+func (suite *MultiTenantServerTestSuite) TestPromote() {
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res := suite.doRequest("depth1", "POST", "/api/promote-src/charts", buf, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/promote-src/charts")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote?to=promote-dst", nil, "")
+	suite.Equal(201, res.Status(), "201 POST /api/promote-src/charts/mychart/0.1.0/promote?to=promote-dst")
+
+	res = suite.doRequest("depth1", "GET", "/promote-dst/charts/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /promote-dst/charts/mychart-0.1.0.tgz")
+
+	res = suite.doRequest("depth1", "GET", "/promote-dst/charts/mychart-0.1.0.tgz.prov", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /promote-dst/charts/mychart-0.1.0.tgz.prov")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote?to=promote-dst", nil, "")
+	suite.Equal(409, res.Status(), "409 POST /api/promote-src/charts/mychart/0.1.0/promote?to=promote-dst")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote?to=promote-dst&force", nil, "")
+	suite.Equal(409, res.Status(), "409 POST /api/promote-src/charts/mychart/0.1.0/promote?to=promote-dst&force")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/9.9.9/promote?to=promote-dst", nil, "")
+	suite.Equal(404, res.Status(), "404 POST /api/promote-src/charts/mychart/9.9.9/promote?to=promote-dst")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote", nil, "")
+	suite.Equal(400, res.Status(), "400 POST /api/promote-src/charts/mychart/0.1.0/promote")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote?to=promote-src", nil, "")
+	suite.Equal(400, res.Status(), "400 POST /api/promote-src/charts/mychart/0.1.0/promote?to=promote-src")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote?to=org/team", nil, "")
+	suite.Equal(400, res.Status(), "400 POST /api/promote-src/charts/mychart/0.1.0/promote?to=org/team")
+
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/mychart/0.1.0/promote?to=../promote-dst", nil, "")
+	suite.Equal(400, res.Status(), "400 POST /api/promote-src/charts/mychart/0.1.0/promote?to=../promote-dst")
+
+	// the lint policy of the target repo applies, its findings being returned
+	server := suite.Depth1Server
+	lintPolicy := LintPolicyReject
+	overrides := &TenantOverrides{Repo: "promote-strict", LintPolicy: &lintPolicy}
+	suite.Nil(overrides.compile(), "no error compiling tenant overrides")
+	defer func(tenantOverrides []*TenantOverrides) {
+		server.TenantOverrides = tenantOverrides
+	}(server.TenantOverrides)
+	server.TenantOverrides = []*TenantOverrides{overrides}
+	dir, err := ioutil.TempDir("", "promote")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+	brokenTarballPath, err := saveBrokenChart(dir)
+	suite.Nil(err, "no error saving broken chart")
+	content, err := ioutil.ReadFile(brokenTarballPath)
+	suite.Nil(err, "no error opening broken tarball")
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/promote-src/charts (broken chart)")
+	body := new(bytes.Buffer)
+	res = suite.doRequest("depth1", "POST", "/api/promote-src/charts/broken/0.1.0/promote?to=promote-strict", nil, "", body)
+	suite.Equal(400, res.Status(), "400 POST /api/promote-src/charts/broken/0.1.0/promote?to=promote-strict")
+	var response struct {
+		Error string         `json:"error"`
+		Lint  []*lintMessage `json:"lint"`
+	}
+	suite.Nil(json.Unmarshal(body.Bytes(), &response), "no error decoding response")
+	suite.Contains(response.Error, "broken-0.1.0.tgz failed lint")
+	suite.NotEmpty(response.Lint, "lint findings in response")
+	_, err = server.StorageBackend.GetObject("promote-strict/broken-0.1.0.tgz")
+	suite.NotNil(err, "broken chart not promoted")
+}
+
+func (suite *MultiTenantServerTestSuite) TestChartFiles() {
+	server := suite.Depth1Server
+	server.chartFiles = newChartFilesCache(1024 * 1024)
+	defer func() { server.chartFiles = newChartFilesCache(0) }()
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.doRequest("depth1", "POST", "/api/files/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/files/charts")
+
+	buffer := bytes.NewBufferString("")
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/files", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/files/charts/mychart/0.1.0/files")
+	suite.Contains(buffer.String(), `"templates/pod.yaml"`, "file list contains template")
+
+	buffer = bytes.NewBufferString("")
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/files/Chart.yaml", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/files/charts/mychart/0.1.0/files/Chart.yaml")
+	suite.Contains(buffer.String(), "name: mychart", "Chart.yaml returned")
+
+	buffer = bytes.NewBufferString("")
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/files/templates/pod.yaml", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/files/charts/mychart/0.1.0/files/templates/pod.yaml")
+	suite.Contains(buffer.String(), "kind: Pod", "template returned")
+
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	chartVersion, httpErr := server.getChartVersion(log, "files", "mychart", "0.1.0", false)
+	suite.Nil(httpErr, "no error getting chart version")
+	key := chartFilesCacheKey("files", "mychart", "0.1.0")
+	_, cached := server.chartFiles.get(key, chartVersion.Digest)
+	suite.True(cached, "chart files cached after first request")
+	_, cached = server.chartFiles.get(key, "otherdigest")
+	suite.False(cached, "cached chart files dropped when package digest changes")
+	server.chartFiles.add(key, chartVersion.Digest, nil)
+	largeFiles := []*chart.File{{Name: "values.yaml", Data: make([]byte, 1024*1024)}}
+	server.chartFiles.add("files/largechart-0.1.0.tgz", "", largeFiles)
+	_, cached = server.chartFiles.get("files/largechart-0.1.0.tgz", "")
+	suite.False(cached, "chart files larger than the cache not cached")
+	_, cached = server.chartFiles.get(key, chartVersion.Digest)
+	suite.True(cached, "chart files kept when larger ones are not cached")
+	halfFiles := []*chart.File{{Name: "values.yaml", Data: make([]byte, 512*1024)}}
+	server.chartFiles.add("files/otherchart-0.1.0.tgz", "", halfFiles)
+	server.chartFiles.add("files/otherchart-0.2.0.tgz", "", halfFiles)
+	_, cached = server.chartFiles.get(key, chartVersion.Digest)
+	suite.False(cached, "least recently used chart files evicted")
+	_, cached = server.chartFiles.get("files/otherchart-0.2.0.tgz", "")
+	suite.True(cached, "most recently used chart files kept")
+
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/latest/files/../Chart.yaml", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /api/files/charts/mychart/latest/files/../Chart.yaml")
+
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/files/nothing.yaml", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/files/charts/mychart/0.1.0/files/nothing.yaml")
+
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/files/values.yaml", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/files/charts/mychart/0.1.0/files/values.yaml")
+
+	res = suite.doRequest("depth2", "GET", "/api/org1/team1/charts/mychart/0.1.0/files/Chart.yaml", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /api/org1/team1/charts/mychart/0.1.0/files/Chart.yaml")
+
+	buffer = bytes.NewBufferString("")
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/templates", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/files/charts/mychart/0.1.0/templates")
+	var templates []*ChartFile
+	err = json.Unmarshal(buffer.Bytes(), &templates)
+	suite.Nil(err, "no error unmarshalling templates")
+	suite.Len(templates, 1, "one template in chart")
+
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/0.1.0/readme", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/files/charts/mychart/0.1.0/readme")
+
+	res = suite.doRequest("depth1", "GET", "/api/files/charts/mychart/9.9.9/files/values.yaml", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/files/charts/mychart/9.9.9/files/values.yaml")
+}
+
+func (suite *MultiTenantServerTestSuite) TestDependencies() {
+	buffer := bytes.NewBufferString("")
+	res := suite.doRequest("depth2", "GET", "/api/org1/team1/charts/mychart/0.1.0/dependencies?repos=org1/team2,org2/team1", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/org1/team1/charts/mychart/0.1.0/dependencies")
+	suite.Contains(buffer.String(), `"dependencies":[]`, "chart without dependencies")
+
+	res = suite.doRequest("depth2", "GET", "/api/org1/team1/charts/mychart/9.9.9/dependencies", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/org1/team1/charts/mychart/9.9.9/dependencies")
+
+	res = suite.doRequest("depth2", "GET", "/api/org1/team1/charts/mychart/0.1.0/dependencies?repos=org1", nil, "")
+	suite.Equal(400, res.Status(), "400 GET /api/org1/team1/charts/mychart/0.1.0/dependencies?repos=org1")
+
+	buffer = bytes.NewBufferString("")
+	res = suite.doRequest("depth2", "GET", "/api/org1/team1/dependents/mychart?repos=*", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/org1/team1/dependents/mychart?repos=*")
+	suite.Equal("[]", buffer.String(), "no dependents of mychart")
+
+	res = suite.doRequest("depth2", "GET", "/api/org1/team1/dependents/mychart?version=bogus", nil, "")
+	suite.Equal(400, res.Status(), "400 GET /api/org1/team1/dependents/mychart?version=bogus")
+}
+
+func (suite *MultiTenantServerTestSuite) TestRepos() {
+	buffer := bytes.NewBufferString("")
+	res := suite.doRequest("depth2", "GET", "/api/repos", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/repos")
+
+	var repos []*RepoSummary
+	err := json.Unmarshal(buffer.Bytes(), &repos)
+	suite.Nil(err, "no error unmarshalling repos")
+
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+		if repo.Name == "org3/team3" {
+			suite.Equal(1, repo.Charts, "chart count of org3/team3")
+			suite.Equal(1, repo.Versions, "version count of org3/team3")
+			suite.NotNil(repo.LastUpdated, "last updated time of org3/team3")
+		}
+	}
+	for org, teams := range suite.StorageDirectory {
+		for team := range teams {
+			suite.Contains(names, fmt.Sprintf("%s/%s", org, team), "tenant discovered from storage")
+		}
+	}
+
+	buffer = bytes.NewBufferString("")
+	res = suite.doRequest("depth2", "GET", "/api/repos?offset=1&limit=2", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/repos?offset=1&limit=2")
+	var page []*RepoSummary
+	err = json.Unmarshal(buffer.Bytes(), &page)
+	suite.Nil(err, "no error unmarshalling repos")
+	suite.Len(page, 2, "one page of repos")
+	suite.Equal(names[1], page[0].Name, "page starting at offset")
+
+	res = suite.doRequest("depth2", "GET", "/api/repos?limit=0", nil, "")
+	suite.Equal(400, res.Status(), "400 GET /api/repos?limit=0")
+
+	buffer = bytes.NewBufferString("")
+	res = suite.doRequest("depth0", "GET", "/api/repos", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/repos")
+	suite.Contains(buffer.String(), `"name":""`, "single tenant listed at depth 0")
+}
+
+func (suite *MultiTenantServerTestSuite) TestRetention() {
+	server := suite.Depth1Server
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+
+	// added to storage directly, so the index is not built from upload events still being processed
+	for _, path := range []string{testTarballPath, testTarballPathV2} {
+		content, err := ioutil.ReadFile(path)
+		suite.Nil(err, "no error opening test tarball")
+		err = server.StorageBackend.PutObject(pathutil.Join("retention", pathutil.Base(path)), content)
+		suite.Nil(err, "no error adding chart package to storage")
+	}
+
+	res := suite.doRequest("depth1", "GET", "/api/retention/retention", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /api/retention/retention")
+
+	rule := &RetentionRule{Repo: "retention", KeepLatest: 1}
+	suite.Nil(rule.compile(), "no error compiling retention rule")
+	server.RetentionRules = []*RetentionRule{rule}
+	defer func() { server.RetentionRules = nil }()
+
+	buffer := bytes.NewBufferString("")
+	res = suite.doRequest("depth1", "GET", "/api/retention/retention", nil, "", buffer)
+	suite.Equal(200, res.Status(), "200 GET /api/retention/retention")
+	var candidates []*RetentionCandidate
+	err := json.Unmarshal(buffer.Bytes(), &candidates)
+	suite.Nil(err, "no error unmarshalling retention candidates")
+	suite.Len(candidates, 1, "one chart version exceeds keepLatest")
+	suite.Equal("0.1.0", candidates[0].Version, "oldest chart version is a retention candidate")
+
+	_, err = server.StorageBackend.GetObject("retention/mychart-0.1.0.tgz")
+	suite.Nil(err, "chart version still in storage after dry run")
+
+	server.pruneRepository(log, "retention")
+	_, err = server.StorageBackend.GetObject("retention/mychart-0.1.0.tgz")
+	suite.NotNil(err, "pruned chart version removed from storage")
+	_, err = server.StorageBackend.GetObject("retention/mychart-0.2.0.tgz")
+	suite.Nil(err, "newest chart version kept in storage")
+}
+
+func (suite *MultiTenantServerTestSuite) TestProvenanceVerification() {
+	server := suite.Depth1Server
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	verifier, err := provenance.NewFromKeyring(testKeyringPath, "")
+	suite.Nil(err, "no error loading test keyring")
+	server.ProvenanceVerifier = verifier
+	defer func() { server.ProvenanceVerifier = nil }()
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	provContent, err := ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	forgedContent := bytes.Replace(provContent, []byte("apiVersion: v1"), []byte("apiVersion: v2"), 1)
+	forgedProvfile, err := ioutil.TempFile("", "mychart-0.1.0.tgz.prov")
+	suite.Nil(err, "no error creating forged provenance file")
+	defer os.Remove(forgedProvfile.Name())
+	_, err = forgedProvfile.Write(forgedContent)
+	suite.Nil(err, "no error writing forged provenance file")
+	forgedProvfile.Close()
+
+	res := suite.doRequest("depth1", "POST", "/api/signed/prov", bytes.NewBuffer(provContent), "")
+	suite.Equal(400, res.Status(), "400 POST /api/signed/prov before chart package")
+
+	res = suite.doRequest("depth1", "POST", "/api/signed/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/signed/charts")
+
+	res = suite.doRequest("depth1", "POST", "/api/signed/prov", bytes.NewBuffer(forgedContent), "")
+	suite.Equal(400, res.Status(), "400 POST /api/signed/prov with forged provenance file")
+
+	res = suite.doRequest("depth1", "POST", "/api/signed/prov", bytes.NewBuffer(provContent), "")
+	suite.Equal(201, res.Status(), "201 POST /api/signed/prov")
+
+	overlay, err := server.getMetadataOverlay("signed")
+	suite.Nil(err, "no error reading metadata overlay")
+	record := overlay.get("mychart", "0.1.0").Provenance
+	suite.NotNil(record, "provenance saved in metadata overlay")
+	suite.Contains(record.SignedBy, "helm-test", "signer identity recorded")
+	suite.NotEmpty(record.KeyID, "signer key recorded")
+
+	// the signer is added to the index, and dropped if the package changes
+	entry := &cacheEntry{RepoName: "signed", RepoIndex: server.newRepositoryIndex(log, "signed")}
+	objects, err := server.fetchChartsInStorage(log, "signed")
+	suite.Nil(err, "no error on fetchChartsInStorage")
+	diff := storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects, server.TimestampTolerance)
+	index, err := server.regenerateRepositoryIndexWorker(log, entry, diff)
+	suite.Nil(err, "no error regenerating repo index")
+	chartVersion := index.Entries["mychart"][0]
+	suite.Equal(record.SignedBy, chartVersion.Annotations[SignedByAnnotation], "signer identity in index")
+	chartVersion.Digest = "otherdigest"
+	suite.True(record.apply(chartVersion), "signer annotation removed when digest changes")
+	suite.NotContains(chartVersion.Annotations, SignedByAnnotation, "signer annotation removed when digest changes")
+
+	body, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, forgedProvfile.Name()})
+	res = suite.doRequest("depth1", "POST", "/api/signedform/charts", body, w.FormDataContentType())
+	suite.Equal(400, res.Status(), "400 POST /api/signedform/charts with forged provenance file")
+	res = suite.doRequest("depth1", "GET", "/signedform/charts/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(404, res.Status(), "chart package not stored with forged provenance file")
+
+	body, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = suite.doRequest("depth1", "POST", "/api/signedform/charts", body, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/signedform/charts")
+
+	overlay, err = server.getMetadataOverlay("signedform")
+	suite.Nil(err, "no error reading metadata overlay")
+	suite.NotNil(overlay.get("mychart", "0.1.0"), "provenance saved in metadata overlay")
+}
+
+func (suite *MultiTenantServerTestSuite) TestSignedOnlyRepos() {
+	server := suite.Depth1Server
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	verifier, err := provenance.NewFromKeyring(testKeyringPath, "")
+	suite.Nil(err, "no error loading test keyring")
+	server.ProvenanceVerifier = verifier
+	server.SignedOnlyRepos = []string{"signedonly*"}
+	defer func() {
+		server.ProvenanceVerifier = nil
+		server.SignedOnlyRepos = nil
+	}()
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.doRequest("depth1", "POST", "/api/signedonly/charts", bytes.NewBuffer(content), "")
+	suite.Equal(400, res.Status(), "400 POST /api/signedonly/charts without provenance file")
+
+	body, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPath})
+	res = suite.doRequest("depth1", "POST", "/api/signedonly/charts", body, w.FormDataContentType())
+	suite.Equal(400, res.Status(), "400 POST /api/signedonly/charts multipart without provenance file")
+
+	body, w = suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = suite.doRequest("depth1", "POST", "/api/signedonly/charts", body, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/signedonly/charts")
+
+	res = suite.doRequest("depth1", "POST", "/api/unsigned/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/unsigned/charts")
+	res = suite.doRequest("depth1", "POST", "/api/unsigned/charts/mychart/0.1.0/promote?to=signedonly-dst", nil, "")
+	suite.Equal(400, res.Status(), "400 POST /api/unsigned/charts/mychart/0.1.0/promote?to=signedonly-dst")
+
+	// chart versions added to storage directly are hidden from the index, and not served
+	contentV2, err := ioutil.ReadFile(testTarballPathV2)
+	suite.Nil(err, "no error opening test tarball")
+	err = server.StorageBackend.PutObject("signedonly/mychart-0.2.0.tgz", contentV2)
+	suite.Nil(err, "no error adding unsigned chart package to storage")
+	entry := &cacheEntry{RepoName: "signedonly", RepoIndex: server.newRepositoryIndex(log, "signedonly")}
+	objects, err := server.fetchChartsInStorage(log, "signedonly")
+	suite.Nil(err, "no error on fetchChartsInStorage")
+	diff := storage.GetObjectSliceDiff(server.getRepoObjectSlice(entry), objects, server.TimestampTolerance)
+	index, err := server.regenerateRepositoryIndexWorker(log, entry, diff)
+	suite.Nil(err, "no error regenerating repo index")
+	suite.Len(index.Entries["mychart"], 1, "unsigned chart version hidden from index entries")
+	suite.Contains(string(index.Raw), "version: 0.1.0", "signed chart version in index.yaml")
+	suite.NotContains(string(index.Raw), "version: 0.2.0", "unsigned chart version hidden from index.yaml")
+
+	res = suite.doRequest("depth1", "GET", "/api/signedonly/charts/mychart/0.2.0", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/signedonly/charts/mychart/0.2.0")
+	res = suite.doRequest("depth1", "GET", "/signedonly/charts/mychart-0.2.0.tgz", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /signedonly/charts/mychart-0.2.0.tgz")
+	res = suite.doRequest("depth1", "GET", "/signedonly/charts/mychart-0.1.0.tgz", nil, "")
+	suite.Equal(200, res.Status(), "200 GET /signedonly/charts/mychart-0.1.0.tgz")
+
+	// shown once its provenance file is uploaded
+	provContentV2, err := ioutil.ReadFile(testTarballPathV2 + ".prov")
+	suite.Nil(err, "no error opening test provenance file")
+	res = suite.doRequest("depth1", "POST", "/api/signedonly/prov", bytes.NewBuffer(provContentV2), "")
+	suite.Equal(201, res.Status(), "201 POST /api/signedonly/prov")
+	suite.Eventually(func() bool {
+		return suite.doRequest("depth1", "GET", "/api/signedonly/charts/mychart/0.2.0", nil, "").Status() == 200
+	}, 5*time.Second, 10*time.Millisecond, "signed chart version shown")
+}
+
+func (suite *MultiTenantServerTestSuite) TestConditionalRequests() {
+	server := suite.Depth1Server
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	err = server.StorageBackend.PutObject("conditional/mychart-0.1.0.tgz", content)
+	suite.Nil(err, "no error adding chart package to storage")
+
+	doConditionalRequest := func(urlStr string, header string, value string) gin.ResponseWriter {
+		res, _ := suite.doRequestWithHeader(server, "GET", urlStr, header, value)
+		return res
+	}
+
+	res := doConditionalRequest("/conditional/index.yaml", "", "")
+	suite.Equal(200, res.Status(), "200 GET /conditional/index.yaml")
+	etag := res.Header().Get("ETag")
+	lastModified := res.Header().Get("Last-Modified")
+	suite.True(strings.HasPrefix(etag, `W/"`), "weak ETag set on index.yaml")
+	suite.NotEmpty(lastModified, "Last-Modified set on index.yaml")
+
+	res = doConditionalRequest("/conditional/index.yaml", "If-None-Match", etag)
+	suite.Equal(304, res.Status(), "304 GET /conditional/index.yaml with matching If-None-Match")
+	res = doConditionalRequest("/conditional/index.yaml", "If-None-Match", `"other", `+strings.TrimPrefix(etag, "W/"))
+	suite.Equal(304, res.Status(), "304 GET /conditional/index.yaml with matching strong If-None-Match")
+	res = doConditionalRequest("/conditional/index.yaml", "If-None-Match", `"other"`)
+	suite.Equal(200, res.Status(), "200 GET /conditional/index.yaml with other If-None-Match")
+	res = doConditionalRequest("/conditional/index.yaml", "If-Modified-Since", lastModified)
+	suite.Equal(304, res.Status(), "304 GET /conditional/index.yaml with If-Modified-Since")
+	res = doConditionalRequest("/conditional/index.yaml", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	suite.Equal(200, res.Status(), "200 GET /conditional/index.yaml modified since")
+
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	chartVersion, httpErr := server.getChartVersion(log, "conditional", "mychart", "0.1.0", false)
+	suite.Nil(httpErr, "no error getting chart version")
+	res = doConditionalRequest("/conditional/charts/mychart-0.1.0.tgz", "", "")
+	suite.Equal(200, res.Status(), "200 GET /conditional/charts/mychart-0.1.0.tgz")
+	suite.Equal(`"`+chartVersion.Digest+`"`, res.Header().Get("ETag"), "chart package ETag is its digest")
+	suite.NotEmpty(res.Header().Get("Last-Modified"), "Last-Modified set on chart package")
+	res = doConditionalRequest("/conditional/charts/mychart-0.1.0.tgz", "If-None-Match", `"`+chartVersion.Digest+`"`)
+	suite.Equal(304, res.Status(), "304 GET /conditional/charts/mychart-0.1.0.tgz with matching If-None-Match")
+
+	// added to storage, not indexed yet
+	err = server.StorageBackend.PutObject("conditional/otherchart-0.1.0.tgz", content)
+	suite.Nil(err, "no error adding chart package to storage")
+	res = doConditionalRequest("/conditional/charts/otherchart-0.1.0.tgz", "", "")
+	suite.Equal(200, res.Status(), "200 GET /conditional/charts/otherchart-0.1.0.tgz")
+	etag = res.Header().Get("ETag")
+	suite.True(strings.HasPrefix(etag, `W/"`), "weak ETag set on chart package not indexed")
+	res = doConditionalRequest("/conditional/charts/otherchart-0.1.0.tgz", "If-None-Match", etag)
+	suite.Equal(304, res.Status(), "304 GET /conditional/charts/otherchart-0.1.0.tgz with matching If-None-Match")
+
+	raw := []byte("apiVersion: v1\nentries: {}\ngenerated: \"2021-01-01T00:00:00Z\"\nserverInfo: {}\n")
+	regenerated := bytes.Replace(raw, []byte("2021-01-01"), []byte("2021-01-02"), 1)
+	suite.Equal(indexETag(raw), indexETag(regenerated), "index ETag ignores generated timestamp")
+	changed := bytes.Replace(raw, []byte("entries: {}"), []byte("entries: []"), 1)
+	suite.NotEqual(indexETag(raw), indexETag(changed), "index ETag changes with content")
+}
+
+func (suite *MultiTenantServerTestSuite) TestIndexRenditions() {
+	server := suite.Depth1Server
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	err = server.StorageBackend.PutObject("renditions/mychart-0.1.0.tgz", content)
+	suite.Nil(err, "no error adding chart package to storage")
+
+	res, body := suite.doRequestWithHeader(server, "GET", "/renditions/index.yaml", "", "")
+	suite.Equal(200, res.Status(), "200 GET /renditions/index.yaml")
+	suite.Empty(res.Header().Get("Content-Encoding"), "index.yaml not compressed")
+	raw := body.Bytes()
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/renditions/index.yaml", "Accept-Encoding", "gzip, deflate")
+	suite.Equal(200, res.Status(), "200 GET /renditions/index.yaml gzip")
+	suite.Equal("gzip", res.Header().Get("Content-Encoding"), "index.yaml gzip-compressed")
+	gzipETag := res.Header().Get("ETag")
+	reader, err := gzip.NewReader(body)
+	suite.Nil(err, "no error reading gzip-compressed index.yaml")
+	uncompressed, err := ioutil.ReadAll(reader)
+	suite.Nil(err, "no error reading gzip-compressed index.yaml")
+	suite.Equal(raw, uncompressed, "gzip-compressed index.yaml matches index.yaml")
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/renditions/index.yaml", "Accept-Encoding", "gzip, br")
+	suite.Equal("br", res.Header().Get("Content-Encoding"), "index.yaml brotli-compressed")
+	suite.NotEqual(gzipETag, res.Header().Get("ETag"), "one ETag per encoding")
+	uncompressed, err = ioutil.ReadAll(brotli.NewReader(body))
+	suite.Nil(err, "no error reading brotli-compressed index.yaml")
+	suite.Equal(raw, uncompressed, "brotli-compressed index.yaml matches index.yaml")
+
+	res, _ = suite.doRequestWithHeader(server, "GET", "/renditions/index.yaml", "Accept-Encoding", "br;q=0, gzip;q=0.5")
+	suite.Equal("gzip", res.Header().Get("Content-Encoding"), "refused encoding not used")
+
+	res, _ = suite.doRequestWithHeader(server, "GET", "/renditions/index.yaml", "If-None-Match", gzipETag)
+	suite.Equal(200, res.Status(), "200 GET /renditions/index.yaml with ETag of another encoding")
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/renditions/index.json", "", "")
+	suite.Equal(200, res.Status(), "200 GET /renditions/index.json")
+	suite.Equal("application/json", res.Header().Get("Content-Type"), "index.json content type")
+	var indexFile helm_repo.IndexFile
+	err = json.Unmarshal(body.Bytes(), &indexFile)
+	suite.Nil(err, "no error unmarshalling index.json")
+	suite.Len(indexFile.Entries["mychart"], 1, "chart version in index.json")
+
+	res, _ = suite.doRequestWithHeader(server, "GET", "/renditions/index.json", "Accept-Encoding", "gzip")
+	suite.Equal("gzip", res.Header().Get("Content-Encoding"), "index.json gzip-compressed")
+
+	// renditions are only computed once requested
+	entry, err := server.initCacheEntry(server.Logger.ContextLoggingFn(&gin.Context{}), "renditions")
+	suite.Nil(err, "no error getting cache entry")
+	suite.Equal(indexETag(raw), entry.RepoIndexETag, "ETag computed when the index was regenerated")
+	renditions := server.indexRenditions.get("renditions", entry.RepoIndexETag, raw)
+	suite.Contains(renditions.contents, "json-gzip", "requested rendition kept in memory")
+	suite.NotContains(renditions.contents, "json-br", "rendition never requested not computed")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStorageObjectStreaming() {
+	server := suite.Depth1Server
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	err = server.StorageBackend.PutObject("streaming/mychart-0.1.0.tgz", content)
+	suite.Nil(err, "no error adding chart package to storage")
+	provContent, err := ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	err = server.StorageBackend.PutObject("streaming/mychart-0.1.0.tgz.prov", provContent)
+	suite.Nil(err, "no error adding provenance file to storage")
+
+	res, body := suite.doRequestWithHeader(server, "GET", "/streaming/charts/mychart-0.1.0.tgz", "", "")
+	suite.Equal(200, res.Status(), "200 GET /streaming/charts/mychart-0.1.0.tgz")
+	suite.Equal(fmt.Sprint(len(content)), res.Header().Get("Content-Length"), "Content-Length set")
+	suite.Equal("application/x-tar", res.Header().Get("Content-Type"), "chart package content type")
+	suite.Equal(content, body.Bytes(), "chart package streamed")
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/streaming/charts/mychart-0.1.0.tgz", "Range", "bytes=10-19")
+	suite.Equal(206, res.Status(), "206 GET /streaming/charts/mychart-0.1.0.tgz with Range")
+	suite.Equal(fmt.Sprintf("bytes 10-19/%d", len(content)), res.Header().Get("Content-Range"), "Content-Range set")
+	suite.Equal(content[10:20], body.Bytes(), "requested range streamed")
+
+	res, body = suite.doRequestWithHeader(server, "HEAD", "/streaming/charts/mychart-0.1.0.tgz", "", "")
+	suite.Equal(200, res.Status(), "200 HEAD /streaming/charts/mychart-0.1.0.tgz")
+	suite.Equal(fmt.Sprint(len(content)), res.Header().Get("Content-Length"), "Content-Length set on HEAD")
+	suite.Empty(body.Bytes(), "no content on HEAD")
+
+	res, _ = suite.doRequestWithHeader(server, "HEAD", "/streaming/charts/mychart-9.9.9.tgz", "", "")
+	suite.Equal(404, res.Status(), "404 HEAD /streaming/charts/mychart-9.9.9.tgz")
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/streaming/charts/mychart-0.1.0.tgz.prov", "", "")
+	suite.Equal(200, res.Status(), "200 GET /streaming/charts/mychart-0.1.0.tgz.prov")
+	suite.Equal(fmt.Sprintf(`"%x"`, sha256.Sum256(provContent)), res.Header().Get("ETag"), "provenance file ETag is its digest")
+	suite.Equal(provContent, body.Bytes(), "provenance file streamed")
+
+	// backends which cannot stream objects are read in memory
+	type bufferedBackend struct{ storage.Backend }
+	reader, _, err := openStorageObject(bufferedBackend{server.StorageBackend}, "streaming/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error opening object from buffered backend")
+	buffered, err := ioutil.ReadAll(reader)
+	suite.Nil(err, "no error reading object from buffered backend")
+	suite.Equal(content, buffered, "object read from buffered backend")
+	suite.Nil(reader.Close(), "no error closing object from buffered backend")
+}
+
+func (suite *MultiTenantServerTestSuite) TestSpooledUploads() {
+	server := suite.Depth1Server
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+
+	// uploads are spooled in the temporary directory, and removed once handled
+	tmpDir, err := ioutil.TempDir(suite.TempDirectory, "spool")
+	suite.Nil(err, "no error creating spool directory")
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	res := suite.doRequest("depth1", "POST", "/api/spooled/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/spooled/charts")
+	object, err := server.StorageBackend.GetObject("spooled/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error getting uploaded chart package")
+	suite.Equal(content, object.Content, "chart package stored")
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res = suite.doRequest("depth1", "POST", "/api/spooledform/charts", buf, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/spooledform/charts")
+	object, err = server.StorageBackend.GetObject("spooledform/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error getting uploaded chart package")
+	suite.Equal(content, object.Content, "chart package stored from form")
+	_, err = server.StorageBackend.GetObject("spooledform/mychart-0.1.0.tgz.prov")
+	suite.Nil(err, "no error getting uploaded provenance file")
+
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testProvfilePath})
+	res = suite.doRequest("depth1", "POST", "/api/spooledform/charts", buf, w.FormDataContentType())
+	suite.Equal(400, res.Status(), "400 POST /api/spooledform/charts with invalid chart package")
+
+	leftovers, err := ioutil.ReadDir(tmpDir)
+	suite.Nil(err, "no error reading spool directory")
+	suite.Empty(leftovers, "spooled uploads removed")
+
+	// the chart package is parsed once, when received
+	chartPackage, err := spoolChartPackage(bytes.NewReader(content), time.Now())
+	suite.Nil(err, "no error spooling chart package")
+	defer chartPackage.remove()
+	chartVersion, err := repo.ChartVersionFromStorageObject(storage.Object{Path: "mychart-0.1.0.tgz", Content: content})
+	suite.Nil(err, "no error parsing chart package")
+	suite.Equal("mychart-0.1.0.tgz", chartPackage.filename, "chart package named after its chart version")
+	suite.Equal(chartVersion.Digest, chartPackage.chartVersion.Digest, "chart package digest")
+	suite.Equal(chartVersion.URLs, chartPackage.chartVersion.URLs, "chart package URLs")
+	suite.Equal(int64(len(content)), chartPackage.size, "chart package size")
+
+	// backends which cannot stream objects are given the content in memory
+	type bufferedBackend struct{ storage.Backend }
+	err = putStorageFile(bufferedBackend{server.StorageBackend}, "spooledbuffered/mychart-0.1.0.tgz", chartPackage.spooledFile)
+	suite.Nil(err, "no error storing chart package in buffered backend")
+	object, err = server.StorageBackend.GetObject("spooledbuffered/mychart-0.1.0.tgz")
+	suite.Nil(err, "no error getting chart package stored in buffered backend")
+	suite.Equal(content, object.Content, "chart package stored in buffered backend")
+}
+
+// failingMoveBackend fails the nth move of an object, to test the rollback of staged uploads
+type failingMoveBackend struct {
+	storage.Backend
+	moves  *int
+	failAt int
+}
+
+func (b failingMoveBackend) MoveObject(from string, to string) error {
+	*b.moves++
+	if *b.moves == b.failAt {
+		return fmt.Errorf("cannot move %s", from)
+	}
+	return moveStorageObject(b.Backend, from, to)
+}
+
+func (suite *MultiTenantServerTestSuite) TestStagedUploads() {
+	server := suite.Depth1Server
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{testTarballPath, testProvfilePath})
+	res := suite.doRequest("depth1", "POST", "/api/staged/charts", buf, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/staged/charts")
+	_, err := server.StorageBackend.GetObject("staged/mychart-0.1.0.tgz")
+	suite.Nil(err, "chart package published")
+	_, err = server.StorageBackend.GetObject("staged/mychart-0.1.0.tgz.prov")
+	suite.Nil(err, "provenance file published")
+	staged, err := server.StorageBackend.ListObjects("staged/" + stagingPrefix)
+	suite.Nil(err, "no error listing staged files")
+	suite.Empty(staged, "no staged files left after publishing")
+	objects, err := server.StorageBackend.ListObjects("staged")
+	suite.Nil(err, "no error listing repo")
+	suite.Len(objects, 2, "staged files not listed in repo")
+
+	// a failure to publish one file rolls back the whole upload
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	provContent, err := ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	chartPackage, err := spoolChartPackage(bytes.NewReader(content), time.Now())
+	suite.Nil(err, "no error spooling chart package")
+	defer chartPackage.remove()
+
+	// the chart package is published, then publishing the provenance file fails
+	failingServer := *server
+	failingServer.StorageBackend = failingMoveBackend{Backend: server.StorageBackend, moves: new(int), failAt: 2}
+	upload := failingServer.newStagedUpload("stagedrollback")
+	err = upload.stage(&chartOrProvenanceFile{filename: chartPackage.filename, field: defaultFormField, chart: chartPackage})
+	suite.Nil(err, "no error staging chart package")
+	err = upload.stage(&chartOrProvenanceFile{filename: "mychart-0.1.0.tgz.prov", content: provContent, field: defaultProvField})
+	suite.Nil(err, "no error staging provenance file")
+	suite.NotNil(upload.publish(), "error publishing provenance file")
+	objects, err = server.StorageBackend.ListObjects("stagedrollback")
+	suite.Nil(err, "no error listing repo")
+	suite.Empty(objects, "published chart package rolled back")
+	staged, err = server.StorageBackend.ListObjects("stagedrollback/" + stagingPrefix)
+	suite.Nil(err, "no error listing staged files")
+	suite.Empty(staged, "staged files removed after rollback")
+
+	// the files replaced by the upload are restored, whichever move fails: each file is moved aside, then published
+	for _, failAt := range []int{1, 2, 3, 4} {
+		err = server.StorageBackend.PutObject("stagedoverwrite/mychart-0.1.0.tgz", []byte("previous chart package"))
+		suite.Nil(err, "no error storing previous chart package")
+		err = server.StorageBackend.PutObject("stagedoverwrite/mychart-0.1.0.tgz.prov", []byte("previous provenance file"))
+		suite.Nil(err, "no error storing previous provenance file")
+		failingServer.StorageBackend = failingMoveBackend{Backend: server.StorageBackend, moves: new(int), failAt: failAt}
+		upload = failingServer.newStagedUpload("stagedoverwrite")
+		err = upload.stage(&chartOrProvenanceFile{filename: chartPackage.filename, field: defaultFormField, chart: chartPackage})
+		suite.Nil(err, "no error staging chart package")
+		err = upload.stage(&chartOrProvenanceFile{filename: "mychart-0.1.0.tgz.prov", content: provContent, field: defaultProvField})
+		suite.Nil(err, "no error staging provenance file")
+		suite.NotNil(upload.publish(), "error publishing on move %d", failAt)
+		object, err := server.StorageBackend.GetObject("stagedoverwrite/mychart-0.1.0.tgz")
+		suite.Nil(err, "chart package restored on move %d", failAt)
+		suite.Equal("previous chart package", string(object.Content), "chart package restored on move %d", failAt)
+		object, err = server.StorageBackend.GetObject("stagedoverwrite/mychart-0.1.0.tgz.prov")
+		suite.Nil(err, "provenance file restored on move %d", failAt)
+		suite.Equal("previous provenance file", string(object.Content), "provenance file restored on move %d", failAt)
+		staged, err = server.StorageBackend.ListObjects("stagedoverwrite/" + stagingPrefix)
+		suite.Nil(err, "no error listing staged files")
+		suite.Empty(staged, "staged files removed after rollback on move %d", failAt)
+	}
+
+	// replaced files are deleted once the upload is published
+	failingServer.StorageBackend = failingMoveBackend{Backend: server.StorageBackend, moves: new(int)}
+	upload = failingServer.newStagedUpload("stagedoverwrite")
+	err = upload.stage(&chartOrProvenanceFile{filename: chartPackage.filename, field: defaultFormField, chart: chartPackage})
+	suite.Nil(err, "no error staging chart package")
+	suite.Nil(upload.publish(), "no error publishing over previous chart package")
+	object, err := server.StorageBackend.GetObject("stagedoverwrite/mychart-0.1.0.tgz")
+	suite.Nil(err, "chart package published")
+	suite.Equal(content, object.Content, "chart package replaced")
+	staged, err = server.StorageBackend.ListObjects("stagedoverwrite/" + stagingPrefix)
+	suite.Nil(err, "no error listing staged files")
+	suite.Empty(staged, "replaced file removed after publishing")
+
+	// files staged by interrupted uploads are swept once they expire
+	err = server.StorageBackend.PutObject("stagedsweep/.staging/0123456789abcdef-mychart-0.1.0.tgz", content)
+	suite.Nil(err, "no error staging old file")
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(pathutil.Join(suite.TempDirectory, "stagedsweep/.staging/0123456789abcdef-mychart-0.1.0.tgz"), old, old)
+	suite.Nil(err, "no error aging staged file")
+	err = server.StorageBackend.PutObject("stagedsweep/.staging/fedcba9876543210-mychart-0.1.0.tgz", content)
+	suite.Nil(err, "no error staging recent file")
+
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	defer func(timeout time.Duration) { server.StagingTimeout = timeout }(server.StagingTimeout)
+	server.StagingTimeout = time.Hour
+	server.sweepStagedUploadsOfRepo(log, "stagedsweep")
+	staged, err = server.StorageBackend.ListObjects("stagedsweep/" + stagingPrefix)
+	suite.Nil(err, "no error listing staged files")
+	suite.Len(staged, 1, "expired staged file swept")
+	suite.Equal("fedcba9876543210-mychart-0.1.0.tgz", staged[0].Path, "recent staged file kept")
+
+	// the files of an upload in progress are never swept, and a file moved aside is not taken for an expired one
+	err = server.StorageBackend.PutObject("stagedlive/mychart-0.1.0.tgz", []byte("previous chart package"))
+	suite.Nil(err, "no error storing previous chart package")
+	err = os.Chtimes(pathutil.Join(suite.TempDirectory, "stagedlive/mychart-0.1.0.tgz"), old, old)
+	suite.Nil(err, "no error aging previous chart package")
+	upload = server.newStagedUpload("stagedlive")
+	err = upload.stage(&chartOrProvenanceFile{filename: chartPackage.filename, field: defaultFormField, chart: chartPackage})
+	suite.Nil(err, "no error staging chart package")
+	err = os.Chtimes(pathutil.Join(suite.TempDirectory, upload.stagingPath(chartPackage.filename)), old, old)
+	suite.Nil(err, "no error aging staged file")
+	suite.Nil(upload.moveAside(chartPackage.filename), "no error moving previous chart package aside")
+	object, err = server.StorageBackend.GetObject(upload.replacedPath(chartPackage.filename))
+	suite.Nil(err, "previous chart package moved aside")
+	suite.True(object.LastModified.After(old.Add(time.Hour)), "file moved aside touched")
+	server.sweepStagedUploadsOfRepo(log, "stagedlive")
+	staged, err = server.StorageBackend.ListObjects("stagedlive/" + stagingPrefix)
+	suite.Nil(err, "no error listing staged files")
+	suite.Len(staged, 2, "files of the upload in progress kept")
+	upload.rollback()
+	upload.abort()
+	object, err = server.StorageBackend.GetObject("stagedlive/mychart-0.1.0.tgz")
+	suite.Nil(err, "previous chart package restored")
+	suite.WithinDuration(old, object.LastModified, time.Second, "time of the restored file kept")
+	suite.False(server.stagedUploads.isInProgress(upload.id+"-"+chartPackage.filename), "aborted upload no longer in progress")
+}
+
+func (suite *MultiTenantServerTestSuite) TestWebhooks() {
+	server := suite.Depth1Server
+
+	type received struct {
+		path    string
+		header  http.Header
+		payload []byte
+	}
+	requests := make(chan received, 10)
+	flakyAttempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+		requests <- received{r.URL.Path, r.Header, payload}
+		if r.URL.Path == "/flaky" {
+			flakyAttempts++
+			if flakyAttempts == 1 {
+				w.WriteHeader(500)
+				return
+			}
+		}
+		w.WriteHeader(204)
+	}))
+	defer receiver.Close()
+	next := func() received {
+		select {
+		case r := <-requests:
+			return r
+		case <-time.After(5 * time.Second):
+			suite.FailNow("webhook not received")
+		}
+		return received{}
+	}
+
+	defer func(webhooks []*Webhook, backoff time.Duration) {
+		server.Webhooks = webhooks
+		webhookBackoff = backoff
+	}(server.Webhooks, webhookBackoff)
+	webhookBackoff = 10 * time.Millisecond
+	server.Webhooks = []*Webhook{
+		{Name: "hook", URL: receiver.URL + "/hook", Secret: "changeme", Repo: "hooked"},
+		{Name: "flaky", URL: receiver.URL + "/flaky", Repo: "hooked", Events: []string{"chart.deleted"}},
+		{Name: "other", URL: receiver.URL + "/other", Repo: "other"},
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res := suite.doRequest("depth1", "POST", "/api/hooked/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/hooked/charts")
+
+	r := next()
+	suite.Equal("/hook", r.path, "chart.added sent to subscribed webhook")
+	suite.Equal("chart.added", r.header.Get(WebhookEventHeader))
+	suite.Equal((&Webhook{Secret: "changeme"}).sign(r.payload), r.header.Get(WebhookSignatureHeader), "payload signed")
+	var payload WebhookPayload
+	suite.Nil(json.Unmarshal(r.payload, &payload), "no error decoding payload")
+	suite.Equal(r.header.Get(WebhookDeliveryHeader), payload.ID)
+	suite.Equal("chart.added", payload.Event)
+	suite.Equal("hooked", payload.Repo)
+	suite.Equal("mychart", payload.Chart.Name)
+	suite.Equal("0.1.0", payload.Chart.Version)
+
+	res = suite.doRequest("depth1", "DELETE", "/api/hooked/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/hooked/charts/mychart/0.1.0")
+	paths := map[string]int{}
+	for i := 0; i < 3; i++ {
+		r = next()
+		suite.Equal("chart.deleted", r.header.Get(WebhookEventHeader))
+		if r.path == "/flaky" {
+			suite.Empty(r.header.Get(WebhookSignatureHeader), "payload not signed without secret")
+		}
+		paths[r.path]++
+	}
+	suite.Equal(map[string]int{"/hook": 1, "/flaky": 2}, paths, "failed delivery retried")
+
+	// the delivery log is updated once the response of the last attempt is read
+	var deliveries []WebhookDelivery
+	for i := 0; i < 50; i++ {
+		res, body := suite.doRequestWithHeader(server, "GET", "/api/hooked/webhooks/deliveries", "", "")
+		suite.Equal(200, res.Status(), "200 GET /api/hooked/webhooks/deliveries")
+		suite.Nil(json.Unmarshal(body.Bytes(), &deliveries), "no error decoding deliveries")
+		if len(deliveries) == 3 && deliveries[0].Delivered && deliveries[1].Delivered {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	suite.Len(deliveries, 3, "deliveries logged")
+	for _, delivery := range deliveries {
+		suite.True(delivery.Delivered, "delivered to %s", delivery.Webhook)
+		suite.Equal("mychart", delivery.Name)
+		if delivery.Webhook == "flaky" {
+			suite.Equal(2, delivery.Attempts, "delivered on second attempt")
+			suite.Equal(204, delivery.StatusCode)
+		}
+	}
+	suite.Equal("chart.added", deliveries[2].Event, "oldest delivery last")
+}
+
+// readFeedEvent reads the next event of a Server-Sent Events stream, skipping comments
+func readFeedEvent(reader *bufio.Reader) (id string, event string, data string, err error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return id, event, data, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, data, nil
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func (suite *MultiTenantServerTestSuite) TestEventFeed() {
+	server := suite.Depth1Server
+	httpServer := httptest.NewServer(server.Router)
+	defer httpServer.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	subscribe := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest("GET", httpServer.URL+"/api/feed/events", nil)
+		suite.Nil(err, "no error creating request")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := client.Do(req)
+		suite.Nil(err, "no error subscribing to event feed")
+		suite.Equal(200, res.StatusCode, "200 GET /api/feed/events")
+		suite.Equal("text/event-stream", res.Header.Get("Content-Type"))
+		return res, bufio.NewReader(res.Body)
+	}
+
+	res, reader := subscribe("")
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	post := suite.doRequest("depth1", "POST", "/api/feed/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, post.Status(), "201 POST /api/feed/charts")
+	post = suite.doRequest("depth1", "POST", "/api/otherfeed/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, post.Status(), "201 POST /api/otherfeed/charts")
+	post = suite.doRequest("depth1", "DELETE", "/api/feed/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, post.Status(), "200 DELETE /api/feed/charts/mychart/0.1.0")
+
+	addedID, event, data, err := readFeedEvent(reader)
+	suite.Nil(err, "no error reading event")
+	suite.Equal("chart.added", event)
+	var e feedEvent
+	suite.Nil(json.Unmarshal([]byte(data), &e), "no error decoding event")
+	suite.Equal("feed", e.Repo)
+	suite.Equal("mychart", e.Chart.Name)
+	suite.Equal("0.1.0", e.Chart.Version)
+	deletedID, event, _, err := readFeedEvent(reader)
+	suite.Nil(err, "no error reading event")
+	suite.Equal("chart.deleted", event, "events of other repos not sent")
+	res.Body.Close()
+
+	// resuming sends the events missed since the last one received
+	res, reader = subscribe(addedID)
+	id, event, _, err := readFeedEvent(reader)
+	suite.Nil(err, "no error reading missed event")
+	suite.Equal(deletedID, id, "missed event sent")
+	suite.Equal("chart.deleted", event)
+	res.Body.Close()
+
+	// events which are no longer buffered, or from before a restart, cannot be resumed
+	res, reader = subscribe("1-1")
+	_, event, _, err = readFeedEvent(reader)
+	suite.Nil(err, "no error reading resync event")
+	suite.Equal(feedResyncEvent, event, "resync sent for unknown event id")
+	res.Body.Close()
+
+	defer func(size int) { eventFeedBufferSize = size }(eventFeedBufferSize)
+	eventFeedBufferSize = 2
+	feed := newEventFeed()
+	chartVersion := &helm_repo.ChartVersion{Metadata: &chart.Metadata{Name: "mychart", Version: "0.1.0"}}
+	for i := 0; i < 4; i++ {
+		feed.publish("feed", updateChart, chartVersion)
+	}
+	subscriber, missed, resync := feed.subscribe("feed", fmt.Sprintf("%d-2", feed.epoch))
+	suite.False(resync, "missed events still buffered")
+	suite.Len(missed, 2, "missed events")
+	feed.unsubscribe(subscriber)
+	subscriber, missed, resync = feed.subscribe("feed", fmt.Sprintf("%d-1", feed.epoch))
+	suite.True(resync, "missed event overwritten in ring buffer")
+	suite.Len(missed, 2, "buffered events still sent")
+	feed.unsubscribe(subscriber)
+}
+
+func (suite *MultiTenantServerTestSuite) TestAuditLog() {
+	server := suite.Depth1Server
+
+	res, _ := suite.doRequestWithHeader(server, "GET", "/api/audited/audit", "", "")
+	suite.Equal(404, res.Status(), "404 GET /api/audited/audit without audit store")
+
+	defer func(auditStore AuditStore, allowForceOverwrite bool) {
+		server.AuditStore = auditStore
+		server.AllowForceOverwrite = allowForceOverwrite
+	}(server.AuditStore, server.AllowForceOverwrite)
+	server.AuditStore = NewStorageAuditStore(server.StorageBackend)
+	server.AllowForceOverwrite = true
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	digest := sha256.Sum256(content)
+	res = suite.doRequest("depth1", "POST", "/api/audited/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/audited/charts")
+	res = suite.doRequest("depth1", "POST", "/api/audited/charts?force", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/audited/charts?force")
+	content, err = ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	res = suite.doRequest("depth1", "POST", "/api/audited/prov", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/audited/prov")
+	res = suite.doRequest("depth1", "DELETE", "/api/audited/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/audited/charts/mychart/0.1.0")
+	res = suite.doRequest("depth1", "POST", "/api/audited/charts", bytes.NewBuffer([]byte("invalid")), "")
+	suite.Equal(500, res.Status(), "500 POST /api/audited/charts with an invalid package")
+
+	var records []*AuditRecord
+	res, body := suite.doRequestWithHeader(server, "GET", "/api/audited/audit", "", "")
+	suite.Equal(200, res.Status(), "200 GET /api/audited/audit")
+	suite.Nil(json.Unmarshal(body.Bytes(), &records), "no error decoding audit records")
+	suite.Len(records, 4, "failed operations not recorded")
+	var actions []string
+	for _, record := range records {
+		actions = append(actions, record.Action)
+		suite.Equal("audited", record.Repo)
+		suite.Equal("mychart", record.Name)
+		suite.Equal("0.1.0", record.Version)
+		suite.NotEmpty(record.RequestID, "request ID recorded")
+	}
+	suite.Equal([]string{AuditActionDelete, AuditActionProvenance, AuditActionForceOverwrite, AuditActionPush}, actions, "newest record first")
+	suite.Equal(hex.EncodeToString(digest[:]), records[3].Digest, "digest of the pushed package")
+	suite.Equal(records[3].Digest, records[0].Digest, "digest of the deleted package")
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/api/audited/audit?action=push", "", "")
+	suite.Equal(200, res.Status(), "200 GET /api/audited/audit?action=push")
+	suite.Nil(json.Unmarshal(body.Bytes(), &records), "no error decoding audit records")
+	suite.Len(records, 1)
+
+	res, body = suite.doRequestWithHeader(server, "GET", "/api/audited/audit?offset=1&limit=2", "", "")
+	suite.Equal(200, res.Status(), "200 GET /api/audited/audit?offset=1&limit=2")
+	suite.Nil(json.Unmarshal(body.Bytes(), &records), "no error decoding audit records")
+	suite.Len(records, 2)
+	suite.Equal(AuditActionProvenance, records[0].Action)
+
+	res, _ = suite.doRequestWithHeader(server, "GET", "/api/audited/audit?limit=0", "", "")
+	suite.Equal(400, res.Status(), "400 GET /api/audited/audit?limit=0")
+}
+
+func (suite *MultiTenantServerTestSuite) TestStorageQuota() {
+	server := suite.Depth1Server
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	quota := &StorageQuota{Repo: "quota", Quota: ByteSize(strconv.Itoa(len(content) + 10))}
+	suite.Nil(quota.compile(), "no error compiling storage quota")
+	defer func(storageQuotas []*StorageQuota) {
+		server.StorageQuotas = storageQuotas
+	}(server.StorageQuotas)
+	server.StorageQuotas = []*StorageQuota{quota}
+
+	getUsage := func() StorageUsage {
+		var usage StorageUsage
+		res, body := suite.doRequestWithHeader(server, "GET", "/api/quota/usage", "", "")
+		suite.Equal(200, res.Status(), "200 GET /api/quota/usage")
+		suite.Nil(json.Unmarshal(body.Bytes(), &usage), "no error decoding storage usage")
+		return usage
+	}
+	suite.Equal(StorageUsage{Repo: "quota", Quota: int64(len(content) + 10)}, getUsage())
+
+	res := suite.doRequest("depth1", "POST", "/api/quota/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/quota/charts")
+	usage := getUsage()
+	suite.Equal(int64(len(content)), usage.Bytes, "usage tracked on upload")
+	suite.Equal(1, usage.Objects)
+	suite.Equal(float64(len(content)), testutil.ToFloat64(storageUsedBytesGaugeVec.WithLabelValues("quota")), "usage metric")
+
+	content, err = ioutil.ReadFile(testProvfilePath)
+	suite.Nil(err, "no error opening test provenance file")
+	res = suite.doRequest("depth1", "POST", "/api/quota/prov", bytes.NewBuffer(content), "")
+	suite.Equal(507, res.Status(), "507 POST /api/quota/prov")
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart", "prov"}, []string{otherTestTarballPath, otherTestProvfilePath})
+	body := new(bytes.Buffer)
+	res = suite.doRequest("depth1", "POST", "/api/quota/charts", buf, w.FormDataContentType(), body)
+	suite.Equal(507, res.Status(), "507 POST /api/quota/charts")
+	suite.Contains(body.String(), "repo has reached storage quota")
+
+	res = suite.doRequest("depth1", "POST", "/api/unlimited/prov", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/unlimited/prov")
+
+	res = suite.doRequest("depth1", "DELETE", "/api/quota/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/quota/charts/mychart/0.1.0")
+	usage = getUsage()
+	suite.Equal(int64(0), usage.Bytes, "usage tracked on delete")
+	suite.Equal(0, usage.Objects)
+}
+
+func (suite *MultiTenantServerTestSuite) TestTenantOverrides() {
+	server := suite.Depth1Server
+	allowOverwrite, disableDelete := true, true
+	maxUploadSize := ByteSize("100")
+	overrides := []*TenantOverrides{
+		{Repo: "sandbox", AllowOverwrite: &allowOverwrite},
+		{Repo: "frozen", DisableDelete: &disableDelete},
+		{Repo: "tiny", MaxUploadSize: &maxUploadSize},
+	}
+	for _, o := range overrides {
+		suite.Nil(o.compile(), "no error compiling tenant overrides")
+	}
+	defer func(tenantOverrides []*TenantOverrides) {
+		server.TenantOverrides = tenantOverrides
+	}(server.TenantOverrides)
+	server.TenantOverrides = overrides
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	for _, repo := range []string{"sandbox", "frozen"} {
+		res := suite.doRequest("depth1", "POST", fmt.Sprintf("/api/%s/charts", repo), bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), fmt.Sprintf("201 POST /api/%s/charts", repo))
+	}
+	res := suite.doRequest("depth1", "POST", "/api/sandbox/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/sandbox/charts (overwrite allowed for the tenant)")
+	res = suite.doRequest("depth1", "POST", "/api/frozen/charts", bytes.NewBuffer(content), "")
+	suite.Equal(409, res.Status(), "409 POST /api/frozen/charts")
+
+	res = suite.doRequest("depth1", "DELETE", "/api/frozen/charts/mychart/0.1.0", nil, "")
+	suite.Equal(404, res.Status(), "404 DELETE /api/frozen/charts/mychart/0.1.0 (delete disabled for the tenant)")
+	res = suite.doRequest("depth1", "DELETE", "/api/sandbox/charts/mychart/0.1.0", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/sandbox/charts/mychart/0.1.0")
+
+	body := new(bytes.Buffer)
+	res = suite.doRequest("depth1", "POST", "/api/tiny/charts", bytes.NewBuffer(content), "", body)
+	suite.Equal(413, res.Status(), "413 POST /api/tiny/charts")
+	suite.JSONEq(`{"error": "request exceeds the max upload size of 100 B"}`, body.String(), "single 413 error")
+	body = new(bytes.Buffer)
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPath})
+	res = suite.doRequest("depth1", "POST", "/api/tiny/charts", buf, w.FormDataContentType(), body)
+	suite.Equal(413, res.Status(), "413 POST /api/tiny/charts multipart")
+	suite.JSONEq(`{"error": "request exceeds the max upload size of 100 B"}`, body.String(), "single 413 error")
+	body = new(bytes.Buffer)
+	res = suite.doRequest("depth1", "POST", "/api/tiny/prov", bytes.NewBuffer(content), "", body)
+	suite.Equal(413, res.Status(), "413 POST /api/tiny/prov")
+	suite.JSONEq(`{"error": "request exceeds the max upload size of 100 B"}`, body.String(), "single 413 error")
+}
+
+func (suite *MultiTenantServerTestSuite) TestLintPolicy() {
+	server := suite.Depth1Server
+	defer func(lintPolicy string) {
+		server.LintPolicy = lintPolicy
+	}(server.LintPolicy)
+	server.LintPolicy = LintPolicyReject
+
+	dir, err := ioutil.TempDir("", "lint")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+	brokenTarballPath, err := saveBrokenChart(dir)
+	suite.Nil(err, "no error saving broken chart")
+	broken, err := ioutil.ReadFile(brokenTarballPath)
+	suite.Nil(err, "no error opening broken tarball")
+
+	body := new(bytes.Buffer)
+	res := suite.doRequest("depth1", "POST", "/api/lint/charts", bytes.NewBuffer(broken), "", body)
+	suite.Equal(400, res.Status(), "400 POST /api/lint/charts")
+	suite.Contains(body.String(), "failed lint")
+	suite.Contains(body.String(), `"lint":[`, "lint findings returned")
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{brokenTarballPath})
+	res = suite.doRequest("depth1", "POST", "/api/lint/charts", buf, w.FormDataContentType())
+	suite.Equal(400, res.Status(), "400 POST /api/lint/charts (multipart)")
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	res = suite.doRequest("depth1", "POST", "/api/lint/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/lint/charts")
+	body = new(bytes.Buffer)
+	res = suite.doRequest("depth1", "GET", "/api/lint/charts/mychart/0.1.0/lint", nil, "", body)
+	suite.Equal(200, res.Status(), "200 GET /api/lint/charts/mychart/0.1.0/lint")
+	var report lintReport
+	suite.Nil(json.Unmarshal(body.Bytes(), &report), "no error decoding lint report")
+	suite.True(report.Passed)
+	suite.Equal(LintPolicyReject, report.Policy)
+
+	// with the warn policy, the package is stored along with its findings (in another repo, whose index is not cached yet)
+	server.LintPolicy = LintPolicyWarn
+	body = new(bytes.Buffer)
+	res = suite.doRequest("depth1", "POST", "/api/lintwarn/charts", bytes.NewBuffer(broken), "", body)
+	suite.Equal(201, res.Status(), "201 POST /api/lintwarn/charts")
+	suite.Contains(body.String(), `"lint":[`, "lint findings returned")
+	body = new(bytes.Buffer)
+	res = suite.doRequest("depth1", "GET", "/api/lintwarn/charts/broken/0.1.0/lint", nil, "", body)
+	suite.Equal(200, res.Status(), "200 GET /api/lintwarn/charts/broken/0.1.0/lint")
+	suite.Nil(json.Unmarshal(body.Bytes(), &report), "no error decoding lint report")
+	suite.False(report.Passed)
+
+	res = suite.doRequest("depth1", "GET", "/api/lint/charts/mychart/9.9.9/lint", nil, "")
+	suite.Equal(404, res.Status(), "404 GET /api/lint/charts/mychart/9.9.9/lint")
+}
+
+func (suite *MultiTenantServerTestSuite) TestUploadPolicy() {
+	server := suite.Depth1Server
+	policy := &UploadPolicy{Repo: "policy", NamePattern: "^org1-", APIVersions: []string{"v1", "v2"}}
+	suite.Nil(policy.compile(), "no error compiling upload policy")
+	defer func(uploadPolicies []*UploadPolicy) {
+		server.UploadPolicies = uploadPolicies
+	}(server.UploadPolicies)
+	server.UploadPolicies = []*UploadPolicy{policy}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	body := new(bytes.Buffer)
+	res := suite.doRequest("depth1", "POST", "/api/policy/charts", bytes.NewBuffer(content), "", body)
+	suite.Equal(400, res.Status(), "400 POST /api/policy/charts")
+	var response struct {
+		Error      string             `json:"error"`
+		Violations []*PolicyViolation `json:"violations"`
+	}
+	suite.Nil(json.Unmarshal(body.Bytes(), &response), "no error decoding response")
+	suite.Contains(response.Error, "violates the upload policy")
+	suite.Equal([]*PolicyViolation{{Rule: PolicyRuleNamePattern, Message: "chart name mychart does not match ^org1-"}}, response.Violations)
+
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPath})
+	res = suite.doRequest("depth1", "POST", "/api/policy/charts", buf, w.FormDataContentType())
+	suite.Equal(400, res.Status(), "400 POST /api/policy/charts (multipart)")
+
+	res = suite.doRequest("depth1", "POST", "/api/nopolicy/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/nopolicy/charts")
+	res = suite.doRequest("depth1", "POST", "/api/nopolicy/charts/mychart/0.1.0/promote?to=policy", nil, "")
+	suite.Equal(400, res.Status(), "400 POST /api/nopolicy/charts/mychart/0.1.0/promote?to=policy")
+
+	// a chart package following the policy
+	server.UploadPolicies = []*UploadPolicy{{Repo: "policy", APIVersions: []string{"v1", "v2"}}}
+	res = suite.doRequest("depth1", "POST", "/api/policy/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/policy/charts")
+}
+
+func (suite *MultiTenantServerTestSuite) TestProtectedVersions() {
+	server := suite.Depth1Server
+	allowOverwrite, protectReleases := true, true
+	overrides := &TenantOverrides{Repo: "protected", AllowOverwrite: &allowOverwrite, ProtectReleases: &protectReleases}
+	suite.Nil(overrides.compile(), "no error compiling tenant overrides")
+	defer func(tenantOverrides []*TenantOverrides) {
+		server.TenantOverrides = tenantOverrides
+	}(server.TenantOverrides)
+	server.TenantOverrides = []*TenantOverrides{overrides}
+
+	dir, err := ioutil.TempDir("", "protected")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+	prereleaseTarballPath, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "mychart", Version: "0.2.0-dev.1"},
+	}, dir)
+	suite.Nil(err, "no error saving prerelease chart")
+	// a numeric prerelease, which its filename alone would give as version 20201010
+	numericPrereleaseTarballPath, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "app", Version: "1.0.0-20201010"},
+	}, dir)
+	suite.Nil(err, "no error saving numeric prerelease chart")
+
+	for _, filename := range []string{testTarballPath, prereleaseTarballPath, numericPrereleaseTarballPath} {
+		content, err := ioutil.ReadFile(filename)
+		suite.Nil(err, "no error opening tarball")
+		res := suite.doRequest("depth1", "POST", "/api/protected/charts", bytes.NewBuffer(content), "")
+		suite.Equal(201, res.Status(), "201 POST /api/protected/charts")
+	}
+
+	content, err := ioutil.ReadFile(testTarballPath)
+	suite.Nil(err, "no error opening test tarball")
+	body := new(bytes.Buffer)
+	res := suite.doRequest("depth1", "POST", "/api/protected/charts?force", bytes.NewBuffer(content), "", body)
+	suite.Equal(409, res.Status(), "409 POST /api/protected/charts?force (protected version)")
+	suite.Contains(body.String(), "0.1.0 is a protected version")
+	buf, w := suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{testTarballPath})
+	res = suite.doRequest("depth1", "POST", "/api/protected/charts", buf, w.FormDataContentType())
+	suite.Equal(409, res.Status(), "409 POST /api/protected/charts (multipart, protected version)")
+
+	content, err = ioutil.ReadFile(prereleaseTarballPath)
+	suite.Nil(err, "no error opening prerelease tarball")
+	res = suite.doRequest("depth1", "POST", "/api/protected/charts", bytes.NewBuffer(content), "")
+	suite.Equal(201, res.Status(), "201 POST /api/protected/charts (prerelease overwritten)")
+	buf, w = suite.getBodyWithMultipartFormFiles([]string{"chart"}, []string{numericPrereleaseTarballPath})
+	res = suite.doRequest("depth1", "POST", "/api/protected/charts", buf, w.FormDataContentType())
+	suite.Equal(201, res.Status(), "201 POST /api/protected/charts (multipart, numeric prerelease overwritten)")
+
+	res = suite.doRequest("depth1", "DELETE", "/api/protected/charts/mychart/0.1.0", nil, "")
+	suite.Equal(403, res.Status(), "403 DELETE /api/protected/charts/mychart/0.1.0")
+	res = suite.doRequest("depth1", "DELETE", "/api/protected/charts/mychart/0.2.0-dev.1", nil, "")
+	suite.Equal(200, res.Status(), "200 DELETE /api/protected/charts/mychart/0.2.0-dev.1")
+}
+
+func (suite *MultiTenantServerTestSuite) TestChartVersionsMatchingConstraint() {
+	var chartVersions helm_repo.ChartVersions
+	for _, version := range []string{"1.3.0", "1.4.2", "1.5.0-beta.1", "1.4.10", "2.0.0", "not-semver"} {
+		chartVersions = append(chartVersions, &helm_repo.ChartVersion{
+			Metadata: &chart.Metadata{Name: "mychart", Version: version},
+		})
+	}
+	versions := func(matches helm_repo.ChartVersions) []string {
+		var result []string
+		for _, match := range matches {
+			result = append(result, match.Version)
+		}
+		return result
+	}
+
+	matches, err := chartVersionsMatchingConstraint(chartVersions, "^1.4", false)
+	suite.Nil(err, "no error matching ^1.4")
+	suite.Equal([]string{"1.4.10", "1.4.2"}, versions(matches), "^1.4 matches releases, newest first")
+
+	matches, err = chartVersionsMatchingConstraint(chartVersions, "^1.4", true)
+	suite.Nil(err, "no error matching ^1.4 with prereleases")
+	suite.Equal([]string{"1.5.0-beta.1", "1.4.10", "1.4.2"}, versions(matches), "^1.4 matches prereleases when included")
+
+	matches, err = chartVersionsMatchingConstraint(chartVersions, ">=1.0 <2.0", false)
+	suite.Nil(err, "no error matching range")
+	suite.Equal([]string{"1.4.10", "1.4.2", "1.3.0"}, versions(matches), "range matches")
+
+	matches, err = chartVersionsMatchingConstraint(chartVersions, "", false)
+	suite.Nil(err, "no error matching empty constraint")
+	suite.Equal("2.0.0", matches[0].Version, "empty constraint matches latest first")
+
+	_, err = chartVersionsMatchingConstraint(chartVersions, "not-a-constraint", false)
+	suite.NotNil(err, "error matching invalid constraint")
+}
+
 func (suite *MultiTenantServerTestSuite) TestRoutes() {
 	suite.testAllRoutes("", 0)
 	for org, teams := range suite.StorageDirectory {
@@ -900,6 +2220,18 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts?offset=-1&limit=5", apiPrefix), nil, "")
 	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/charts?limit=0", apiPrefix))
 
+	// GET /api/:repo/search
+	buffer := bytes.NewBufferString("")
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/search?q=name:mychart", apiPrefix), nil, "", buffer)
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/search?q=name:mychart", apiPrefix))
+	suite.Contains(buffer.String(), `"name":"mychart"`, "search result contains mychart")
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/search", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/search", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/search?q=bogus:value", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/search?q=bogus:value", apiPrefix))
+
 	// GET /api/:repo/charts/:name
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart", apiPrefix))
@@ -907,6 +2239,16 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart", apiPrefix), nil, "")
 	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart", apiPrefix))
 
+	// GET /api/:repo/charts/:name?version=
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart?version=^0.1", apiPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart?version=^0.1", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart?version=not-a-constraint", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/charts/mychart?version=not-a-constraint", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart?version=^0.1", apiPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/fakechart?version=^0.1", apiPrefix))
+
 	// HEAD /api/:repo/charts/:name
 	res = suite.doRequest(stype, "HEAD", fmt.Sprintf("%s/charts/mychart", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 HEAD %s/charts/mychart", apiPrefix))
@@ -927,6 +2269,18 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/fakechart/0.1.0", apiPrefix), nil, "")
 	suite.Equal(404, res.Status(), fmt.Sprintf("200 GET %s/charts/fakechart/0.1.0", apiPrefix))
 
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/~0.1.0", apiPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart/~0.1.0", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/%%3E%%3D0.1%%20%%3C1.0?includePrereleases=true", apiPrefix), nil, "")
+	suite.Equal(200, res.Status(), fmt.Sprintf("200 GET %s/charts/mychart/>=0.1 <1.0?includePrereleases=true", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/^5", apiPrefix), nil, "")
+	suite.Equal(404, res.Status(), fmt.Sprintf("404 GET %s/charts/mychart/^5", apiPrefix))
+
+	res = suite.doRequest(stype, "GET", fmt.Sprintf("%s/charts/mychart/latest?includePrereleases=maybe", apiPrefix), nil, "")
+	suite.Equal(400, res.Status(), fmt.Sprintf("400 GET %s/charts/mychart/latest?includePrereleases=maybe", apiPrefix))
+
 	// HEAD /api/:repo/charts/:name/:version
 	res = suite.doRequest(stype, "HEAD", fmt.Sprintf("%s/charts/mychart/0.1.0", apiPrefix), nil, "")
 	suite.Equal(200, res.Status(), fmt.Sprintf("200 HEAD %s/charts/mychart/0.1.0", apiPrefix))
@@ -1062,6 +2416,17 @@ func (suite *MultiTenantServerTestSuite) testAllRoutes(repo string, depth int) {
 
 }
 
+func (suite *MultiTenantServerTestSuite) doRequestWithHeader(server *MultiTenantServer, method string, urlStr string, header string, value string) (gin.ResponseWriter, *bytes.Buffer) {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request, _ = http.NewRequest(method, urlStr, nil)
+	if header != "" {
+		c.Request.Header.Set(header, value)
+	}
+	server.Router.HandleContext(c)
+	return c.Writer, recorder.Body
+}
+
 func (suite *MultiTenantServerTestSuite) getBodyWithMultipartFormFiles(fields []string, filenames []string) (io.Reader, *multipart.Writer) {
 	buf := new(bytes.Buffer)
 	w := multipart.NewWriter(buf)
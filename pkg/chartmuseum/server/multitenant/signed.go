@@ -0,0 +1,89 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"net/http"
+	pathutil "path"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+// requireSignedCharts returns true if a tenant only accepts and serves chart versions with a verified provenance file
+func (server *MultiTenantServer) requireSignedCharts(repo string) bool {
+	if server.RequireSignedCharts {
+		return true
+	}
+	for _, pattern := range server.SignedOnlyRepos {
+		if ok, _ := pathutil.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChartPackageSigned rejects a chart package without a verified provenance file if the tenant is signed-only
+func (server *MultiTenantServer) checkChartPackageSigned(repo string, filename string, provenance *provenanceRecord) *HTTPError {
+	if provenance == nil && server.requireSignedCharts(repo) {
+		return &HTTPError{http.StatusBadRequest, fmt.Sprintf("%s has no valid provenance file, repo only accepts signed charts", filename)}
+	}
+	return nil
+}
+
+/*
+hideUnsignedChartVersions removes the chart versions without a verified provenance file from the index of a
+signed-only tenant before it is regenerated, so they are neither listed nor served. Since they are then missing
+from the index, they are loaded again from storage on every full rebuild, and show up once signed.
+*/
+func (server *MultiTenantServer) hideUnsignedChartVersions(log cm_logger.LoggingFn, repo string, index *cm_repo.Index) error {
+	if !server.requireSignedCharts(repo) {
+		return nil
+	}
+	overlay, err := server.getMetadataOverlay(repo)
+	if err != nil {
+		return err
+	}
+
+	hidden := 0
+	for name, chartVersions := range index.Entries {
+		signed := helm_repo.ChartVersions{}
+		for _, chartVersion := range chartVersions {
+			cvo := overlay.get(name, chartVersion.Version)
+			if cvo == nil || cvo.Provenance == nil || cvo.Provenance.Digest != chartVersion.Digest {
+				hidden++
+				continue
+			}
+			signed = append(signed, chartVersion)
+		}
+		if len(signed) == 0 {
+			delete(index.Entries, name)
+		} else {
+			index.Entries[name] = signed
+		}
+	}
+	if hidden > 0 {
+		log(cm_logger.DebugLevel, "Unsigned chart versions hidden from index",
+			"repo", repo,
+			"hidden", hidden,
+		)
+	}
+	return nil
+}
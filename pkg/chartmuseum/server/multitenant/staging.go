@@ -0,0 +1,340 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"os"
+	pathutil "path"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/chartmuseum/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// stagingPrefix is the prefix, below each tenant, where uploaded files are written before being published.
+	// As a nested prefix it is left out when listing the objects of the tenant.
+	stagingPrefix = ".staging"
+)
+
+type (
+	// StorageObjectMover may be implemented by storage backends to move an object without copying its content
+	StorageObjectMover interface {
+		MoveObject(from string, to string) error
+	}
+
+	/*
+		stagedUpload publishes the files of an upload together: every file is first written under the staging
+		prefix of the tenant, and moved to its final path only once all of them are stored. The files it replaces
+		are moved aside under the staging prefix first. If publishing fails midway, the files already published
+		are deleted and the files they replaced restored, so a chart package is never served without the
+		provenance file uploaded with it (and vice versa).
+	*/
+	stagedUpload struct {
+		server    *MultiTenantServer
+		repo      string
+		id        string
+		staged    []string
+		published []string
+		sizes     map[string]int64
+		replaced  map[string]*replacedFile
+	}
+
+	// replacedFile is a file replaced by a staged upload, moved aside until the upload is published
+	replacedFile struct {
+		size         int64
+		lastModified time.Time
+	}
+
+	// stagedUploadTracker keeps the ids of the staged uploads in progress, whose files are never swept
+	stagedUploadTracker struct {
+		lock sync.Mutex
+		ids  map[string]bool
+	}
+)
+
+func newStagedUploadTracker() *stagedUploadTracker {
+	return &stagedUploadTracker{ids: map[string]bool{}}
+}
+
+func (tracker *stagedUploadTracker) start(id string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.ids[id] = true
+}
+
+func (tracker *stagedUploadTracker) finish(id string) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	delete(tracker.ids, id)
+}
+
+// isInProgress tells whether a file under the staging prefix belongs to an upload in progress
+func (tracker *stagedUploadTracker) isInProgress(stagedFilename string) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.ids[strings.SplitN(stagedFilename, "-", 2)[0]]
+}
+
+func (server *MultiTenantServer) newStagedUpload(repo string) *stagedUpload {
+	id := make([]byte, 8)
+	rand.Read(id)
+	upload := &stagedUpload{
+		server:   server,
+		repo:     repo,
+		id:       hex.EncodeToString(id),
+		sizes:    map[string]int64{},
+		replaced: map[string]*replacedFile{},
+	}
+	// until it is published or aborted
+	server.stagedUploads.start(upload.id)
+	return upload
+}
+
+// stagingPath returns where a file of the upload is written before being published
+func (upload *stagedUpload) stagingPath(filename string) string {
+	return pathutil.Join(upload.repo, stagingPrefix, upload.id+"-"+filename)
+}
+
+// replacedPath returns where a file replaced by the upload is moved until the upload is published
+func (upload *stagedUpload) replacedPath(filename string) string {
+	return upload.stagingPath(filename) + ".replaced"
+}
+
+// stage writes a chart package or provenance file under the staging prefix, removing the staged files on error
+func (upload *stagedUpload) stage(ppf *chartOrProvenanceFile) error {
+	err := upload.server.putChartOrProvenanceFile(upload.stagingPath(ppf.filename), ppf)
+	if err != nil {
+		upload.abort()
+		return err
+	}
+	upload.staged = append(upload.staged, ppf.filename)
+	upload.sizes[ppf.filename] = ppf.size()
+	return nil
+}
+
+// publish moves the staged files to their final path, rolling back the files already published on error
+func (upload *stagedUpload) publish() error {
+	backend := upload.server.StorageBackend
+	for i, filename := range upload.staged {
+		err := upload.moveAside(filename)
+		if err == nil {
+			err = moveStorageObject(backend, upload.stagingPath(filename), pathutil.Join(upload.repo, filename))
+		}
+		if err != nil {
+			upload.rollback()
+			upload.staged = upload.staged[i:]
+			upload.abort()
+			return err
+		}
+		upload.published = append(upload.published, filename)
+		upload.server.recordStorageObject(upload.repo, filename, upload.sizes[filename])
+	}
+	upload.staged = nil
+	for filename := range upload.replaced {
+		backend.DeleteObject(upload.replacedPath(filename))
+	}
+	upload.replaced = map[string]*replacedFile{}
+	upload.server.stagedUploads.finish(upload.id)
+	return nil
+}
+
+// moveAside moves the file a staged file is about to replace under the staging prefix, if there is one
+func (upload *stagedUpload) moveAside(filename string) error {
+	backend := upload.server.StorageBackend
+	path := pathutil.Join(upload.repo, filename)
+	content, lastModified, err := openStorageObject(backend, path)
+	if err != nil {
+		return nil // nothing to replace
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	content.Close()
+	if err != nil {
+		return err
+	}
+	if err = moveStorageObject(backend, path, upload.replacedPath(filename)); err != nil {
+		return err
+	}
+	// a renamed file keeps its time, it would otherwise look like an expired staged file to the sweeper
+	touchStorageObject(backend, upload.replacedPath(filename), time.Now())
+	upload.replaced[filename] = &replacedFile{size: size, lastModified: lastModified}
+	return nil
+}
+
+// rollback deletes the files already published, and restores the files they replaced
+func (upload *stagedUpload) rollback() {
+	backend := upload.server.StorageBackend
+	for _, filename := range upload.published {
+		backend.DeleteObject(pathutil.Join(upload.repo, filename))
+		upload.server.forgetStorageObject(upload.repo, filename)
+	}
+	upload.published = nil
+	for filename, replaced := range upload.replaced {
+		// left under the staging prefix if it cannot be restored, until it is swept
+		path := pathutil.Join(upload.repo, filename)
+		if err := moveStorageObject(backend, upload.replacedPath(filename), path); err == nil {
+			touchStorageObject(backend, path, replaced.lastModified)
+			upload.server.recordStorageObject(upload.repo, filename, replaced.size)
+		}
+	}
+	upload.replaced = map[string]*replacedFile{}
+}
+
+// abort removes the staged files of an upload which is not published
+func (upload *stagedUpload) abort() {
+	for _, filename := range upload.staged {
+		upload.server.StorageBackend.DeleteObject(upload.stagingPath(filename))
+	}
+	upload.staged = nil
+	upload.server.stagedUploads.finish(upload.id)
+}
+
+// moveStorageObject moves an object within a storage backend, renaming it if the backend supports it
+func moveStorageObject(backend storage.Backend, from string, to string) error {
+	switch b := backend.(type) {
+	case StorageObjectMover:
+		return b.MoveObject(from, to)
+	case *storage.LocalFilesystemBackend:
+		return moveLocalFilesystemObject(b, from, to)
+	case *storage.AmazonS3Backend:
+		return moveAmazonS3Object(b, from, to)
+	}
+	object, err := backend.GetObject(from)
+	if err != nil {
+		return err
+	}
+	if err = backend.PutObject(to, object.Content); err != nil {
+		return err
+	}
+	return backend.DeleteObject(from)
+}
+
+func moveLocalFilesystemObject(b *storage.LocalFilesystemBackend, from string, to string) error {
+	fullpath := pathutil.Join(b.RootDirectory, to)
+	if err := os.MkdirAll(pathutil.Dir(fullpath), 0777); err != nil {
+		return err
+	}
+	// atomic on the same filesystem, clients never see a partially written file
+	return os.Rename(pathutil.Join(b.RootDirectory, from), fullpath)
+}
+
+// touchStorageObject sets the time of an object renamed on the local filesystem, other backends writing moved objects anew
+func touchStorageObject(backend storage.Backend, path string, t time.Time) {
+	if b, ok := backend.(*storage.LocalFilesystemBackend); ok {
+		os.Chtimes(pathutil.Join(b.RootDirectory, path), t, t)
+	}
+}
+
+func moveAmazonS3Object(b *storage.AmazonS3Backend, from string, to string) error {
+	source := pathutil.Join(b.Bucket, b.Prefix, from)
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(b.Bucket),
+		Key:        aws.String(pathutil.Join(b.Prefix, to)),
+		CopySource: aws.String((&url.URL{Path: source}).EscapedPath()),
+	}
+	if b.SSE != "" {
+		input.ServerSideEncryption = aws.String(b.SSE)
+	}
+	if _, err := b.Client.CopyObject(input); err != nil {
+		return err
+	}
+	return b.DeleteObject(from)
+}
+
+/*
+sweepStagedUploads deletes the staged files and OCI upload sessions of every tenant older than the staging timeout,
+left behind by uploads which were interrupted (e.g. by a restart) before being published or aborted.
+*/
+func (server *MultiTenantServer) sweepStagedUploads() {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	repos, err := server.discoverTenants(log)
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error discovering tenants",
+			"error", err.Error(),
+		)
+		return
+	}
+	for _, repo := range repos {
+		server.sweepStagedUploadsOfRepo(log, repo)
+	}
+}
+
+func (server *MultiTenantServer) sweepStagedUploadsOfRepo(log cm_logger.LoggingFn, repo string) {
+	// the files of uploads in progress are kept, however long they take to publish
+	server.sweepExpiredObjects(log, repo, pathutil.Join(repo, stagingPrefix), server.stagedUploads.isInProgress)
+	// the sessions of OCI blob uploads which were never completed are swept along with the staged files
+	server.sweepExpiredObjects(log, repo, pathutil.Join(repo, ociUploadsPrefix), nil)
+	if server.EnableOCI {
+		server.sweepOrphanedOCIBlobs(log, repo)
+	}
+}
+
+// sweepExpiredObjects deletes the objects below a prefix older than the staging timeout unless kept, returning the deleted paths
+func (server *MultiTenantServer) sweepExpiredObjects(log cm_logger.LoggingFn, repo string, prefix string, keep func(path string) bool) []string {
+	objects, err := server.StorageBackend.ListObjects(prefix)
+	if err != nil {
+		log(cm_logger.ErrorLevel, "Error listing staged uploads",
+			"repo", repo,
+			"error", err.Error(),
+		)
+		return nil
+	}
+	var swept []string
+	expired := time.Now().Add(-server.StagingTimeout)
+	for _, object := range objects {
+		if object.LastModified.After(expired) || (keep != nil && keep(object.Path)) {
+			continue
+		}
+		err := server.StorageBackend.DeleteObject(pathutil.Join(prefix, object.Path))
+		if err != nil {
+			log(cm_logger.WarnLevel, "Error deleting staged upload",
+				"repo", repo,
+				"file", object.Path,
+				"error", err.Error(),
+			)
+			continue
+		}
+		log(cm_logger.InfoLevel, "Staged upload swept",
+			"repo", repo,
+			"file", object.Path,
+		)
+		swept = append(swept, object.Path)
+	}
+	return swept
+}
+
+func (server *MultiTenantServer) initStagingSweepTimer() {
+	if server.StagingTimeout > 0 {
+		go func() {
+			server.sweepStagedUploads()
+			t := time.NewTicker(server.StagingTimeout)
+			for range t.C {
+				server.sweepStagedUploads()
+			}
+		}()
+	}
+}
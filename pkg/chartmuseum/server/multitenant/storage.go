@@ -17,14 +17,25 @@ limitations under the License.
 package multitenant
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
 	pathutil "path"
 	"strings"
+	"time"
 
 	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
 	cm_repo "helm.sh/chartmuseum/pkg/repo"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/chartmuseum/storage"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
 )
 
 var (
@@ -33,9 +44,38 @@ var (
 )
 
 type (
+	// StorageObject is a chart package or provenance file, opened to be streamed to a client
 	StorageObject struct {
-		*storage.Object
-		ContentType string
+		Path         string
+		Content      io.ReadSeekCloser
+		LastModified time.Time
+		ContentType  string
+	}
+
+	// StorageObjectOpener may be implemented by storage backends to stream the content of an object,
+	// rather than loading it in memory. The content must be seekable, to answer range requests.
+	StorageObjectOpener interface {
+		OpenObject(path string) (io.ReadSeekCloser, time.Time, error)
+	}
+
+	// StorageObjectWriter may be implemented by storage backends to store an object streamed from an upload,
+	// rather than loaded in memory.
+	StorageObjectWriter interface {
+		WriteObject(path string, content io.Reader) error
+	}
+
+	// amazonS3ObjectReader reads an object from Amazon S3, requesting the range starting at the current offset
+	amazonS3ObjectReader struct {
+		backend *storage.AmazonS3Backend
+		key     string
+		size    int64
+		offset  int64
+		body    io.ReadCloser
+	}
+
+	// bufferedObjectReader holds the content of an object read from a backend which cannot stream it
+	bufferedObjectReader struct {
+		*bytes.Reader
 	}
 )
 
@@ -50,9 +90,27 @@ func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo
 		return nil, &HTTPError{http.StatusInternalServerError, "unsupported file extension"}
 	}
 
+	// the unsigned chart versions of signed-only tenants are not indexed, and not served either
+	if isChartPackage && server.requireSignedCharts(repo) {
+		index, httpErr := server.getIndexFile(log, repo)
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		if findChartPackage(index, filename) == nil {
+			return nil, &HTTPError{http.StatusNotFound, "object not found"}
+		}
+	}
+
 	objectPath := pathutil.Join(repo, filename)
 
-	object, err := server.StorageBackend.GetObject(objectPath)
+	content, lastModified, err := openStorageObject(server.StorageBackend, objectPath)
+	if proxy := server.getUpstreamProxy(repo); err != nil && proxy != nil {
+		// fetched from upstream on first download, served from storage afterwards
+		if httpErr := server.fetchUpstreamFile(log, proxy, filename); httpErr != nil {
+			return nil, httpErr
+		}
+		content, lastModified, err = openStorageObject(server.StorageBackend, objectPath)
+	}
 	if err != nil {
 		errStr := err.Error()
 		log(cm_logger.WarnLevel, errStr,
@@ -71,9 +129,221 @@ func (server *MultiTenantServer) getStorageObject(log cm_logger.LoggingFn, repo
 	}
 
 	storageObject := &StorageObject{
-		Object:      &object,
-		ContentType: contentType,
+		Path:         objectPath,
+		Content:      content,
+		LastModified: lastModified,
+		ContentType:  contentType,
 	}
 
 	return storageObject, nil
 }
+
+/*
+getStorageObjectETag returns the digest of a chart package from the index, or hashes a (small) provenance file.
+A chart package which is not indexed yet gets a weak ETag from its modification time and size instead, as hashing
+it would read it whole on every request.
+*/
+func (server *MultiTenantServer) getStorageObjectETag(log cm_logger.LoggingFn, repo string, filename string, storageObject *StorageObject) (string, error) {
+	content := storageObject.Content
+	if strings.HasSuffix(filename, cm_repo.ProvenanceFileExtension) {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, content); err != nil {
+			return "", err
+		}
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("\"%x\"", hash.Sum(nil)), nil
+	}
+
+	// the cached index is used as is, the package is served even if it is not indexed yet
+	if entry, err := server.initCacheEntry(log, repo); err == nil {
+		if chartVersion := findChartPackage(entry.RepoIndex, filename); chartVersion != nil && chartVersion.Digest != "" {
+			return fmt.Sprintf("\"%s\"", chartVersion.Digest), nil
+		}
+	}
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("W/\"%x-%x\"", storageObject.LastModified.UnixNano(), size), nil
+}
+
+// findChartPackage returns the chart version of a chart package filename in an index, nil if it is not indexed
+func findChartPackage(index *cm_repo.Index, filename string) *helm_repo.ChartVersion {
+	for i, c := range filename {
+		if c != '-' {
+			continue
+		}
+		name := filename[:i]
+		version := strings.TrimSuffix(filename[i+1:], "."+cm_repo.ChartPackageFileExtension)
+		for _, chartVersion := range index.Entries[name] {
+			if chartVersion.Version == version {
+				return chartVersion
+			}
+		}
+	}
+	return nil
+}
+
+// openStorageObject opens an object from a storage backend, streaming it if the backend supports it
+func openStorageObject(backend storage.Backend, path string) (io.ReadSeekCloser, time.Time, error) {
+	switch b := backend.(type) {
+	case StorageObjectOpener:
+		return b.OpenObject(path)
+	case *storage.LocalFilesystemBackend:
+		return openLocalFilesystemObject(b, path)
+	case *storage.AmazonS3Backend:
+		return openAmazonS3Object(b, path)
+	}
+	object, err := backend.GetObject(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return bufferedObjectReader{bytes.NewReader(object.Content)}, object.LastModified, nil
+}
+
+// putStorageFile stores a spooled file, streaming it if the backend supports it
+func putStorageFile(backend storage.Backend, path string, file *spooledFile) error {
+	var writeObject func(path string, content io.Reader) error
+	switch b := backend.(type) {
+	case StorageObjectWriter:
+		writeObject = b.WriteObject
+	case *storage.LocalFilesystemBackend:
+		writeObject = func(path string, content io.Reader) error {
+			return writeLocalFilesystemObject(b, path, content)
+		}
+	case *storage.AmazonS3Backend:
+		writeObject = func(path string, content io.Reader) error {
+			return writeAmazonS3Object(b, path, content)
+		}
+	default:
+		content, err := file.readAll()
+		if err != nil {
+			return err
+		}
+		return backend.PutObject(path, content)
+	}
+	f, err := file.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeObject(path, f)
+}
+
+func openLocalFilesystemObject(b *storage.LocalFilesystemBackend, path string) (io.ReadSeekCloser, time.Time, error) {
+	file, err := os.Open(pathutil.Join(b.RootDirectory, path))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.IsDir() {
+		err = errors.New("object is a directory")
+	}
+	if err != nil {
+		file.Close()
+		return nil, time.Time{}, err
+	}
+	return file, info.ModTime(), nil
+}
+
+func writeLocalFilesystemObject(b *storage.LocalFilesystemBackend, path string, content io.Reader) error {
+	fullpath := pathutil.Join(b.RootDirectory, path)
+	if err := os.MkdirAll(pathutil.Dir(fullpath), 0777); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(fullpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func openAmazonS3Object(b *storage.AmazonS3Backend, path string) (io.ReadSeekCloser, time.Time, error) {
+	key := pathutil.Join(b.Prefix, path)
+	head, err := b.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	reader := &amazonS3ObjectReader{
+		backend: b,
+		key:     key,
+		size:    aws.Int64Value(head.ContentLength),
+	}
+	return reader, aws.TimeValue(head.LastModified), nil
+}
+
+func writeAmazonS3Object(b *storage.AmazonS3Backend, path string, content io.Reader) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(b.Bucket),
+		Key:    aws.String(pathutil.Join(b.Prefix, path)),
+		Body:   content,
+	}
+	if b.SSE != "" {
+		input.ServerSideEncryption = aws.String(b.SSE)
+	}
+	_, err := b.Uploader.Upload(input)
+	return err
+}
+
+func (reader *amazonS3ObjectReader) Read(p []byte) (int, error) {
+	if reader.offset >= reader.size {
+		return 0, io.EOF
+	}
+	if reader.body == nil {
+		output, err := reader.backend.Client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(reader.backend.Bucket),
+			Key:    aws.String(reader.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", reader.offset)),
+		})
+		if err != nil {
+			return 0, err
+		}
+		reader.body = output.Body
+	}
+	n, err := reader.body.Read(p)
+	reader.offset += int64(n)
+	return n, err
+}
+
+func (reader *amazonS3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += reader.offset
+	case io.SeekEnd:
+		offset += reader.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != reader.offset {
+		// the next read requests the range starting at the new offset
+		reader.Close()
+		reader.offset = offset
+	}
+	return offset, nil
+}
+
+func (reader *amazonS3ObjectReader) Close() error {
+	if reader.body == nil {
+		return nil
+	}
+	err := reader.body.Close()
+	reader.body = nil
+	return err
+}
+
+func (reader bufferedObjectReader) Close() error {
+	return nil
+}
@@ -0,0 +1,322 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	pathutil "path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	cm_auth "github.com/chartmuseum/auth"
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// TenantSettingsFilename is the file, in the storage prefix of a tenant, which may override its settings
+	TenantSettingsFilename = "tenant.yaml"
+)
+
+var (
+	// the tenant.yaml of a tenant is read again once older than this
+	tenantSettingsCacheTTL = time.Minute
+)
+
+type (
+	/*
+		TenantOverrides overrides settings of the server for the tenants matching Repo (a glob, as in path.Match,
+		matching every tenant when empty). Settings left unset keep their value:
+
+			tenants:
+			# a sandbox where charts can be overwritten and deleted
+			- repo: sandbox
+			  allowOverwrite: true
+			  disableDelete: false
+			# released charts are immutable
+			- repo: release
+			  allowOverwrite: false
+			  allowForceOverwrite: false
+			  disableDelete: true
+			  enforceSemver2: true
+
+		The same settings, without repo, may be stored in the tenant.yaml of a tenant.
+	*/
+	TenantOverrides struct {
+		Repo                string    `json:"repo,omitempty"`
+		AllowOverwrite      *bool     `json:"allowOverwrite,omitempty"`
+		AllowForceOverwrite *bool     `json:"allowForceOverwrite,omitempty"`
+		DisableDelete       *bool     `json:"disableDelete,omitempty"`
+		EnforceSemver2      *bool     `json:"enforceSemver2,omitempty"`
+		MaxStorageObjects   *int      `json:"maxStorageObjects,omitempty"`
+		MaxUploadSize       *ByteSize `json:"maxUploadSize,omitempty"`
+		ChartURL            *string   `json:"chartURL,omitempty"`
+		AnonymousGet        *bool     `json:"anonymousGet,omitempty"`
+		LintPolicy          *string   `json:"lintPolicy,omitempty"`
+		ProtectReleases     *bool     `json:"protectReleases,omitempty"`
+		ProtectedVersions   []string  `json:"protectedVersions,omitempty"`
+
+		maxUploadSize     int64
+		protectedVersions []*regexp.Regexp
+	}
+
+	tenantsConfig struct {
+		Tenants []*TenantOverrides `json:"tenants"`
+	}
+
+	// tenantSettings are the settings applying to a tenant, once overridden
+	tenantSettings struct {
+		allowOverwrite      bool
+		allowForceOverwrite bool
+		disableDelete       bool
+		enforceSemver2      bool
+		maxStorageObjects   int
+		maxUploadSize       int64
+		chartURL            string
+		anonymousGet        bool
+		lintPolicy          string
+		protectReleases     bool
+		protectedVersions   []*regexp.Regexp
+	}
+
+	storedTenantOverrides struct {
+		overrides *TenantOverrides
+		loaded    time.Time
+	}
+
+	// tenantOverridesCache keeps the overrides read from the tenant.yaml of each tenant
+	tenantOverridesCache struct {
+		lock    sync.Mutex
+		entries map[string]*storedTenantOverrides
+	}
+)
+
+// LoadTenantOverrides reads and validates the tenant overrides in a YAML file
+func LoadTenantOverrides(filename string) ([]*TenantOverrides, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &tenantsConfig{}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	for i, overrides := range config.Tenants {
+		if err := overrides.compile(); err != nil {
+			return nil, fmt.Errorf("tenant %d: %s", i+1, err)
+		}
+	}
+	return config.Tenants, nil
+}
+
+// parseTenantOverrides parses the content of a tenant.yaml, which applies to its tenant only
+func parseTenantOverrides(content []byte) (*TenantOverrides, error) {
+	overrides := &TenantOverrides{}
+	err := yaml.Unmarshal(content, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if overrides.Repo != "" {
+		return nil, fmt.Errorf("repo cannot be set in %s", TenantSettingsFilename)
+	}
+	return overrides, overrides.compile()
+}
+
+// compile validates the repo glob and the limits of the overrides
+func (overrides *TenantOverrides) compile() error {
+	if _, err := pathutil.Match(overrides.Repo, ""); err != nil {
+		return fmt.Errorf("invalid repo glob %q: %s", overrides.Repo, err)
+	}
+	if overrides.MaxStorageObjects != nil && *overrides.MaxStorageObjects < 0 {
+		return fmt.Errorf("maxStorageObjects must not be negative")
+	}
+	if overrides.MaxUploadSize != nil {
+		size, err := ParseByteSize(string(*overrides.MaxUploadSize))
+		if err != nil {
+			return err
+		}
+		overrides.maxUploadSize = size
+	}
+	if overrides.ChartURL != nil {
+		*overrides.ChartURL = strings.TrimSuffix(*overrides.ChartURL, "/")
+	}
+	if overrides.LintPolicy != nil {
+		if err := ValidateLintPolicy(*overrides.LintPolicy); err != nil {
+			return err
+		}
+	}
+	protectedVersions, err := CompileProtectedVersions(overrides.ProtectedVersions)
+	if err != nil {
+		return err
+	}
+	overrides.protectedVersions = protectedVersions
+	return nil
+}
+
+func (overrides *TenantOverrides) matches(repo string) bool {
+	if overrides.Repo == "" {
+		return true
+	}
+	ok, _ := pathutil.Match(overrides.Repo, repo)
+	return ok
+}
+
+func (overrides *TenantOverrides) apply(settings *tenantSettings) {
+	if overrides.AllowOverwrite != nil {
+		settings.allowOverwrite = *overrides.AllowOverwrite
+	}
+	if overrides.AllowForceOverwrite != nil {
+		settings.allowForceOverwrite = *overrides.AllowForceOverwrite
+	}
+	if overrides.DisableDelete != nil {
+		settings.disableDelete = *overrides.DisableDelete
+	}
+	if overrides.EnforceSemver2 != nil {
+		settings.enforceSemver2 = *overrides.EnforceSemver2
+	}
+	if overrides.MaxStorageObjects != nil {
+		settings.maxStorageObjects = *overrides.MaxStorageObjects
+	}
+	if overrides.MaxUploadSize != nil {
+		settings.maxUploadSize = overrides.maxUploadSize
+	}
+	if overrides.ChartURL != nil {
+		settings.chartURL = *overrides.ChartURL
+	}
+	if overrides.AnonymousGet != nil {
+		settings.anonymousGet = *overrides.AnonymousGet
+	}
+	if overrides.LintPolicy != nil {
+		settings.lintPolicy = *overrides.LintPolicy
+	}
+	if overrides.ProtectReleases != nil {
+		settings.protectReleases = *overrides.ProtectReleases
+	}
+	if overrides.ProtectedVersions != nil {
+		settings.protectedVersions = overrides.protectedVersions
+	}
+}
+
+// canOverwrite tells whether an upload may replace an existing file
+func (settings *tenantSettings) canOverwrite(force bool) bool {
+	return settings.allowOverwrite || (settings.allowForceOverwrite && force)
+}
+
+/*
+getTenantSettings returns the settings of a tenant: the ones of the server, overridden by the matching
+entries of the tenants config file in order, and then by the tenant.yaml of the tenant if enabled.
+*/
+func (server *MultiTenantServer) getTenantSettings(log cm_logger.LoggingFn, repo string) *tenantSettings {
+	settings := &tenantSettings{
+		allowOverwrite:      server.AllowOverwrite,
+		allowForceOverwrite: server.AllowForceOverwrite,
+		disableDelete:       server.DisableDelete,
+		enforceSemver2:      server.EnforceSemver2,
+		maxStorageObjects:   server.MaxStorageObjects,
+		anonymousGet:        server.AnonymousGet,
+		lintPolicy:          server.LintPolicy,
+		protectReleases:     server.ProtectReleases,
+		protectedVersions:   server.ProtectedVersions,
+	}
+	if server.ChartURL != "" {
+		settings.chartURL = server.ChartURL
+		if repo != "" {
+			settings.chartURL = settings.chartURL + "/" + repo
+		}
+	}
+	for _, overrides := range server.TenantOverrides {
+		if overrides.matches(repo) {
+			overrides.apply(settings)
+		}
+	}
+	if server.EnableTenantYAML {
+		if overrides := server.getStoredTenantOverrides(log, repo); overrides != nil {
+			overrides.apply(settings)
+		}
+	}
+	return settings
+}
+
+// getStoredTenantOverrides returns the overrides in the tenant.yaml of a tenant, nil if it has none
+func (server *MultiTenantServer) getStoredTenantOverrides(log cm_logger.LoggingFn, repo string) *TenantOverrides {
+	cache := server.storedTenantOverrides
+	cache.lock.Lock()
+	entry, ok := cache.entries[repo]
+	cache.lock.Unlock()
+	if ok && time.Since(entry.loaded) < tenantSettingsCacheTTL {
+		return entry.overrides
+	}
+
+	entry = &storedTenantOverrides{loaded: time.Now()}
+	object, err := server.StorageBackend.GetObject(pathutil.Join(repo, TenantSettingsFilename))
+	if err == nil {
+		entry.overrides, err = parseTenantOverrides(object.Content)
+		if err != nil {
+			// the settings of the server apply, rather than rejecting every request of the tenant
+			log(cm_logger.ErrorLevel, fmt.Sprintf("%s found but could not be parsed", TenantSettingsFilename),
+				"repo", repo,
+				"error", err.Error(),
+			)
+			entry.overrides = nil
+		}
+	}
+	cache.lock.Lock()
+	cache.entries[repo] = entry
+	cache.lock.Unlock()
+	return entry.overrides
+}
+
+func newTenantOverridesCache() *tenantOverridesCache {
+	return &tenantOverridesCache{entries: map[string]*storedTenantOverrides{}}
+}
+
+/*
+authorizePull wraps the handler of a pull route, which is authorized here rather than by the router,
+as anonymous-get may be overridden by tenant.
+*/
+func (server *MultiTenantServer) authorizePull(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !server.authorizeRepo(c, cm_auth.PullAction, c.Param("repo")) {
+			return
+		}
+		handler(c)
+	}
+}
+
+// limitUploadSize limits the size of the request body to the max upload size of the tenant, if it has one
+func (server *MultiTenantServer) limitUploadSize(c *gin.Context, settings *tenantSettings) {
+	if settings.maxUploadSize > 0 {
+		// the limit of the router still applies, the limit of the tenant can only be lower
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, settings.maxUploadSize)
+	}
+}
+
+// uploadTooLargeError returns a 413 if reading the request body failed as it exceeds the max upload size of the tenant
+func uploadTooLargeError(settings *tenantSettings, err error) *HTTPError {
+	// the error of http.MaxBytesReader, possibly wrapped by the multipart reader
+	if settings.maxUploadSize > 0 && strings.Contains(err.Error(), "http: request body too large") {
+		return &HTTPError{http.StatusRequestEntityTooLarge, fmt.Sprintf("request exceeds the max upload size of %s", formatByteSize(settings.maxUploadSize))}
+	}
+	return nil
+}
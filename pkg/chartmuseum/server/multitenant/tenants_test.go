@@ -0,0 +1,186 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	pathutil "path"
+	"testing"
+
+	cm_auth "github.com/chartmuseum/auth"
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+	cm_router "helm.sh/chartmuseum/pkg/chartmuseum/router"
+
+	"github.com/chartmuseum/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type TenantsTestSuite struct {
+	suite.Suite
+	TempDirectory string
+	Logger        *cm_logger.Logger
+}
+
+func (suite *TenantsTestSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "tenants")
+	suite.Nil(err, "no error creating temp dir")
+	suite.TempDirectory = dir
+
+	logger, err := cm_logger.NewLogger(cm_logger.LoggerOptions{})
+	suite.Nil(err, "no error creating logger")
+	suite.Logger = logger
+}
+
+func (suite *TenantsTestSuite) TearDownTest() {
+	os.RemoveAll(suite.TempDirectory)
+}
+
+func (suite *TenantsTestSuite) TestLoadTenantOverrides() {
+	filename := pathutil.Join(suite.TempDirectory, "tenants.yaml")
+	err := ioutil.WriteFile(filename, []byte(`tenants:
+- repo: sandbox
+  allowOverwrite: true
+  maxUploadSize: 1Mi
+- repo: release/*
+  disableDelete: true
+  chartURL: https://charts.example.com/release/
+`), 0644)
+	suite.Nil(err, "no error writing tenants config")
+	overrides, err := LoadTenantOverrides(filename)
+	suite.Nil(err, "no error loading tenant overrides")
+	suite.Len(overrides, 2)
+	suite.Equal(int64(1024*1024), overrides[0].maxUploadSize)
+	suite.Nil(overrides[0].DisableDelete, "unset settings are nil")
+	suite.Equal("https://charts.example.com/release", *overrides[1].ChartURL, "trailing slash trimmed")
+
+	for _, content := range []string{
+		"tenants:\n- repo: \"[\"\n  allowOverwrite: true\n",
+		"tenants:\n- repo: sandbox\n  maxStorageObjects: -1\n",
+		"tenants:\n- repo: sandbox\n  maxUploadSize: lots\n",
+		"tenants:\n- repo: sandbox\n  protectedVersions: [\"(\"]\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		suite.Nil(err, "no error writing tenants config")
+		_, err = LoadTenantOverrides(filename)
+		suite.NotNil(err, "error loading invalid tenant overrides: %s", content)
+	}
+
+	_, err = parseTenantOverrides([]byte("repo: other\nallowOverwrite: true\n"))
+	suite.NotNil(err, "error parsing a tenant.yaml setting repo")
+}
+
+func (suite *TenantsTestSuite) TestGetTenantSettings() {
+	backend := storage.NewLocalFilesystemBackend(suite.TempDirectory)
+	allowOverwrite, disableDelete, maxStorageObjects := true, true, 10
+	server := &MultiTenantServer{
+		StorageBackend:    backend,
+		ChartURL:          "https://charts.example.com",
+		MaxStorageObjects: 100,
+		TenantOverrides: []*TenantOverrides{
+			{Repo: "org1/*", AllowOverwrite: &allowOverwrite, MaxStorageObjects: &maxStorageObjects},
+			{Repo: "org1/release", DisableDelete: &disableDelete},
+		},
+		storedTenantOverrides: newTenantOverridesCache(),
+	}
+	log := suite.Logger.ContextLoggingFn(&gin.Context{})
+
+	settings := server.getTenantSettings(log, "org2")
+	suite.False(settings.allowOverwrite, "server setting")
+	suite.Equal(100, settings.maxStorageObjects, "server setting")
+	suite.Equal("https://charts.example.com/org2", settings.chartURL, "chart URL of the tenant")
+
+	settings = server.getTenantSettings(log, "org1/release")
+	suite.True(settings.allowOverwrite, "setting overridden by glob")
+	suite.True(settings.disableDelete, "setting overridden by repo")
+	suite.Equal(10, settings.maxStorageObjects)
+
+	err := backend.PutObject(pathutil.Join("org1/release", TenantSettingsFilename), []byte("allowOverwrite: false\n"))
+	suite.Nil(err, "no error putting tenant.yaml")
+	suite.True(server.getTenantSettings(log, "org1/release").allowOverwrite, "tenant.yaml ignored unless enabled")
+
+	server.EnableTenantYAML = true
+	settings = server.getTenantSettings(log, "org1/release")
+	suite.False(settings.allowOverwrite, "setting overridden by tenant.yaml")
+	suite.True(settings.disableDelete, "setting not in tenant.yaml kept")
+
+	err = backend.PutObject(pathutil.Join("org1/team1", TenantSettingsFilename), []byte("repo: org1/release\n"))
+	suite.Nil(err, "no error putting tenant.yaml")
+	suite.True(server.getTenantSettings(log, "org1/team1").allowOverwrite, "invalid tenant.yaml ignored")
+}
+
+func (suite *TenantsTestSuite) TestAnonymousGetOverride() {
+	backend := storage.NewLocalFilesystemBackend(suite.TempDirectory)
+	anonymousGet := false
+	router := cm_router.NewRouter(cm_router.RouterOptions{
+		Logger:       suite.Logger,
+		Depth:        1,
+		Username:     "user",
+		Password:     "pass",
+		AnonymousGet: true,
+	})
+	server, err := NewMultiTenantServer(MultiTenantServerOptions{
+		Logger:                 suite.Logger,
+		Router:                 router,
+		StorageBackend:         backend,
+		EnableAPI:              true,
+		ChartPostFormFieldName: "chart",
+		ProvPostFormFieldName:  "prov",
+		IndexLimit:             1,
+		TenantOverrides:        []*TenantOverrides{{Repo: "private", AnonymousGet: &anonymousGet}},
+	})
+	suite.Nil(err, "no error creating server")
+	suite.True(server.AnonymousGet, "anonymous-get kept by the server")
+	suite.Equal([]string{cm_auth.PullAction}, router.Authorizer.AnonymousActions, "router authorizer left unchanged")
+
+	doRequest := func(method string, url string, auth bool) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request, _ = http.NewRequest(method, url, nil)
+		if auth {
+			c.Request.SetBasicAuth("user", "pass")
+		}
+		server.Router.HandleContext(c)
+		return recorder
+	}
+
+	suite.Equal(200, doRequest("GET", "/public/index.yaml", false).Code, "anonymous pull allowed")
+	res := doRequest("GET", "/private/index.yaml", false)
+	suite.Equal(401, res.Code, "anonymous pull denied")
+	suite.NotEmpty(res.Header().Get("WWW-Authenticate"), "authentication challenge")
+	suite.Equal(200, doRequest("GET", "/private/index.yaml", true).Code, "authenticated pull allowed")
+	suite.Equal(401, doRequest("DELETE", "/api/public/charts/mychart/0.1.0", false).Code, "anonymous push denied")
+
+	for _, repo := range []string{"public", "private"} {
+		err = backend.PutObject(pathutil.Join(repo, "mychart-0.1.0.tgz"), []byte{})
+		suite.Nil(err, "no error putting chart package")
+	}
+	res = doRequest("GET", "/api/repos", false)
+	suite.Equal(200, res.Code, "200 GET /api/repos")
+	suite.Contains(res.Body.String(), `"name":"public"`, "public repo listed to anonymous users")
+	suite.NotContains(res.Body.String(), `"name":"private"`, "private repo not listed to anonymous users")
+	res = doRequest("GET", "/api/repos", true)
+	suite.Contains(res.Body.String(), `"name":"private"`, "private repo listed to authenticated users")
+	suite.Equal(401, doRequest("GET", "/api/private/charts/mychart/0.1.0/files/Chart.yaml", false).Code, "anonymous chart file pull denied")
+}
+
+func TestTenantsTestSuite(t *testing.T) {
+	suite.Run(t, new(TenantsTestSuite))
+}
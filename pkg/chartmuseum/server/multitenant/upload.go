@@ -0,0 +1,237 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	pathutil "path"
+	"path/filepath"
+	"time"
+
+	cm_repo "helm.sh/chartmuseum/pkg/repo"
+
+	"github.com/gin-gonic/gin"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+type (
+	// spooledFile is an uploaded file written to a temporary directory as it is received, rather than held in memory
+	spooledFile struct {
+		dir    string
+		path   string
+		size   int64
+		digest string
+	}
+
+	// spooledChartPackage is a spooled chart package, parsed once when received
+	spooledChartPackage struct {
+		*spooledFile
+		filename     string
+		chartVersion *helm_repo.ChartVersion
+	}
+
+	// uploadReport holds the findings on the chart packages of an upload, returned along with its response
+	uploadReport struct {
+		lint       []*lintReport
+		violations []*PolicyViolation
+	}
+)
+
+// spoolFile copies the content of a reader to a temporary file, computing its sha256 digest on the way
+func spoolFile(r io.Reader) (*spooledFile, error) {
+	dir, err := ioutil.TempDir("", "chartmuseum-upload")
+	if err != nil {
+		return nil, err
+	}
+	file := &spooledFile{dir: dir, path: filepath.Join(dir, "upload")}
+	f, err := os.Create(file.path)
+	if err != nil {
+		file.remove()
+		return nil, err
+	}
+	hash := sha256.New()
+	file.size, err = io.Copy(io.MultiWriter(f, hash), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		file.remove()
+		return nil, err
+	}
+	file.digest = hex.EncodeToString(hash.Sum(nil))
+	return file, nil
+}
+
+// spoolChartPackage spools a chart package and parses it
+func spoolChartPackage(r io.Reader, lastModified time.Time) (*spooledChartPackage, error) {
+	file, err := spoolFile(r)
+	if err != nil {
+		return nil, err
+	}
+	chartPackage, err := parseChartPackage(file, lastModified)
+	if err != nil {
+		file.remove()
+		return nil, err
+	}
+	return chartPackage, nil
+}
+
+/*
+parseChartPackage loads the chart of a spooled chart package, and renames the file after the chart version,
+as provenance verification checks the filename of the package. The chart version is the one added to the index.
+*/
+func parseChartPackage(file *spooledFile, lastModified time.Time) (*spooledChartPackage, error) {
+	f, err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	chart, err := loader.LoadArchive(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	filename := cm_repo.ChartPackageFilenameFromNameVersion(chart.Metadata.Name, chart.Metadata.Version)
+	if pathutil.Base(filename) == filename {
+		// an improperly formatted filename is rejected by the caller, the file must not leave its directory
+		path := filepath.Join(file.dir, filename)
+		if err = os.Rename(file.path, path); err != nil {
+			return nil, err
+		}
+		file.path = path
+	}
+	chartPackage := &spooledChartPackage{
+		spooledFile: file,
+		filename:    filename,
+		chartVersion: &helm_repo.ChartVersion{
+			URLs:     []string{fmt.Sprintf("charts/%s", filename)},
+			Metadata: chart.Metadata,
+			Digest:   file.digest,
+			Created:  lastModified,
+		},
+	}
+	return chartPackage, nil
+}
+
+func (file *spooledFile) open() (*os.File, error) {
+	return os.Open(file.path)
+}
+
+// readAll reads a spooled file in memory, for small files or storage backends which cannot stream uploads
+func (file *spooledFile) readAll() ([]byte, error) {
+	return ioutil.ReadFile(file.path)
+}
+
+func (file *spooledFile) remove() {
+	os.RemoveAll(file.dir)
+}
+
+/*
+extractFilesFromRequest spools the files of the given form fields of a multipart request, reading the request
+body as a stream. Only the first file of each field is kept.
+*/
+func extractFilesFromRequest(req *http.Request, fields []string) (map[string]*spooledFile, error) {
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, field := range fields {
+		wanted[field] = true
+	}
+	files := map[string]*spooledFile{}
+	for {
+		var part *multipart.Part
+		part, err = reader.NextPart()
+		if err != nil {
+			break
+		}
+		field := part.FormName()
+		if !wanted[field] || part.FileName() == "" || files[field] != nil {
+			continue // skipped by the next call to NextPart
+		}
+		file, spoolErr := spoolFile(part)
+		if spoolErr != nil {
+			err = spoolErr
+			break
+		}
+		files[field] = file
+	}
+	if err != io.EOF {
+		for _, file := range files {
+			file.remove()
+		}
+		return nil, err
+	}
+	return files, nil
+}
+
+// version returns the chart version of a chart package, as parsed when it was received, or of a provenance file
+func (ppf *chartOrProvenanceFile) version() string {
+	if ppf.chart != nil {
+		return ppf.chart.chartVersion.Version
+	}
+	return provenanceVersion(ppf.content)
+}
+
+func (ppf *chartOrProvenanceFile) size() int64 {
+	if ppf.chart != nil {
+		return ppf.chart.size
+	}
+	return int64(len(ppf.content))
+}
+
+// removeChartOrProvenanceFiles removes the spooled chart packages of an upload once it has been handled
+func removeChartOrProvenanceFiles(cpFiles map[string]*chartOrProvenanceFile) {
+	for _, ppf := range cpFiles {
+		if ppf.chart != nil {
+			ppf.chart.remove()
+		}
+	}
+}
+
+// response adds the policy violations and lint findings of an upload to its response
+func (report *uploadReport) response(h gin.H) gin.H {
+	if report == nil {
+		return h
+	}
+	var messages []*lintMessage
+	for _, lint := range report.lint {
+		messages = append(messages, lint.Messages...)
+	}
+	if len(messages) == 0 && len(report.violations) == 0 {
+		return h
+	}
+	response := gin.H{}
+	for key, value := range h {
+		response[key] = value
+	}
+	if len(report.violations) > 0 {
+		response["violations"] = report.violations
+	}
+	if len(messages) > 0 {
+		response["lint"] = messages
+	}
+	return response
+}
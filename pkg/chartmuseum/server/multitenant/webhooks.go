@@ -0,0 +1,323 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	pathutil "path"
+	"sync"
+	"time"
+
+	cm_logger "helm.sh/chartmuseum/pkg/chartmuseum/logger"
+
+	"github.com/ghodss/yaml"
+	"github.com/gin-gonic/gin"
+	helm_repo "helm.sh/helm/v3/pkg/repo"
+)
+
+const (
+	// WebhookEventHeader holds the event of a webhook delivery
+	WebhookEventHeader = "X-ChartMuseum-Event"
+	// WebhookDeliveryHeader holds the ID of a webhook delivery, which is the same for all its attempts
+	WebhookDeliveryHeader = "X-ChartMuseum-Delivery"
+	// WebhookSignatureHeader holds the HMAC-SHA256 of the payload, keyed with the secret of the webhook
+	WebhookSignatureHeader = "X-ChartMuseum-Signature"
+)
+
+var (
+	// a delivery is attempted up to webhookMaxAttempts times, the backoff between attempts doubling each time
+	webhookMaxAttempts = 5
+	webhookBackoff     = time.Second
+	webhookTimeout     = 10 * time.Second
+
+	// number of deliveries kept in the delivery log of each tenant
+	webhookDeliveryLogSize = 100
+)
+
+type (
+	/*
+		Webhook is a subscription to the chart events of the tenants matching Repo (a glob, as in path.Match,
+		matching every tenant when empty). Events restricts the events sent, all of them being sent when empty:
+
+			webhooks:
+			# trigger an ArgoCD sync for new chart versions of the org1 tenants
+			- name: argocd
+			  url: https://argocd.example.com/api/webhook
+			  secret: changeme
+			  repo: org1/*
+			  events: [chart.added]
+	*/
+	Webhook struct {
+		Name   string   `json:"name,omitempty"`
+		URL    string   `json:"url"`
+		Secret string   `json:"secret,omitempty"`
+		Repo   string   `json:"repo,omitempty"`
+		Events []string `json:"events,omitempty"`
+	}
+
+	// WebhookPayload is the JSON body POSTed to a webhook
+	WebhookPayload struct {
+		ID        string                  `json:"id"`
+		Event     string                  `json:"event"`
+		Repo      string                  `json:"repo"`
+		Chart     *helm_repo.ChartVersion `json:"chart"`
+		Timestamp time.Time               `json:"timestamp"`
+	}
+
+	// WebhookDelivery is an entry of the delivery log of a tenant
+	WebhookDelivery struct {
+		ID          string     `json:"id"`
+		Webhook     string     `json:"webhook"`
+		Event       string     `json:"event"`
+		Name        string     `json:"name"`
+		Version     string     `json:"version"`
+		Attempts    int        `json:"attempts"`
+		StatusCode  int        `json:"statusCode,omitempty"`
+		Error       string     `json:"error,omitempty"`
+		Delivered   bool       `json:"delivered"`
+		CreatedAt   time.Time  `json:"createdAt"`
+		DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	}
+
+	webhookConfig struct {
+		Webhooks []*Webhook `json:"webhooks"`
+	}
+
+	// webhookDeliveryLog keeps the latest deliveries of each tenant in memory
+	webhookDeliveryLog struct {
+		lock       sync.Mutex
+		deliveries map[string][]*WebhookDelivery
+	}
+)
+
+// LoadWebhooks reads and validates the webhook subscriptions in a YAML file
+func LoadWebhooks(filename string) ([]*Webhook, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &webhookConfig{}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, err
+	}
+	for i, webhook := range config.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return nil, fmt.Errorf("webhook %d: %s", i+1, err)
+		}
+	}
+	return config.Webhooks, nil
+}
+
+// validate checks the URL, repo glob and events of the webhook, naming it after its host if it has no name
+func (webhook *Webhook) validate() error {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", webhook.URL)
+	}
+	if _, err := pathutil.Match(webhook.Repo, ""); err != nil {
+		return fmt.Errorf("invalid repo glob %q: %s", webhook.Repo, err)
+	}
+	for _, event := range webhook.Events {
+		valid := false
+		for _, name := range chartEvents {
+			valid = valid || event == name
+		}
+		if !valid {
+			return fmt.Errorf("invalid event %q", event)
+		}
+	}
+	if webhook.Name == "" {
+		webhook.Name = u.Host
+	}
+	return nil
+}
+
+func (webhook *Webhook) matches(repo string, event string) bool {
+	if webhook.Repo != "" {
+		if ok, _ := pathutil.Match(webhook.Repo, repo); !ok {
+			return false
+		}
+	}
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, e := range webhook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the value of the signature header for a payload, empty if the webhook has no secret
+func (webhook *Webhook) sign(payload []byte) string {
+	if webhook.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+notifyWebhooks sends an event to the webhooks subscribed to it, once the index of the tenant has been
+regenerated, so receivers fetching index.yaml see the change. Deliveries happen in the background.
+*/
+func (server *MultiTenantServer) notifyWebhooks(log cm_logger.LoggingFn, repo string, operationType operationType, chartVersion *helm_repo.ChartVersion) {
+	event := chartEvents[operationType]
+	for _, webhook := range server.Webhooks {
+		if !webhook.matches(repo, event) {
+			continue
+		}
+		id := make([]byte, 16)
+		rand.Read(id)
+		payload := &WebhookPayload{
+			ID:        hex.EncodeToString(id),
+			Event:     event,
+			Repo:      repo,
+			Chart:     chartVersion,
+			Timestamp: time.Now(),
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log(cm_logger.ErrorLevel, "Error encoding webhook payload",
+				"repo", repo,
+				"webhook", webhook.Name,
+				"error", err.Error(),
+			)
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:        payload.ID,
+			Webhook:   webhook.Name,
+			Event:     event,
+			Name:      chartVersion.Name,
+			Version:   chartVersion.Version,
+			CreatedAt: payload.Timestamp,
+		}
+		server.webhookDeliveries.add(repo, delivery)
+		go server.deliverWebhook(webhook, delivery, body)
+	}
+}
+
+// deliverWebhook POSTs a payload to a webhook, retrying with an exponential backoff until it answers with a 2xx
+func (server *MultiTenantServer) deliverWebhook(webhook *Webhook, delivery *WebhookDelivery, body []byte) {
+	log := server.Logger.ContextLoggingFn(&gin.Context{})
+	client := &http.Client{Timeout: webhookTimeout}
+	signature := webhook.sign(body)
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		statusCode, err := postWebhook(client, webhook.URL, delivery, signature, body)
+		server.webhookDeliveries.update(func() {
+			delivery.Attempts = attempt
+			delivery.StatusCode = statusCode
+			delivery.Error = ""
+			if err != nil {
+				delivery.Error = err.Error()
+			} else {
+				now := time.Now()
+				delivery.Delivered = true
+				delivery.DeliveredAt = &now
+			}
+		})
+		if err == nil {
+			log(cm_logger.DebugLevel, "Webhook delivered",
+				"webhook", webhook.Name,
+				"delivery", delivery.ID,
+				"attempts", attempt,
+			)
+			return
+		}
+		log(cm_logger.WarnLevel, "Webhook delivery failed",
+			"webhook", webhook.Name,
+			"delivery", delivery.ID,
+			"attempt", attempt,
+			"error", err.Error(),
+		)
+	}
+}
+
+func postWebhook(client *http.Client, url string, delivery *WebhookDelivery, signature string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	if signature != "" {
+		req.Header.Set(WebhookSignatureHeader, signature)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook answered with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+func newWebhookDeliveryLog() *webhookDeliveryLog {
+	return &webhookDeliveryLog{deliveries: map[string][]*WebhookDelivery{}}
+}
+
+// add records a delivery, dropping the oldest delivery of the tenant if its log is full
+func (deliveryLog *webhookDeliveryLog) add(repo string, delivery *WebhookDelivery) {
+	deliveryLog.lock.Lock()
+	defer deliveryLog.lock.Unlock()
+	deliveries := append(deliveryLog.deliveries[repo], delivery)
+	if len(deliveries) > webhookDeliveryLogSize {
+		deliveries = deliveries[len(deliveries)-webhookDeliveryLogSize:]
+	}
+	deliveryLog.deliveries[repo] = deliveries
+}
+
+// update changes deliveries while holding the lock of the log
+func (deliveryLog *webhookDeliveryLog) update(fn func()) {
+	deliveryLog.lock.Lock()
+	defer deliveryLog.lock.Unlock()
+	fn()
+}
+
+// list returns copies of the deliveries of a tenant, newest first
+func (deliveryLog *webhookDeliveryLog) list(repo string) []WebhookDelivery {
+	deliveryLog.lock.Lock()
+	defer deliveryLog.lock.Unlock()
+	deliveries := deliveryLog.deliveries[repo]
+	result := make([]WebhookDelivery, 0, len(deliveries))
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		result = append(result, *deliveries[i])
+	}
+	return result
+}
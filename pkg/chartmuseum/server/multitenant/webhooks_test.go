@@ -0,0 +1,93 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multitenant
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	pathutil "path"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type WebhooksTestSuite struct {
+	suite.Suite
+}
+
+func (suite *WebhooksTestSuite) TestLoadWebhooks() {
+	dir, err := ioutil.TempDir("", "webhooks")
+	suite.Nil(err, "no error creating temp dir")
+	defer os.RemoveAll(dir)
+
+	filename := pathutil.Join(dir, "webhooks.yaml")
+	err = ioutil.WriteFile(filename, []byte(`webhooks:
+- name: argocd
+  url: https://argocd.example.com/api/webhook
+  secret: changeme
+  repo: org1/*
+  events: [chart.added]
+- url: http://slack.example.com:8080/notify
+`), 0644)
+	suite.Nil(err, "no error writing webhooks config")
+	webhooks, err := LoadWebhooks(filename)
+	suite.Nil(err, "no error loading webhooks")
+	suite.Len(webhooks, 2)
+	suite.Equal("argocd", webhooks[0].Name)
+	suite.Equal("slack.example.com:8080", webhooks[1].Name, "webhook named after its host")
+
+	for _, content := range []string{
+		"webhooks:\n- url: ftp://example.com\n",
+		"webhooks:\n- url: not a url\n",
+		"webhooks:\n- url: https://example.com\n  repo: \"[\"\n",
+		"webhooks:\n- url: https://example.com\n  events: [chart.promoted]\n",
+	} {
+		err = ioutil.WriteFile(filename, []byte(content), 0644)
+		suite.Nil(err, "no error writing webhooks config")
+		_, err = LoadWebhooks(filename)
+		suite.NotNil(err, "error loading invalid webhooks: %s", content)
+	}
+}
+
+func (suite *WebhooksTestSuite) TestMatches() {
+	webhook := &Webhook{URL: "https://example.com", Repo: "org1/*", Events: []string{"chart.added", "chart.deleted"}}
+	suite.Nil(webhook.validate(), "no error validating webhook")
+	suite.True(webhook.matches("org1/team1", "chart.added"))
+	suite.True(webhook.matches("org1/team2", "chart.deleted"))
+	suite.False(webhook.matches("org1/team1", "chart.updated"), "event not subscribed")
+	suite.False(webhook.matches("org2/team1", "chart.added"), "repo not subscribed")
+
+	webhook = &Webhook{URL: "https://example.com"}
+	suite.Nil(webhook.validate(), "no error validating webhook")
+	suite.True(webhook.matches("", "chart.updated"), "all repos and events subscribed")
+}
+
+func (suite *WebhooksTestSuite) TestSign() {
+	payload := []byte(`{"event":"chart.added"}`)
+	suite.Empty((&Webhook{}).sign(payload), "payload not signed without secret")
+
+	mac := hmac.New(sha256.New, []byte("changeme"))
+	mac.Write(payload)
+	suite.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), (&Webhook{Secret: "changeme"}).sign(payload))
+}
+
+func TestWebhooksTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhooksTestSuite))
+}
@@ -52,6 +52,15 @@ func (suite *ServerTestSuite) TestNewServer() {
 	multiTenantServer, err := NewServer(serverOptions)
 	suite.NotNil(multiTenantServer)
 	suite.Nil(err)
+
+	serverOptions.SignedOnlyRepos = "org1/prod"
+	_, err = NewServer(serverOptions)
+	suite.NotNil(err, "error with signed-only repos and no keyring")
+
+	serverOptions.VerifyKeyring = "../../testdata/pgp/helm-test-key.pub"
+	multiTenantServer, err = NewServer(serverOptions)
+	suite.NotNil(multiTenantServer)
+	suite.Nil(err, "no error with signed-only repos and a keyring")
 }
 
 func TestServerTestSuite(t *testing.T) {
@@ -757,6 +757,196 @@ var configVars = map[string]configVar{
 			EnvVar: "CACHE_INTERVAL",
 		},
 	},
+	"retention.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "retention-config",
+			Usage:  "path to a YAML file with retention rules for pruning chart versions",
+			EnvVar: "RETENTION_CONFIG",
+		},
+	},
+	"retention.interval": {
+		Type:    durationType,
+		Default: time.Duration(0),
+		CLIFlag: cli.DurationFlag{
+			Name:   "retention-interval",
+			Usage:  "set the interval of enforcing the retention rules",
+			EnvVar: "RETENTION_INTERVAL",
+		},
+	},
+	"chartfilescachesize": {
+		Type:    stringType,
+		Default: "100Mi",
+		CLIFlag: cli.StringFlag{
+			Name:   "chart-files-cache-size",
+			Usage:  "maximum size of the chart files cached in memory for the chart files routes, in bytes or with a unit such as 100Mi",
+			EnvVar: "CHART_FILES_CACHE_SIZE",
+		},
+	},
+	"verifykeyring": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "verify-keyring",
+			Usage:  "path to a keyring used to verify the signature and digest of uploaded provenance files",
+			EnvVar: "VERIFY_KEYRING",
+		},
+	},
+	"requiresignedcharts": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "require-signed-charts",
+			Usage:  "only accept and serve chart versions with a provenance file verified against --verify-keyring",
+			EnvVar: "REQUIRE_SIGNED_CHARTS",
+		},
+	},
+	"signedonlyrepos": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "signed-only-repos",
+			Usage:  "comma-separated list of repos (or glob patterns) which only accept and serve signed chart versions",
+			EnvVar: "SIGNED_ONLY_REPOS",
+		},
+	},
+	"stagingtimeout": {
+		Type:    durationType,
+		Default: time.Hour,
+		CLIFlag: cli.DurationFlag{
+			Name:   "staging-timeout",
+			Usage:  "age after which files staged by interrupted uploads are deleted (0 to never delete them)",
+			EnvVar: "STAGING_TIMEOUT",
+		},
+	},
+	"webhooks.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "webhooks-config",
+			Usage:  "path to a YAML file with webhooks notified of chart events",
+			EnvVar: "WEBHOOKS_CONFIG",
+		},
+	},
+	"audit.store": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "audit-store",
+			Usage:  "where to keep the audit log of write operations (\"storage\" or \"local\", disabled if empty)",
+			EnvVar: "AUDIT_STORE",
+		},
+	},
+	"audit.file": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "audit-file",
+			Usage:  "path of the file the audit log is appended to, with --audit-store=local",
+			EnvVar: "AUDIT_FILE",
+		},
+	},
+	"quota.default": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-quota",
+			Usage:  "default storage quota of each repo, in bytes or with a unit such as 500Mi or 10G (no quota if empty)",
+			EnvVar: "STORAGE_QUOTA",
+		},
+	},
+	"quota.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "storage-quota-config",
+			Usage:  "path to a YAML file with storage quotas overriding the default one for some repos",
+			EnvVar: "STORAGE_QUOTA_CONFIG",
+		},
+	},
+	"lint.policy": {
+		Type:    stringType,
+		Default: "off",
+		CLIFlag: cli.StringFlag{
+			Name:   "lint-policy",
+			Usage:  "lint uploaded chart packages, reporting the findings (warn) or also rejecting the packages with errors (reject)",
+			Value:  "off",
+			EnvVar: "LINT_POLICY",
+		},
+	},
+	"uploadpolicy.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "upload-policy-config",
+			Usage:  "path to a YAML file with policies uploaded chart packages must follow",
+			EnvVar: "UPLOAD_POLICY_CONFIG",
+		},
+	},
+	"protectreleases": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "protect-releases",
+			Usage:  "never overwrite or delete published release (non-prerelease) versions, even with ?force",
+			EnvVar: "PROTECT_RELEASES",
+		},
+	},
+	"protectedversions": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "protected-versions",
+			Usage:  "comma-separated list of regular expressions matching chart versions which are never overwritten or deleted once published",
+			EnvVar: "PROTECTED_VERSIONS",
+		},
+	},
+	"enableoci": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "enable-oci",
+			Usage:  "serve the OCI distribution API below /v2/, to push and pull charts with helm as OCI artifacts",
+			EnvVar: "ENABLE_OCI",
+		},
+	},
+	"proxy.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "proxy-config",
+			Usage:  "path to a YAML file with upstream chart repositories proxied by some repos",
+			EnvVar: "PROXY_CONFIG",
+		},
+	},
+	"proxy.interval": {
+		Type:    durationType,
+		Default: 5 * time.Minute,
+		CLIFlag: cli.DurationFlag{
+			Name:   "proxy-interval",
+			Usage:  "set the interval of fetching the index of the proxied upstream repositories",
+			EnvVar: "PROXY_INTERVAL",
+		},
+	},
+	"tenants.config": {
+		Type:    stringType,
+		Default: "",
+		CLIFlag: cli.StringFlag{
+			Name:   "tenants-config",
+			Usage:  "path to a YAML file with settings overriding the server ones for some repos",
+			EnvVar: "TENANTS_CONFIG",
+		},
+	},
+	"tenants.enableyaml": {
+		Type:    boolType,
+		Default: false,
+		CLIFlag: cli.BoolFlag{
+			Name:   "enable-tenant-yaml",
+			Usage:  "allow each repo to override the server settings with a tenant.yaml stored in it",
+			EnvVar: "ENABLE_TENANT_YAML",
+		},
+	},
 	"listen.host": {
 		Type:    stringType,
 		Default: "0.0.0.0",